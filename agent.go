@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/kononovn/testcmd/netutils"
+	"github.com/kononovn/testcmd/servers"
+)
+
+const (
+	agentCommand = "agent"
+
+	// agentTokenEnv is the environment variable with the bearer token used when -token-file is not set
+	agentTokenEnv = "TESTCMD_AGENT_TOKEN"
+
+	agentTestsPath   = "/v1/tests"
+	agentServersPath = "/v1/servers"
+
+	agentMaxBodySize = 1 << 20
+)
+
+// agent exposes the client tests and servers over authenticated HTTP API
+type agent struct {
+	token   string
+	mutex   sync.Mutex
+	nextID  int
+	servers map[string]*agentServer
+}
+
+// agentServer is a server started by the API
+type agentServer struct {
+	ID      string     `json:"id"`
+	Spec    serverSpec `json:"spec"`
+	Started string     `json:"started"`
+	Running bool       `json:"running"`
+	Error   string     `json:"error,omitempty"`
+	server  *servers.Server
+}
+
+type agentError struct {
+	Error string `json:"error"`
+}
+
+// runAgent runs the agent command and returns the exit code
+func runAgent(args []string) int {
+	flags := flag.NewFlagSet(agentCommand, flag.ExitOnError)
+	address := flags.String("listen-address", ":9090", "Address of the HTTP API")
+	tokenFile := flags.String("token-file", "", "File with the bearer token required by the API (default $"+agentTokenEnv+")")
+	tlsCert := flags.String("tls-cert", "", "TLS certificate file, the API is served over HTTPS when set")
+	tlsKey := flags.String("tls-key", "", "TLS key file")
+	flags.Parse(args)
+
+	token, err := readToken(*tokenFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	if (*tlsCert == "") != (*tlsKey == "") {
+		fmt.Fprintf(os.Stderr, "error: -tls-cert and -tls-key must be set together\n")
+		return 1
+	}
+
+	testAgent := &agent{token: token, servers: map[string]*agentServer{}}
+	httpServer := &http.Server{Addr: *address, Handler: testAgent.handler()}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Printf("Agent received %s, stopping", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		httpServer.Shutdown(ctx)
+	}()
+
+	log.Printf("Start agent API on %s", *address)
+	if *tlsCert != "" {
+		err = httpServer.ListenAndServeTLS(*tlsCert, *tlsKey)
+	} else {
+		err = httpServer.ListenAndServe()
+	}
+	testAgent.stopServers()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// readToken reads the bearer token from the file or the environment, the API is never served without token
+func readToken(tokenFile string) (string, error) {
+	token := os.Getenv(agentTokenEnv)
+	if tokenFile != "" {
+		data, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return "", err
+		}
+		token = string(data)
+	}
+	token = strings.TrimSpace(token)
+	if token == "" {
+		return "", fmt.Errorf("token is required, use -token-file or %s", agentTokenEnv)
+	}
+	return token, nil
+}
+
+func (testAgent *agent) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(healthPath, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.Handle(agentTestsPath, testAgent.authenticated(testAgent.handleTests))
+	mux.Handle(agentServersPath, testAgent.authenticated(testAgent.handleServers))
+	mux.Handle(agentServersPath+"/", testAgent.authenticated(testAgent.handleServer))
+	return mux
+}
+
+// authenticated requires the bearer token, the comparison takes constant time
+func (testAgent *agent) authenticated(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(token), []byte(testAgent.token)) != 1 {
+			writeAgentJSON(w, http.StatusUnauthorized, agentError{Error: "unauthorized"})
+			return
+		}
+		next(w, r)
+	})
+}
+
+// handleTests runs the test given as plan test and returns its report
+func (testAgent *agent) handleTests(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAgentJSON(w, http.StatusMethodNotAllowed, agentError{Error: "method not allowed"})
+		return
+	}
+	test := planTest{}
+	err := readAgentBody(r, &test)
+	if err != nil {
+		writeAgentJSON(w, http.StatusBadRequest, agentError{Error: err.Error()})
+		return
+	}
+	if test.Name == "" {
+		test.Name = "test"
+	}
+	log.Printf("Agent test %s started by %s", test.Name, r.RemoteAddr)
+	report := test.run()
+	log.Printf("Agent test %s finished, passed=%t", test.Name, report.Passed)
+	writeAgentJSON(w, http.StatusOK, report)
+}
+
+// handleServers lists and starts servers
+func (testAgent *agent) handleServers(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeAgentJSON(w, http.StatusOK, testAgent.listServers())
+	case http.MethodPost:
+		spec := serverSpec{}
+		err := readAgentBody(r, &spec)
+		if err != nil {
+			writeAgentJSON(w, http.StatusBadRequest, agentError{Error: err.Error()})
+			return
+		}
+		started, err := testAgent.startServer(spec)
+		if err != nil {
+			writeAgentJSON(w, http.StatusBadRequest, agentError{Error: err.Error()})
+			return
+		}
+		writeAgentJSON(w, http.StatusCreated, started)
+	default:
+		writeAgentJSON(w, http.StatusMethodNotAllowed, agentError{Error: "method not allowed"})
+	}
+}
+
+// handleServer shows or stops the server given by id
+func (testAgent *agent) handleServer(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, agentServersPath+"/")
+	switch r.Method {
+	case http.MethodGet:
+		server := testAgent.server(id)
+		if server == nil {
+			writeAgentJSON(w, http.StatusNotFound, agentError{Error: fmt.Sprintf("server %s not found", id)})
+			return
+		}
+		writeAgentJSON(w, http.StatusOK, server)
+	case http.MethodDelete:
+		server := testAgent.stopServer(id)
+		if server == nil {
+			writeAgentJSON(w, http.StatusNotFound, agentError{Error: fmt.Sprintf("server %s not found", id)})
+			return
+		}
+		writeAgentJSON(w, http.StatusOK, server)
+	default:
+		writeAgentJSON(w, http.StatusMethodNotAllowed, agentError{Error: "method not allowed"})
+	}
+}
+
+func (testAgent *agent) startServer(spec serverSpec) (agentServer, error) {
+	err := checkCapabilities(true, spec.Protocol, 0, netutils.BindDevice(spec.Interface, spec.VRF), spec.Port, spec.SourcePort,
+		spec.Multicast, spec.Broadcast, false)
+	if err != nil {
+		return agentServer{}, err
+	}
+	server, err := spec.start(nil)
+	if err != nil {
+		return agentServer{}, err
+	}
+	testAgent.mutex.Lock()
+	defer testAgent.mutex.Unlock()
+	testAgent.nextID++
+	started := &agentServer{
+		ID:      strconv.Itoa(testAgent.nextID),
+		Spec:    spec,
+		Started: time.Now().UTC().Format(time.RFC3339),
+		Running: true,
+		server:  server,
+	}
+	testAgent.servers[started.ID] = started
+	log.Printf("Agent server %s started: %s port %d", started.ID, spec.Protocol, spec.Port)
+	go func() {
+		// server stopped by itself keeps the error until it is deleted
+		err := server.Wait()
+		testAgent.mutex.Lock()
+		defer testAgent.mutex.Unlock()
+		started.Running = false
+		if err != nil {
+			started.Error = err.Error()
+			log.Printf("Agent server %s stopped: %v", started.ID, err)
+		}
+	}()
+	return *started, nil
+}
+
+func (testAgent *agent) server(id string) *agentServer {
+	testAgent.mutex.Lock()
+	defer testAgent.mutex.Unlock()
+	server, ok := testAgent.servers[id]
+	if !ok {
+		return nil
+	}
+	copied := *server
+	return &copied
+}
+
+func (testAgent *agent) listServers() []agentServer {
+	testAgent.mutex.Lock()
+	defer testAgent.mutex.Unlock()
+	list := make([]agentServer, 0, len(testAgent.servers))
+	for _, server := range testAgent.servers {
+		list = append(list, *server)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		left, _ := strconv.Atoi(list[i].ID)
+		right, _ := strconv.Atoi(list[j].ID)
+		return left < right
+	})
+	return list
+}
+
+// stopServer stops and forgets the server
+func (testAgent *agent) stopServer(id string) *agentServer {
+	testAgent.mutex.Lock()
+	server, ok := testAgent.servers[id]
+	delete(testAgent.servers, id)
+	testAgent.mutex.Unlock()
+	if !ok {
+		return nil
+	}
+	err := server.server.Close()
+	if err != nil {
+		log.Printf("Agent server %s stop error: %v", id, err)
+	}
+	log.Printf("Agent server %s stopped", id)
+	return testAgent.stoppedCopy(server)
+}
+
+func (testAgent *agent) stoppedCopy(server *agentServer) *agentServer {
+	testAgent.mutex.Lock()
+	defer testAgent.mutex.Unlock()
+	copied := *server
+	copied.Running = false
+	return &copied
+}
+
+func (testAgent *agent) stopServers() {
+	for _, server := range testAgent.listServers() {
+		testAgent.stopServer(server.ID)
+	}
+}
+
+func readAgentBody(r *http.Request, out interface{}) error {
+	data, err := io.ReadAll(io.LimitReader(r.Body, agentMaxBodySize))
+	if err != nil {
+		return err
+	}
+	return decodeStrict(data, out)
+}
+
+func writeAgentJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	err := encoder.Encode(body)
+	if err != nil {
+		log.Printf("Agent response error: %v", err)
+	}
+}
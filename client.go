@@ -0,0 +1,540 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kononovn/testcmd/netutils"
+	"github.com/kononovn/testcmd/protocols"
+)
+
+// clientTest keeps parameters of the client test. Server is literal address or hostname resolved
+// to addresses of the family, the first one is tested unless all addresses are requested
+type clientTest struct {
+	Protocol     string
+	Server       string
+	Family       string
+	AllAddresses bool
+	Port         int
+	Packages     int
+	MTU          int
+	MTUStrict    bool
+	Negative     bool
+	TimeoutTCP   int
+	TimeoutUDP   int
+	Interface    string
+	VRF          string
+	Source       string
+	SourcePort   int
+	Multicast    bool
+	Broadcast    bool
+	Directed     bool
+	Routing      protocols.Routing
+	Reflect      protocols.Reflect
+	Flows        protocols.Flows
+	Trace        bool
+	MaxHops      int
+	Diagnostics  bool
+	WaitPeer     time.Duration
+	// HappyEyeballs measures connect preference of dual-stack tcp client
+	HappyEyeballs bool
+	// Expectation is the reception assertion of udp multicast/broadcast receiver
+	Expectation *receptionExpectation
+	network     *netutils.NetworkStatus
+}
+
+// clientResult is the result of the test against single resolved address
+type clientResult struct {
+	Address  string
+	Duration time.Duration
+	Err      error
+	Result   *protocols.Result
+}
+
+func validateFamily(family string) error {
+	switch family {
+	case netutils.FamilyIPv4, netutils.FamilyIPv6, netutils.FamilyAny, netutils.FamilyDual:
+		return nil
+	}
+	return fmt.Errorf("Unsupported parameter family=%s. Options: %s/%s/%s/%s",
+		family, netutils.FamilyIPv4, netutils.FamilyIPv6, netutils.FamilyAny, netutils.FamilyDual)
+}
+
+// addresses returns destination addresses of the test. Broadcast destination is defined by the
+// interface, other servers are resolved
+func (test *clientTest) addresses() ([]string, *netutils.Resolution, error) {
+	if test.Broadcast {
+		host, zone := netutils.SplitZone(test.Server)
+		err := test.defineZoneInterface(zone)
+		if err != nil {
+			return nil, nil, err
+		}
+		address, err := defineBroadcastAddress(host, test.Directed, test.Interface)
+		if err != nil {
+			return nil, nil, err
+		}
+		address, err = test.scopedAddress(net.ParseIP(address))
+		if err != nil {
+			return nil, nil, err
+		}
+		return []string{address}, nil, nil
+	}
+	if test.Family == netutils.FamilyDual {
+		return test.dualAddresses()
+	}
+	resolution, err := test.resolve(test.Server, test.Family)
+	if err != nil {
+		return nil, resolution, err
+	}
+	if netutils.ParseIP(test.Server) == nil {
+		log.Print(resolution)
+	}
+	addresses, err := test.validateAddresses(resolution.Addresses)
+	if err != nil {
+		return nil, resolution, err
+	}
+	if !test.AllAddresses {
+		addresses = addresses[:1]
+	}
+	return addresses, resolution, nil
+}
+
+// dualAddresses resolves hostname or comma separated pair of addresses and returns the preferred
+// address of each family, IPv4 first, or every address of both families when all addresses are requested
+func (test *clientTest) dualAddresses() ([]string, *netutils.Resolution, error) {
+	resolution := &netutils.Resolution{Host: test.Server}
+	for _, host := range strings.Split(test.Server, ",") {
+		hostResolution, err := test.resolve(strings.TrimSpace(host), netutils.FamilyDual)
+		if err != nil {
+			return nil, hostResolution, err
+		}
+		resolution.Addresses = append(resolution.Addresses, hostResolution.Addresses...)
+		resolution.Duration += hostResolution.Duration
+	}
+	log.Print(resolution)
+	addresses, err := test.validateAddresses(resolution.Addresses)
+	if err != nil {
+		return nil, resolution, err
+	}
+	var ipv4, ipv6 []string
+	for _, address := range addresses {
+		if ipProtocolVersion(address) == 4 {
+			ipv4 = append(ipv4, address)
+		} else {
+			ipv6 = append(ipv6, address)
+		}
+	}
+	if len(ipv4) == 0 || len(ipv6) == 0 {
+		return nil, resolution, fmt.Errorf("Unsupported parameter server=%s requires both IPv4 and IPv6 address with family=%s",
+			test.Server, netutils.FamilyDual)
+	}
+	if !test.AllAddresses {
+		ipv4, ipv6 = ipv4[:1], ipv6[:1]
+	}
+	return append(ipv4, ipv6...), resolution, nil
+}
+
+// resolve resolves the host, zone of the link-local address selects the interface
+func (test *clientTest) resolve(server string, family string) (*netutils.Resolution, error) {
+	host, zone := netutils.SplitZone(server)
+	err := test.defineZoneInterface(zone)
+	if err != nil {
+		return nil, err
+	}
+	resolution, err := netutils.ResolveHost(host, family)
+	if err != nil {
+		return resolution, fmt.Errorf("Unsupported parameter server=%s %s", server, err)
+	}
+	return resolution, nil
+}
+
+// validateAddresses validates resolved addresses and scopes link-local ones to the interface
+func (test *clientTest) validateAddresses(ips []net.IP) ([]string, error) {
+	addresses := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		err := validateIP(ip.String(), test.Multicast)
+		if err != nil {
+			return nil, err
+		}
+		address, err := test.scopedAddress(ip)
+		if err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, address)
+	}
+	return addresses, nil
+}
+
+// defineZoneInterface uses the zone of the server address as the interface unless the interface is set
+func (test *clientTest) defineZoneInterface(zone string) error {
+	if zone == "" {
+		return nil
+	}
+	intFace, err := netutils.ResolveInterface(zone)
+	if err != nil {
+		return fmt.Errorf("Unsupported parameter server=%s zone %s", test.Server, err)
+	}
+	if test.Interface == "" {
+		test.Interface = intFace.Name
+		return nil
+	}
+	if test.Interface != intFace.Name {
+		return fmt.Errorf("Unsupported parameter server=%s zone does not match interface %s", test.Server, test.Interface)
+	}
+	return nil
+}
+
+// scopedAddress returns the address with the interface as zone if the address is link-local
+func (test *clientTest) scopedAddress(ip net.IP) (string, error) {
+	if !netutils.NeedsZone(ip) {
+		return ip.String(), nil
+	}
+	if test.Interface == "" {
+		return "", fmt.Errorf("Unsupported parameter server=%s link-local address requires zone or interface", test.Server)
+	}
+	return ip.String() + "%" + test.Interface, nil
+}
+
+// newTest validates parameters depending on the destination address and creates the protocol test
+func (test *clientTest) newTest(dstAddress string) (protocols.Test, error) {
+	protocolVersion := ipProtocolVersion(dstAddress)
+	sourceIP := networkSourceIP(test.network, test.Source, protocolVersion)
+	err := validateSourceIP(sourceIP, test.Interface, protocolVersion)
+	if err != nil {
+		return nil, err
+	}
+	mtu, err := defineMtu(test.MTU, test.Protocol, protocolVersion, dstAddress, sourceIP, test.Routing.Mark,
+		netutils.BindDevice(test.Interface, test.VRF), test.MTUStrict)
+	if err != nil {
+		return nil, err
+	}
+	if test.Protocol != protocols.ProtocolICMP {
+		err = validatePort(test.Port)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, flowSource := range test.Flows.Sources {
+		err = validateSourceIP(flowSource, test.Interface, protocolVersion)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if test.Trace {
+		return protocols.NewTraceTest(test.Protocol, mtu, protocolVersion, dstAddress, test.Port, test.MaxHops,
+			test.Interface, test.VRF, sourceIP, test.SourcePort, test.Routing)
+	}
+	switch test.Protocol {
+	case protocols.ProtocolICMP:
+		if test.SourcePort != 0 {
+			log.Printf("Parameter -source-port=%d ignored in ICMP mode", test.SourcePort)
+		}
+		return protocols.NewICMPTest(mtu, protocolVersion, dstAddress, test.Interface, test.VRF, test.Packages,
+			test.Negative, sourceIP, test.Routing, test.Diagnostics)
+	case protocols.ProtocolTCP:
+		return protocols.NewTCPTest(mtu, protocolVersion, dstAddress, test.Port, test.Packages, test.Negative,
+			test.TimeoutTCP, test.Interface, test.VRF, sourceIP, test.SourcePort, test.Routing, test.Reflect, test.Flows,
+			test.Diagnostics)
+	case protocols.ProtocolUDP:
+		udpTest, err := protocols.NewUDPTest(mtu, protocolVersion, dstAddress, test.Port, test.Packages, test.Negative,
+			test.Multicast, test.Broadcast, test.TimeoutUDP, test.Interface, test.VRF, sourceIP, test.SourcePort,
+			test.Routing, test.Reflect, test.Flows, test.Diagnostics)
+		if err != nil {
+			return nil, err
+		}
+		if test.Expectation != nil {
+			udpTest.ExpectPackets = test.Expectation.Packets
+			udpTest.ExpectFrom = test.Expectation.From
+			udpTest.ExpectWithin = test.Expectation.Within
+		}
+		return udpTest, nil
+	case protocols.ProtocolSCTP:
+		return protocols.NewSCTPTest(mtu, dstAddress, protocolVersion, test.Port, test.Packages, test.Negative,
+			test.Interface, test.VRF, sourceIP, test.SourcePort, test.Routing, test.Reflect, test.Diagnostics)
+	}
+	return nil, validateProtocol(test.Protocol)
+}
+
+// run runs the test against the destination addresses and returns error unless every result
+// matches the expectation
+func (test *clientTest) run() error {
+	results, resolution, err := test.runAll()
+	if err != nil {
+		return err
+	}
+	if test.Expectation != nil && len(results) == 1 && results[0].Result != nil {
+		return test.Expectation.summarize(results[0].Result.Sources, results[0].Duration, results[0].Err)
+	}
+	if len(results) == 1 {
+		return results[0].Err
+	}
+	err = printSummary(resolution, results)
+	if test.HappyEyeballs {
+		test.measureHappyEyeballs(results)
+	}
+	return err
+}
+
+// runAll runs the test against every destination address, the error is returned when the test
+// can not start at all
+func (test *clientTest) runAll() ([]clientResult, *netutils.Resolution, error) {
+	err := validateRouting(&test.Routing)
+	if err != nil {
+		return nil, nil, err
+	}
+	if test.Family == netutils.FamilyDual && test.Source != "" {
+		return nil, nil, fmt.Errorf("Unsupported parameter source=%s with family=%s, source of each family is taken from -network or routing",
+			test.Source, netutils.FamilyDual)
+	}
+	if test.Expectation != nil {
+		if test.Protocol != protocols.ProtocolUDP || (!test.Multicast && !test.Broadcast) {
+			return nil, nil, fmt.Errorf("Unsupported parameter expect-packets/expect-from/expect-within in %s client mode, "+
+				"use it with servers or udp multicast/broadcast receivers", test.Protocol)
+		}
+		if test.Negative {
+			return nil, nil, fmt.Errorf("Unsupported parameter expect-packets/expect-from/expect-within with negative")
+		}
+	}
+	err = test.validateReflect()
+	if err != nil {
+		return nil, nil, err
+	}
+	err = test.validateFlows()
+	if err != nil {
+		return nil, nil, err
+	}
+	err = test.validateTrace()
+	if err != nil {
+		return nil, nil, err
+	}
+	addresses, resolution, err := test.addresses()
+	if err != nil {
+		return nil, resolution, err
+	}
+	results := make([]clientResult, 0, len(addresses))
+	for _, address := range addresses {
+		result := clientResult{Address: address}
+		start := time.Now()
+		connectivityTest, err := test.newTest(address)
+		if err == nil {
+			if test.WaitPeer > 0 {
+				connectivityTest.WaitPeer(test.WaitPeer)
+			}
+			err = connectivityTest.Run()
+			result.Result = connectivityTest.Result()
+		}
+		result.Duration = time.Since(start)
+		result.Err = err
+		results = append(results, result)
+	}
+	return results, resolution, nil
+}
+
+// validateReflect validates the reflection request, expected source and backend distribution imply
+// the reflection
+func (test *clientTest) validateReflect() error {
+	if test.Reflect.ExpectBackends < 0 {
+		return fmt.Errorf("Unsupported parameter expect-backends=%d", test.Reflect.ExpectBackends)
+	}
+	if test.Reflect.ExpectAffinity && test.Reflect.ExpectBackends > 1 {
+		return fmt.Errorf("Unsupported parameter expect-backends=%d with expect-affinity", test.Reflect.ExpectBackends)
+	}
+	if test.Reflect.ExpectAffinity || test.Reflect.ExpectBackends > 0 {
+		test.Reflect.Tally = true
+	}
+	if test.Reflect.Tally {
+		if test.Protocol != protocols.ProtocolTCP && test.Protocol != protocols.ProtocolUDP {
+			return fmt.Errorf("Unsupported parameter tally/expect-affinity/expect-backends in %s client mode", test.Protocol)
+		}
+		if test.Negative {
+			return fmt.Errorf("Unsupported parameter tally/expect-affinity/expect-backends with negative")
+		}
+		test.Reflect.Enabled = true
+	}
+	if test.Reflect.ExpectSourceIP != "" {
+		if netutils.ParseIP(test.Reflect.ExpectSourceIP) == nil {
+			return fmt.Errorf("Unsupported parameter expect-source-ip=%s is not ip address", test.Reflect.ExpectSourceIP)
+		}
+		test.Reflect.Enabled = true
+	}
+	if !test.Reflect.Enabled {
+		return nil
+	}
+	if test.Protocol == protocols.ProtocolICMP || test.Multicast || test.Broadcast {
+		return fmt.Errorf("Unsupported parameter reflect/expect-source-ip/tally in %s %s client mode, the server must reply",
+			test.Protocol, test.mode())
+	}
+	if test.Negative && test.Reflect.ExpectSourceIP != "" {
+		return fmt.Errorf("Unsupported parameter expect-source-ip with negative")
+	}
+	return nil
+}
+
+// validateFlows validates multi-flow mode of tcp/udp unicast client
+func (test *clientTest) validateFlows() error {
+	if !test.Flows.Enabled() {
+		return nil
+	}
+	if test.Flows.Count < 0 {
+		return fmt.Errorf("Unsupported parameter flows=%d", test.Flows.Count)
+	}
+	if (test.Protocol != protocols.ProtocolTCP && test.Protocol != protocols.ProtocolUDP) || test.Multicast || test.Broadcast {
+		return fmt.Errorf("Unsupported parameter flows/source-port-range/flow-sources in %s %s client mode",
+			test.Protocol, test.mode())
+	}
+	if test.Negative {
+		return fmt.Errorf("Unsupported parameter flows/source-port-range/flow-sources with negative")
+	}
+	if test.Reflect.Tally {
+		return fmt.Errorf("Unsupported parameter tally with flows, flows report the backend of every flow")
+	}
+	if test.SourcePort != 0 && test.Flows.PortFirst > 0 {
+		return fmt.Errorf("Unsupported parameter source-port=%d with source-port-range", test.SourcePort)
+	}
+	if test.SourcePort != 0 {
+		return fmt.Errorf("Unsupported parameter source-port=%d with flows, every flow needs its own source port",
+			test.SourcePort)
+	}
+	if test.Source != "" && len(test.Flows.Sources) > 0 {
+		return fmt.Errorf("Unsupported parameter source=%s with flow-sources", test.Source)
+	}
+	return nil
+}
+
+// validateTrace validates trace mode of unicast client
+func (test *clientTest) validateTrace() error {
+	if !test.Trace {
+		return nil
+	}
+	err := validateIntInRange(test.MaxHops, 1, 255)
+	if err != nil {
+		return fmt.Errorf("unsupported parameter max-hops=%d %s", test.MaxHops, err)
+	}
+	if test.Multicast || test.Broadcast {
+		return fmt.Errorf("Unsupported parameter trace in %s %s client mode", test.Protocol, test.mode())
+	}
+	if test.Negative {
+		return fmt.Errorf("Unsupported parameter trace with negative")
+	}
+	if test.Reflect.Enabled || test.Flows.Enabled() {
+		return fmt.Errorf("Unsupported parameter trace with reflect/tally/flows")
+	}
+	return nil
+}
+
+// parseSourcePortRange parses first-last range of the flow source ports, empty range is the kernel choice
+func parseSourcePortRange(portRange string) (int, int, error) {
+	if portRange == "" {
+		return 0, 0, nil
+	}
+	first, last, found := strings.Cut(portRange, "-")
+	if !found {
+		last = first
+	}
+	firstPort, errFirst := strconv.Atoi(first)
+	lastPort, errLast := strconv.Atoi(last)
+	if errFirst != nil || errLast != nil || firstPort == 0 || lastPort < firstPort {
+		return 0, 0, fmt.Errorf("Unsupported parameter source-port-range=%s. Example: 40000-40063", portRange)
+	}
+	err := validateSourcePort(firstPort)
+	if err == nil {
+		err = validateSourcePort(lastPort)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	return firstPort, lastPort, nil
+}
+
+// parseFlowSources splits comma separated source addresses of the flows
+func parseFlowSources(sources string) []string {
+	if sources == "" {
+		return nil
+	}
+	var list []string
+	for _, source := range strings.Split(sources, ",") {
+		if source = strings.TrimSpace(source); source != "" {
+			list = append(list, source)
+		}
+	}
+	return list
+}
+
+// mode returns the client mode used in messages
+func (test *clientTest) mode() string {
+	switch {
+	case test.Multicast:
+		return "multicast"
+	case test.Broadcast:
+		return "broadcast"
+	}
+	return "unicast"
+}
+
+// measureHappyEyeballs reports which family dual-stack tcp client connects over, the resolver preference
+// order defines the primary family
+func (test *clientTest) measureHappyEyeballs(results []clientResult) {
+	if test.Protocol != protocols.ProtocolTCP || test.Family != netutils.FamilyDual {
+		log.Printf("Parameter -happy-eyeballs ignored without -protocol=%s -family=%s", protocols.ProtocolTCP, netutils.FamilyDual)
+		return
+	}
+	resolution, err := netutils.ResolveHost(strings.Split(test.Server, ",")[0], netutils.FamilyAny)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	primary := resolution.Addresses[0]
+	secondary := ""
+	for _, result := range results {
+		if (ipProtocolVersion(result.Address) == 6) != (primary.To4() == nil) {
+			secondary = result.Address
+			break
+		}
+	}
+	result := protocols.MeasureHappyEyeballs(primary.String(), secondary, test.Port, netutils.BindDevice(test.Interface, test.VRF),
+		test.Routing.Mark, time.Duration(test.TimeoutTCP)*time.Second)
+	fmt.Printf("Happy Eyeballs: %s\n", result)
+}
+
+func familyName(address string) string {
+	if ipProtocolVersion(address) == 6 {
+		return "IPv6"
+	}
+	return "IPv4"
+}
+
+func printSummary(resolution *netutils.Resolution, results []clientResult) error {
+	fmt.Printf("--- %s summary ---\n", resolution.Host)
+	fmt.Println(resolution)
+	width := 0
+	for _, result := range results {
+		if len(result.Address) > width {
+			width = len(result.Address)
+		}
+	}
+	failed := 0
+	for _, result := range results {
+		status := "passed"
+		if result.Err != nil {
+			failed++
+			status = fmt.Sprintf("failed: %v", result.Err)
+		}
+		if result.Result != nil && len(result.Result.Flows) > 0 {
+			status += fmt.Sprintf(" (%d flows)", len(result.Result.Flows))
+		} else if result.Result != nil && len(result.Result.Trace) > 0 {
+			status += fmt.Sprintf(" (%d hops)", len(result.Result.Trace))
+		} else if result.Result != nil && result.Result.Reflection != nil {
+			status += fmt.Sprintf(" (observed source %s)", result.Result.Reflection.Source)
+		}
+		fmt.Printf("%s  %-*s  %8s  %s\n", familyName(result.Address), width, result.Address,
+			result.Duration.Round(time.Millisecond), status)
+	}
+	if failed != 0 {
+		return fmt.Errorf("%d of %d addresses failed", failed, len(results))
+	}
+	return nil
+}
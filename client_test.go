@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+func TestParseSourcePortRange(t *testing.T) {
+	tests := []struct {
+		portRange string
+		first     int
+		last      int
+		wantErr   bool
+	}{
+		{portRange: "", first: 0, last: 0},
+		{portRange: "40000", first: 40000, last: 40000},
+		{portRange: "40000-40063", first: 40000, last: 40063},
+		{portRange: "1-65534", first: 1, last: 65534},
+		{portRange: "40000-40000", first: 40000, last: 40000},
+		{portRange: "40063-40000", wantErr: true},
+		{portRange: "0-100", wantErr: true},
+		{portRange: "0", wantErr: true},
+		{portRange: "40000-65535", wantErr: true},
+		{portRange: "-1-100", wantErr: true},
+		{portRange: "40000-", wantErr: true},
+		{portRange: "-40000", wantErr: true},
+		{portRange: "40000-40010-40020", wantErr: true},
+		{portRange: "40000:40063", wantErr: true},
+		{portRange: " 40000-40063", wantErr: true},
+		{portRange: "ports", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.portRange, func(t *testing.T) {
+			first, last, err := parseSourcePortRange(tt.portRange)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSourcePortRange(%q) error = %v, wantErr %v", tt.portRange, err, tt.wantErr)
+			}
+			if first != tt.first || last != tt.last {
+				t.Errorf("parseSourcePortRange(%q) = %d, %d, want %d, %d", tt.portRange, first, last, tt.first, tt.last)
+			}
+		})
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	controllerCommand = "controller"
+)
+
+// controllerPlan is a plan run by agents. Servers are started on the agents before the tests
+// and stopped afterwards
+type controllerPlan struct {
+	Concurrency int                `yaml:"concurrency"`
+	Agents      map[string]string  `yaml:"agents"`
+	Servers     []controllerServer `yaml:"servers"`
+	Tests       []controllerTest   `yaml:"tests"`
+}
+
+// controllerServer is a server started on the agent
+type controllerServer struct {
+	Agent string     `yaml:"agent"`
+	Spec  serverSpec `yaml:",inline"`
+}
+
+// controllerTest is a plan test run by the agent
+type controllerTest struct {
+	Agent string   `yaml:"agent"`
+	Test  planTest `yaml:",inline"`
+}
+
+// agentClient calls the API of single agent
+type agentClient struct {
+	name   string
+	url    string
+	token  string
+	client *http.Client
+}
+
+// runController runs the controller command and returns the exit code
+func runController(args []string) int {
+	flags := flag.NewFlagSet(controllerCommand, flag.ExitOnError)
+	file := flags.String("file", "", "YAML or JSON file with the agents, servers and tests")
+	concurrency := flags.Int("concurrency", 0, "Number of tests run in parallel. Options: Any int in range 1-64 (default from the file or 1)")
+	output := flags.String("output", outputText, "Report format. Options: text/json")
+	tokenFile := flags.String("token-file", "", "File with the bearer token of the agents (default $"+agentTokenEnv+")")
+	caFile := flags.String("ca-file", "", "CA certificate file verifying HTTPS agents")
+	timeout := flags.Duration("timeout", 10*time.Minute, "Timeout of single agent request")
+	flags.Parse(args)
+
+	testPlan, err := readControllerPlan(*file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	if *concurrency != 0 {
+		testPlan.Concurrency = *concurrency
+	}
+	if testPlan.Concurrency == 0 {
+		testPlan.Concurrency = 1
+	}
+	err = validateIntInRange(testPlan.Concurrency, 1, 64)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: unsupported parameter concurrency %v\n", err)
+		return 1
+	}
+	if *output != outputText && *output != outputJSON {
+		fmt.Fprintf(os.Stderr, "error: unsupported parameter output=%s\n", *output)
+		return 1
+	}
+	token, err := readToken(*tokenFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	client, err := newAgentHTTPClient(*caFile, *timeout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	agents := map[string]*agentClient{}
+	for name, url := range testPlan.Agents {
+		agents[name] = &agentClient{name: name, url: strings.TrimSuffix(url, "/"), token: token, client: client}
+	}
+
+	report, err := testPlan.run(agents)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	if *output == outputJSON {
+		err = report.writeJSON(os.Stdout)
+	} else {
+		err = report.writeText(os.Stdout)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	if report.Failed != 0 {
+		return 1
+	}
+	return 0
+}
+
+// readControllerPlan reads the plan and validates that every server and test refers to known agent
+func readControllerPlan(file string) (*controllerPlan, error) {
+	if file == "" {
+		return nil, fmt.Errorf("plan file is required")
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	testPlan := &controllerPlan{}
+	err = decodeStrict(data, testPlan)
+	if err != nil {
+		return nil, fmt.Errorf("can not parse plan %s: %w", file, err)
+	}
+	if len(testPlan.Agents) == 0 {
+		return nil, fmt.Errorf("plan %s has no agents", file)
+	}
+	if len(testPlan.Tests) == 0 {
+		return nil, fmt.Errorf("plan %s has no tests", file)
+	}
+	for _, server := range testPlan.Servers {
+		if _, ok := testPlan.Agents[server.Agent]; !ok {
+			return nil, fmt.Errorf("plan %s server %s port %d refers to unknown agent %q", file, server.Spec.Protocol,
+				server.Spec.Port, server.Agent)
+		}
+	}
+	names := map[string]bool{}
+	for i := range testPlan.Tests {
+		test := &testPlan.Tests[i]
+		if _, ok := testPlan.Agents[test.Agent]; !ok {
+			return nil, fmt.Errorf("plan %s test %d refers to unknown agent %q", file, i+1, test.Agent)
+		}
+		if test.Test.Name == "" {
+			test.Test.Name = fmt.Sprintf("test-%d", i+1)
+		}
+		if names[test.Test.Name] {
+			return nil, fmt.Errorf("plan %s has duplicate test name %s", file, test.Test.Name)
+		}
+		names[test.Test.Name] = true
+	}
+	return testPlan, nil
+}
+
+// run starts the servers, runs the tests on the agents and stops the servers regardless of the result
+func (testPlan *controllerPlan) run(agents map[string]*agentClient) (*planReport, error) {
+	started := []agentServer{}
+	defer func() {
+		for i, server := range started {
+			err := agents[testPlan.Servers[i].Agent].stopServer(server.ID)
+			if err != nil {
+				log.Printf("Can not stop server %s on agent %s: %v", server.ID, testPlan.Servers[i].Agent, err)
+			}
+		}
+	}()
+	for _, server := range testPlan.Servers {
+		startedServer, err := agents[server.Agent].startServer(server.Spec)
+		if err != nil {
+			return nil, fmt.Errorf("can not start %s server port %d on agent %s: %w", server.Spec.Protocol, server.Spec.Port,
+				server.Agent, err)
+		}
+		log.Printf("Started %s server %s port %d on agent %s", server.Spec.Protocol, startedServer.ID, server.Spec.Port,
+			server.Agent)
+		started = append(started, startedServer)
+	}
+
+	tests := make([]planTest, len(testPlan.Tests))
+	for i := range testPlan.Tests {
+		tests[i] = testPlan.Tests[i].Test
+	}
+	return runTests(testPlan.Concurrency, tests, func(i int) planTestReport {
+		agentName := testPlan.Tests[i].Agent
+		report, err := agents[agentName].runTest(tests[i])
+		if err != nil {
+			report = planTestReport{Name: tests[i].Name, Protocol: tests[i].Protocol, Server: tests[i].Server,
+				Negative: tests[i].Negative, Error: err.Error()}
+		}
+		report.Agent = agentName
+		return report
+	}), nil
+}
+
+func newAgentHTTPClient(caFile string, timeout time.Duration) (*http.Client, error) {
+	client := &http.Client{Timeout: timeout}
+	if caFile == "" {
+		return client, nil
+	}
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificate found in %s", caFile)
+	}
+	client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	return client, nil
+}
+
+func (agent *agentClient) runTest(test planTest) (planTestReport, error) {
+	report := planTestReport{}
+	err := agent.call(http.MethodPost, agentTestsPath, test, http.StatusOK, &report)
+	return report, err
+}
+
+func (agent *agentClient) startServer(spec serverSpec) (agentServer, error) {
+	server := agentServer{}
+	err := agent.call(http.MethodPost, agentServersPath, spec, http.StatusCreated, &server)
+	return server, err
+}
+
+func (agent *agentClient) stopServer(id string) error {
+	return agent.call(http.MethodDelete, agentServersPath+"/"+id, nil, http.StatusOK, nil)
+}
+
+// call sends the request body as YAML, keys of the plan are YAML keys, and decodes JSON response
+func (agent *agentClient) call(method string, path string, body interface{}, status int, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := yaml.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	request, err := http.NewRequest(method, agent.url+path, reader)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", "Bearer "+agent.token)
+	if body != nil {
+		request.Header.Set("Content-Type", "application/yaml")
+	}
+	response, err := agent.client.Do(request)
+	if err != nil {
+		return fmt.Errorf("agent %s: %w", agent.name, err)
+	}
+	defer response.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(response.Body, agentMaxBodySize))
+	if err != nil {
+		return fmt.Errorf("agent %s: %w", agent.name, err)
+	}
+	if response.StatusCode != status {
+		apiError := agentError{}
+		if json.Unmarshal(data, &apiError) == nil && apiError.Error != "" {
+			return fmt.Errorf("agent %s: %s", agent.name, apiError.Error)
+		}
+		return fmt.Errorf("agent %s: unexpected status %s", agent.name, response.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
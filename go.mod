@@ -3,3 +3,7 @@ module github.com/kononovn/testcmd
 go 1.20
 
 require github.com/ishidawataru/sctp v0.0.0-20230406120618-7ff4192f6ff2
+
+require gopkg.in/yaml.v3 v3.0.1
+
+require golang.org/x/sys v0.13.0
@@ -6,14 +6,27 @@ import (
 	"log"
 	"net"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/kononovn/testcmd/netutils"
 	"github.com/kononovn/testcmd/protocols"
 	"github.com/kononovn/testcmd/servers"
 )
 
 const (
 	ipv4BroadcastAddress = "255.255.255.255"
+	mtuAuto              = "auto"
+	mtuMin               = 50
+	mtuMax               = 9000
+
+	defaultMtu        = "1450"
+	defaultPort       = 80
+	defaultPackages   = 5
+	defaultTimeoutTCP = 2
+	defaultTimeoutUDP = 5
+	defaultMaxHops    = 30
 )
 
 var (
@@ -21,7 +34,7 @@ var (
 )
 
 func validateIP(host string, multicast bool) error {
-	ip := net.ParseIP(host)
+	ip := netutils.ParseIP(host)
 	if multicast {
 		if ip.IsMulticast() {
 			return nil
@@ -34,13 +47,124 @@ func validateIP(host string, multicast bool) error {
 	return fmt.Errorf("Unsupported parameter server ip=%s", host)
 }
 
+// defineBroadcastAddress returns the destination used in broadcast mode. IPv4 uses the limited
+// broadcast address unless subnet-directed broadcast is given, e.g. of a remote subnet behind a router,
+// or computed from the interface prefix. IPv6 has no broadcast and uses a link-scoped multicast group
+// such as the all-nodes address ff02::1 instead.
+func defineBroadcastAddress(host string, directed bool, interfaceName string) (string, error) {
+	if host == "" {
+		if directed {
+			return servers.DirectedBroadcastAddress(interfaceName)
+		}
+		return ipv4BroadcastAddress, nil
+	}
+	ip := netutils.ParseIP(host)
+	if ip != nil && ip.To4() != nil && !ip.IsMulticast() && !ip.IsUnspecified() {
+		return host, nil
+	}
+	if ip != nil && ip.To4() == nil && ip.IsLinkLocalMulticast() {
+		return host, nil
+	}
+	return "", fmt.Errorf("Unsupported parameter server ip=%s is not IPv4 broadcast or IPv6 link-scoped multicast address",
+		host)
+}
+
 func ipProtocolVersion(host string) int {
-	if strings.Contains(host, ":") {
+	ip := netutils.ParseIP(host)
+	if ip != nil && ip.To4() == nil {
 		return 6
 	}
 	return 4
 }
 
+func validateSourceIP(sourceIP string, interfaceName string, protocolVersion int) error {
+	if sourceIP == "" {
+		return nil
+	}
+	ip := netutils.ParseIP(sourceIP)
+	if ip == nil {
+		return fmt.Errorf("Unsupported parameter source ip=%s", sourceIP)
+	}
+	if ipProtocolVersion(sourceIP) != protocolVersion {
+		return fmt.Errorf("Unsupported parameter source ip=%s is not IPv%d address", sourceIP, protocolVersion)
+	}
+	var (
+		addrs []net.Addr
+		err   error
+	)
+	if interfaceName != "" {
+		intFace, err := net.InterfaceByName(interfaceName)
+		if err != nil {
+			return err
+		}
+		addrs, err = intFace.Addrs()
+		if err != nil {
+			return err
+		}
+	} else {
+		addrs, err = net.InterfaceAddrs()
+		if err != nil {
+			return err
+		}
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return nil
+		}
+	}
+	if interfaceName != "" {
+		return fmt.Errorf("source ip=%s is not assigned to interface %s", sourceIP, interfaceName)
+	}
+	return fmt.Errorf("source ip=%s is not assigned to any local interface", sourceIP)
+}
+
+func validateSourcePort(portNumber int) error {
+	// 0 lets the kernel pick ephemeral port
+	if portNumber == 0 {
+		return nil
+	}
+	err := validateIntInRange(portNumber, 1, 65534)
+	if err != nil {
+		return fmt.Errorf("unsupported parameter source-port=%d %s", portNumber, err)
+	}
+	return nil
+}
+
+func validateVRF(vrfName string, interfaceName string) error {
+	if vrfName == "" {
+		return nil
+	}
+	vrf, err := netutils.VRFByName(vrfName)
+	if err != nil {
+		return fmt.Errorf("Unsupported parameter vrf=%s %s", vrfName, err)
+	}
+	if interfaceName != "" {
+		err = netutils.ValidateVRFMember(interfaceName, vrf)
+		if err != nil {
+			return fmt.Errorf("Unsupported parameter interface=%s %s", interfaceName, err)
+		}
+	}
+	log.Printf("Using vrf %s routing table %d", vrf.Name, vrf.VRFTable)
+	return nil
+}
+
+func validateRouting(routing *protocols.Routing) error {
+	if routing.Mark < 0 || int64(routing.Mark) > 0xffffffff {
+		return fmt.Errorf("Unsupported parameter mark=%d", routing.Mark)
+	}
+	if routing.ExpectEgressInterface != "" {
+		intFace, err := netutils.ResolveInterface(routing.ExpectEgressInterface)
+		if err != nil {
+			return fmt.Errorf("Unsupported parameter expect-egress-interface=%s %s", routing.ExpectEgressInterface, err)
+		}
+		routing.ExpectEgressInterface = intFace.Name
+	}
+	if routing.ExpectGateway != "" && routing.ExpectGateway != protocols.GatewayNone && net.ParseIP(routing.ExpectGateway) == nil {
+		return fmt.Errorf("Unsupported parameter expect-gateway=%s", routing.ExpectGateway)
+	}
+	return nil
+}
+
 func validateIntInRange(testInt int, rangeStart int, rangeStop int) error {
 	if testInt >= rangeStart && testInt <= rangeStop {
 		return nil
@@ -49,13 +173,179 @@ func validateIntInRange(testInt int, rangeStart int, rangeStop int) error {
 }
 
 func validateMtu(mtuSize int) error {
-	err := validateIntInRange(mtuSize, 50, 9000)
+	err := validateIntInRange(mtuSize, mtuMin, mtuMax)
 	if err != nil {
 		return fmt.Errorf("unsupported parameter mtu=%d %s", mtuSize, err)
 	}
 	return nil
 }
 
+func parseMtu(mtuValue string) (int, error) {
+	if mtuValue == mtuAuto {
+		return 0, nil
+	}
+	mtuSize, err := strconv.Atoi(mtuValue)
+	if err != nil {
+		return 0, fmt.Errorf("unsupported parameter mtu=%s is not a number or %s", mtuValue, mtuAuto)
+	}
+	return mtuSize, validateMtu(mtuSize)
+}
+
+// defineMtu compares payload size with the largest payload fitting into the egress device and route MTU
+// towards dstAddress. Zero mtuSize means auto and returns the largest payload. Payload which can not fit
+// is reported, or fails when strict. TCP payload is segmented and always fits.
+func defineMtu(
+	mtuSize int, protocol string, protocolVersion int, dstAddress string, sourceIP string, mark int, device string, strict bool) (int, error) {
+	oif := 0
+	if device != "" {
+		intFace, err := net.InterfaceByName(device)
+		if err != nil {
+			return 0, err
+		}
+		oif = intFace.Index
+	}
+	pathMtu, route, err := netutils.PathMTU(netutils.ParseIP(dstAddress), netutils.ParseIP(sourceIP), mark, oif)
+	if err != nil {
+		if mtuSize == 0 {
+			return 0, fmt.Errorf("can not define mtu=%s: %v", mtuAuto, err)
+		}
+		log.Printf("Can not verify mtu=%d against the egress interface: %v", mtuSize, err)
+		return mtuSize, nil
+	}
+	maxPayload := protocols.MaxPayload(protocol, protocolVersion, pathMtu)
+	if mtuSize == 0 {
+		mtuSize = maxPayload
+		if mtuSize > mtuMax {
+			mtuSize = mtuMax
+		}
+		log.Printf("Using mtu=%d, the largest %s payload fitting MTU %d of %s", mtuSize, protocol, pathMtu, route.Interface)
+		return mtuSize, validateMtu(mtuSize)
+	}
+	if mtuSize <= maxPayload || protocol == protocols.ProtocolTCP {
+		return mtuSize, nil
+	}
+	err = fmt.Errorf("mtu=%d %s payload does not fit MTU %d of %s, the largest payload is %d",
+		mtuSize, protocol, pathMtu, route.Interface, maxPayload)
+	if strict {
+		return 0, err
+	}
+	log.Printf("Warning: %v", err)
+	return mtuSize, nil
+}
+
+// defineServerMtu returns buffer size of the server, auto uses the largest payload fitting the interface MTU
+func defineServerMtu(mtuSize int, protocol string, protocolVersion int, device string) (int, error) {
+	if mtuSize != 0 {
+		return mtuSize, nil
+	}
+	if device == "" {
+		return mtuMax, nil
+	}
+	link, err := netutils.LinkByName(device)
+	if err != nil {
+		return 0, err
+	}
+	mtuSize = protocols.MaxPayload(protocol, protocolVersion, link.MTU)
+	if mtuSize > mtuMax {
+		mtuSize = mtuMax
+	}
+	return mtuSize, validateMtu(mtuSize)
+}
+
+// defineNetwork resolves the network attachment from the network-status annotation and sets the interface
+// of the attachment unless the interface is given explicitly
+func defineNetwork(network string, annotationsFile string, interfaceName *string) (*netutils.NetworkStatus, error) {
+	if network == "" {
+		return nil, nil
+	}
+	status, err := netutils.NetworkStatusByName(annotationsFile, network)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Network %s", status)
+	if *interfaceName == "" {
+		*interfaceName = status.Interface
+	} else if *interfaceName != status.Interface {
+		return nil, fmt.Errorf("interface %s does not match interface %s of network %s", *interfaceName, status.Interface, status.Name)
+	}
+	return status, nil
+}
+
+// networkSourceIP returns the source address of the network attachment unless the source is given explicitly
+func networkSourceIP(status *netutils.NetworkStatus, sourceIP string, protocolVersion int) string {
+	if status == nil || sourceIP != "" {
+		return sourceIP
+	}
+	return status.SourceIP(protocolVersion)
+}
+
+// waitForInterface waits until the interface is ready for the address family of the server and the source
+// address if set. Family of hostname or empty server is not known unless given, so any address is enough
+func waitForInterface(interfaceName string, server string, family string, sourceIP string, timeout time.Duration) error {
+	if timeout <= 0 {
+		return nil
+	}
+	if interfaceName == "" {
+		log.Printf("Parameter -wait-interface=%s ignored without -interface", timeout)
+		return nil
+	}
+	protocolVersion := 0
+	switch {
+	case netutils.ParseIP(server) != nil:
+		protocolVersion = ipProtocolVersion(server)
+	case family == netutils.FamilyIPv4:
+		protocolVersion = 4
+	case family == netutils.FamilyIPv6:
+		protocolVersion = 6
+	}
+	serverIP := netutils.ParseIP(server)
+	linkLocal := serverIP != nil && netutils.NeedsZone(serverIP)
+	return netutils.WaitInterface(interfaceName, protocolVersion, linkLocal, netutils.ParseIP(sourceIP), timeout)
+}
+
+// checkCapabilities explains which requested option needs a capability the process does not have,
+// so the tool fails early instead of with socket errors. Ping sockets replace raw icmp sockets when allowed
+func checkCapabilities(
+	serverMode bool, protocol string, mark int, device string, port int, sourcePort int, multicast bool, broadcast bool,
+	trace bool) error {
+	var missing []string
+	require := func(option string, capability int) {
+		if !netutils.HasCapability(capability) {
+			missing = append(missing, fmt.Sprintf("%s requires %s", option, netutils.CapabilityName(capability)))
+		}
+	}
+	if mark != 0 {
+		require("-mark", netutils.CapNetAdmin)
+	}
+	if device != "" && netutils.BindToDeviceNeedsCapability() {
+		require("-interface/-vrf on kernel before 5.7", netutils.CapNetRaw)
+	}
+	portStart := netutils.UnprivilegedPortStart()
+	if serverMode && port < portStart {
+		require(fmt.Sprintf("server -port=%d below net.ipv4.ip_unprivileged_port_start=%d", port, portStart), netutils.CapNetBindService)
+	}
+	if serverMode && (multicast || broadcast) && sourcePort == 0 {
+		sourcePort = port
+	}
+	if sourcePort != 0 && sourcePort < portStart {
+		require(fmt.Sprintf("-source-port=%d below net.ipv4.ip_unprivileged_port_start=%d", sourcePort, portStart), netutils.CapNetBindService)
+	}
+	if !serverMode && trace {
+		require("-trace", netutils.CapNetRaw)
+	} else if !serverMode && protocol == protocols.ProtocolICMP && !netutils.HasCapability(netutils.CapNetRaw) {
+		if !netutils.UnprivilegedPingAllowed() {
+			missing = append(missing, fmt.Sprintf("-protocol=%s requires %s or group in net.ipv4.ping_group_range",
+				protocol, netutils.CapabilityName(netutils.CapNetRaw)))
+		} else {
+			log.Printf("Running without %s, using unprivileged icmp socket", netutils.CapabilityName(netutils.CapNetRaw))
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing capabilities: %s", strings.Join(missing, "; "))
+	}
+	return nil
+}
+
 func validatePort(portNumber int) error {
 	err := validateIntInRange(portNumber, 1, 65534)
 	if err != nil {
@@ -74,101 +364,263 @@ func validateProtocol(protocolName string) error {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == planCommand {
+		os.Exit(runPlan(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == matrixCommand {
+		os.Exit(runMatrix(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == agentCommand {
+		os.Exit(runAgent(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == controllerCommand {
+		os.Exit(runController(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == monitorCommand {
+		os.Exit(runMonitor(os.Args[2:]))
+	}
+
 	serverMode := flag.Bool("listen", false, "Insert this flag in order to run server")
-	interfaceName := flag.String("interface", "", "Interface name. Examples: ens33/eth0/net1")
+	interfaceName := flag.String("interface", "", "Interface name, alternative name or index. Examples: ens33/eth0/net1/3")
 	multicast := flag.Bool("multicast", false, "Insert this flag in order to run udp multicast server")
-	broadcast := flag.Bool("broadcast", false, "Insert this flag in order to run udp broadcast server")
+	broadcast := flag.Bool("broadcast", false, "Insert this flag in order to run udp broadcast server. IPv6 uses link-scoped -server group, e.g. ff02::1")
+	directed := flag.Bool("directed", false, "Insert this flag in order to use subnet-directed broadcast address of the interface prefix")
 	protocol := flag.String("protocol", "", "Protocol name. Options: tcp/udp/icmp/sctp")
-	mtu := flag.Int("mtu", 1450, "MTU Size. Options: Any int in range 50-9000")
-	dstAddress := flag.String("server", "", "Destination ip address IPv4/IPv6")
-	serverPort := flag.Int("port", 80, "Port number. Options: Any int in range 1-65534")
-	packagesNumber := flag.Int("packages", 5, "Packages number. Options: Any int in range 1-65534")
-	timeoutTCP := flag.Int("timeoutTCP", 2, "Session timeout TCP. Options: Any int in range 1-65534")
-	timeoutUDP := flag.Int("timeoutUDP", 5, "Session timeout UDP. Options: Any int in range 1-65534")
+	mtuValue := flag.String("mtu", defaultMtu, "MTU Size. Options: Any int in range 50-9000 or auto to fit the interface MTU")
+	mtuStrict := flag.Bool("mtu-strict", false, "Insert this flag in order to fail when -mtu can not fit the interface MTU")
+	dstAddress := flag.String("server", "", "Destination ip address IPv4/IPv6 or hostname")
+	family := flag.String("family", netutils.FamilyAny, "Address family of the resolved server. Options: 4/6/any/dual. Dual tests both families of hostname or address pair, e.g. 10.0.0.1,fd00::1")
+	happyEyeballs := flag.Bool("happy-eyeballs", false, "Insert this flag in order to measure tcp connect preference in -family=dual mode")
+	allAddresses := flag.Bool("all-addresses", false, "Insert this flag in order to test every resolved server address")
+	serverPort := flag.Int("port", defaultPort, "Port number. Options: Any int in range 1-65534")
+	packagesNumber := flag.Int("packages", defaultPackages, "Packages number. Options: Any int in range 1-65534")
+	timeoutTCP := flag.Int("timeoutTCP", defaultTimeoutTCP, "Session timeout TCP. Options: Any int in range 1-65534")
+	timeoutUDP := flag.Int("timeoutUDP", defaultTimeoutUDP, "Session timeout UDP. Options: Any int in range 1-65534")
 	negative := flag.Bool("negative", false, "Insert this flag if no connectivity expected")
+	sourceIP := flag.String("source", "", "Source ip address IPv4/IPv6. Must be assigned to the interface")
+	sourcePort := flag.Int("source-port", 0, "Source port number. Options: Any int in range 1-65534 (default 0 kernel choice)")
+	vrfName := flag.String("vrf", "", "VRF device name. Sockets are bound to the vrf unless -interface enslaved to it is set")
+	routing := protocols.Routing{}
+	flag.IntVar(&routing.Mark, "mark", 0, "Firewall mark set on client sockets and used for the route lookup. Examples: 10/0xa")
+	flag.StringVar(&routing.ExpectEgressInterface, "expect-egress-interface", "", "Fail if client traffic is routed via another interface")
+	flag.StringVar(&routing.ExpectGateway, "expect-gateway", "", "Fail if client traffic is routed via another gateway. Use none for directly connected")
+	reflect := protocols.Reflect{}
+	flag.BoolVar(&reflect.Enabled, "reflect", false, "Insert this flag in order to reply with the observed client address instead of the echo in server mode and report it in client mode")
+	flag.StringVar(&reflect.ExpectSourceIP, "expect-source-ip", "", "Fail if the reflecting server observes another client address, e.g. SNAT or egress IP. Implies -reflect")
+	identity := flag.String("identity", "", "Server identity returned instead of the echo, environment variables are expanded. Example: $POD_NAME@$NODE_NAME")
+	flag.BoolVar(&reflect.Tally, "tally", false, "Insert this flag in order to open new connection per package and count replies per server identity")
+	flag.BoolVar(&reflect.ExpectAffinity, "expect-affinity", false, "Fail if replies come from more than one server identity. Implies -tally")
+	flag.IntVar(&reflect.ExpectBackends, "expect-backends", 0, "Fail if replies come from fewer server identities. Implies -tally")
+	flows := protocols.Flows{}
+	flag.IntVar(&flows.Count, "flows", 0, "Number of flows with distinct source ports the packages are sent over, e.g. to find black-holed ECMP member")
+	sourcePortRange := flag.String("source-port-range", "", "Source ports of the flows, every port is one flow unless limited by -flows. Example: 40000-40063")
+	flowSources := flag.String("flow-sources", "", "Comma separated source addresses the flows cycle. Example: 10.0.0.1,10.0.0.2")
+	trace := flag.Bool("trace", false, "Insert this flag in order to trace the path hop by hop with probes of the protocol, port, size and DF flag of the test instead of the test")
+	maxHops := flag.Int("max-hops", defaultMaxHops, "Maximum ttl/hop limit of the -trace probes. Options: Any int in range 1-255")
+	diagnostics := flag.Bool("diagnostics", false, "Insert this flag in order to collect network diagnostics when client test fails")
+	netNS := flag.String("netns", "", "Network namespace to run in. Options: name in /var/run/netns, path or pid")
+	network := flag.String("network", "", "Multus network attachment namespace/name selecting -interface and -source. Example: default/sriov-net1")
+	networkStatusFile := flag.String("network-status-file", netutils.DefaultAnnotationsFile, "Downward API file with pod annotations used by -network")
+	waitInterface := flag.Duration("wait-interface", 0, "Wait up to the timeout until -interface is up and has address assigned. Example: 30s")
+	metricsAddress := flag.String("metrics-address", "", "Address of the server HTTP side-port with /healthz, /readyz and /metrics. Example: :9092")
+	metricsPerClient := flag.Bool("metrics-per-client", false, "Insert this flag in order to label the server packet metrics by client IP instead of the totals")
+	expectPackets := flag.Int("expect-packets", 0, "Number of packets the server or udp multicast/broadcast receiver expects before it exits")
+	expectFrom := flag.String("expect-from", "", "Address or cidr the expected packets come from, others are unexpected. Example: 10.0.0.0/24")
+	expectWithin := flag.Duration("expect-within", 0, "Time the expected packets must arrive within. Example: 30s")
+	waitPeer := flag.Duration("wait-peer", 0, "Wait up to the timeout until the server answers before client test. Example: 30s")
 	flag.Parse()
 
-	err := validateProtocol(*protocol)
+	err := netutils.EnterNetNS(*netNS)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error: %v\n", err)
 		os.Exit(1)
 	}
 
-	err = validateMtu(*mtu)
+	err = checkCapabilities(*serverMode, *protocol, routing.Mark, netutils.BindDevice(*interfaceName, *vrfName), *serverPort, *sourcePort,
+		*multicast, *broadcast, *trace)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error: %v\n", err)
 		os.Exit(1)
 	}
 
-	if *serverMode {
-		err = validatePort(*serverPort)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "error: %v\n", err)
-			os.Exit(1)
-		}
+	networkStatus, err := defineNetwork(*network, *networkStatusFile, interfaceName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
 
-		if *multicast {
-			err = validateIP(*dstAddress, *multicast)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "error: %v\n", err)
-				os.Exit(1)
-			}
-			protocolVersion := ipProtocolVersion(*dstAddress)
-			servers.RunMulticastUDPServer(*serverPort, *dstAddress, protocolVersion, *mtu, *interfaceName)
-		} else if *broadcast {
-			servers.RunBroadcastUDPServer(*serverPort, ipv4BroadcastAddress, *mtu, *interfaceName)
-		} else {
-			switch *protocol {
-			case protocols.ProtocolUDP:
-				if *dstAddress != "" {
-					log.Printf("Parameter -server=%s ignored in server UDP unicast mode. Use all interfaces 0.0.0.0", *dstAddress)
-				}
-				servers.RunUDPServer(*serverPort, *mtu)
-			case protocols.ProtocolSCTP:
-				servers.RunSCTP(*dstAddress, *serverPort, *mtu, *interfaceName, ipProtocolVersion(*dstAddress), *packagesNumber)
-			case protocols.ProtocolTCP:
-				servers.RunTCPServer(*dstAddress, *serverPort, *interfaceName, *mtu)
-			}
-		}
-		return
+	err = waitForInterface(*interfaceName, *dstAddress, *family, *sourceIP, *waitInterface)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+
+	intFace, err := netutils.ResolveInterface(*interfaceName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	if intFace != nil {
+		// index and alternative names are resolved to the kernel name used for socket binding
+		*interfaceName = intFace.Name
+	}
+	if networkStatus != nil && intFace != nil && networkStatus.Mac != "" &&
+		!strings.EqualFold(networkStatus.Mac, intFace.HardwareAddr.String()) {
+		log.Printf("Warning: interface %s mac %s differs from network %s mac %s",
+			intFace.Name, intFace.HardwareAddr, networkStatus.Name, networkStatus.Mac)
+	}
+
+	err = validateProtocol(*protocol)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
 	}
 
-	err = validateIP(*dstAddress, *multicast)
+	err = validateFamily(*family)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error: %v\n", err)
 		os.Exit(1)
 	}
-	protocolVersion := ipProtocolVersion(*dstAddress)
 
-	switch *protocol {
-	case protocols.ProtocolICMP:
-		test := protocols.NewICMPTest(*mtu, protocolVersion, *dstAddress, *interfaceName, *packagesNumber, *negative)
-		test.RunTest()
+	mtu, err := parseMtu(*mtuValue)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
 
-	case protocols.ProtocolTCP:
-		err = validatePort(*serverPort)
+	err = validateSourcePort(*sourcePort)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+
+	err = validateVRF(*vrfName, *interfaceName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+
+	flows.PortFirst, flows.PortLast, err = parseSourcePortRange(*sourcePortRange)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	flows.Sources = parseFlowSources(*flowSources)
+
+	expectation, err := parseExpectation(*expectPackets, *expectFrom, *expectWithin)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *serverMode {
+		if expectation != nil && (*multicast || *broadcast) {
+			fmt.Fprintf(os.Stderr, "error: Unsupported parameter expect-packets/expect-from/expect-within in multicast/broadcast "+
+				"server mode, the server only sends, use it with the receiving client\n")
+			os.Exit(1)
+		}
+		if *waitPeer != 0 {
+			log.Printf("Parameter -wait-peer=%s ignored in server mode", *waitPeer)
+		}
+		spec := serverSpec{
+			Protocol:   *protocol,
+			Server:     *dstAddress,
+			Port:       *serverPort,
+			MTU:        *mtuValue,
+			MTUStrict:  *mtuStrict,
+			Packages:   *packagesNumber,
+			Interface:  *interfaceName,
+			VRF:        *vrfName,
+			Source:     *sourceIP,
+			SourcePort: *sourcePort,
+			Multicast:  *multicast,
+			Broadcast:  *broadcast,
+			Directed:   *directed,
+			Reflect:    reflect.Enabled,
+			Identity:   *identity,
+		}
+		if reflect.ExpectSourceIP != "" {
+			log.Printf("Parameter -expect-source-ip=%s ignored in server mode", reflect.ExpectSourceIP)
+		}
+		if flows.Enabled() {
+			log.Printf("Parameter -flows/-source-port-range/-flow-sources ignored in server mode")
+		}
+		if *trace {
+			log.Printf("Parameter -trace ignored in server mode")
+		}
+		var endpoints *serverEndpoints
+		if *metricsPerClient && *metricsAddress == "" {
+			log.Printf("Parameter -metrics-per-client ignored without -metrics-address")
+		}
+		if *metricsAddress != "" {
+			endpoints, err = startServerEndpoints(*metricsAddress, &spec, *metricsPerClient)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		server, err := spec.start(networkStatus)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "error: %v\n", err)
 			os.Exit(1)
 		}
-		test := protocols.NewTCPTest(*mtu, protocolVersion, *dstAddress, *serverPort, *packagesNumber, *negative, *timeoutTCP, *interfaceName)
-		test.RunTest()
-
-	case protocols.ProtocolUDP:
-		err = validatePort(*serverPort)
+		if endpoints != nil {
+			endpoints.setServer(server)
+		}
+		if expectation != nil {
+			err = expectation.waitServer(server)
+			if err != nil {
+				os.Exit(1)
+			}
+			return
+		}
+		err = server.Wait()
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "error: %v\n", err)
 			os.Exit(1)
 		}
-		test := protocols.NewUDPTest(*mtu, protocolVersion, *dstAddress, *serverPort, *packagesNumber, *negative, *multicast, *broadcast, *timeoutUDP, *interfaceName)
-		test.RunTest()
+		return
+	}
 
-	case protocols.ProtocolSCTP:
-		err = validatePort(*serverPort)
-		if err != nil {
-			log.Fatalf("port validation error: %v\n", err)
-		}
-		test := protocols.NewSCTPTest(*mtu, *dstAddress, protocolVersion, *serverPort, *packagesNumber, *negative)
-		test.RunTest()
+	if *metricsAddress != "" {
+		log.Printf("Parameter -metrics-address=%s ignored in client mode", *metricsAddress)
+	}
+	if *identity != "" {
+		log.Printf("Parameter -identity=%s ignored in client mode", *identity)
+	}
+	test := clientTest{
+		Protocol:      *protocol,
+		Server:        *dstAddress,
+		Family:        *family,
+		AllAddresses:  *allAddresses,
+		Port:          *serverPort,
+		Packages:      *packagesNumber,
+		MTU:           mtu,
+		MTUStrict:     *mtuStrict,
+		Negative:      *negative,
+		TimeoutTCP:    *timeoutTCP,
+		TimeoutUDP:    *timeoutUDP,
+		Interface:     *interfaceName,
+		VRF:           *vrfName,
+		Source:        *sourceIP,
+		SourcePort:    *sourcePort,
+		Multicast:     *multicast,
+		Broadcast:     *broadcast,
+		Directed:      *directed,
+		Routing:       routing,
+		Reflect:       reflect,
+		Flows:         flows,
+		Trace:         *trace,
+		MaxHops:       *maxHops,
+		Diagnostics:   *diagnostics,
+		WaitPeer:      *waitPeer,
+		HappyEyeballs: *happyEyeballs,
+		Expectation:   expectation,
+		network:       networkStatus,
+	}
+	err = test.run()
+	if err != nil {
+		log.Print(err)
+		os.Exit(1)
 	}
 }
@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestDefineBroadcastAddress(t *testing.T) {
+	tests := []struct {
+		name     string
+		host     string
+		directed bool
+		want     string
+		wantErr  bool
+	}{
+		{name: "default limited broadcast", want: ipv4BroadcastAddress},
+		{name: "limited broadcast", host: "255.255.255.255", want: "255.255.255.255"},
+		{name: "remote directed broadcast", host: "10.30.0.255", want: "10.30.0.255"},
+		{name: "directed broadcast ignores flag", host: "192.168.1.127", directed: true, want: "192.168.1.127"},
+		{name: "ipv6 link-scoped group", host: "ff02::1", want: "ff02::1"},
+		{name: "ipv6 link-scoped group with zone", host: "ff02::1%eth0", want: "ff02::1%eth0"},
+		{name: "directed without interface", directed: true, wantErr: true},
+		{name: "unspecified", host: "0.0.0.0", wantErr: true},
+		{name: "ipv4 multicast", host: "239.1.1.1", wantErr: true},
+		{name: "ipv6 global multicast", host: "ff0e::1", wantErr: true},
+		{name: "ipv6 unicast", host: "fd10::1", wantErr: true},
+		{name: "hostname", host: "example.com", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := defineBroadcastAddress(tt.host, tt.directed, "")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("defineBroadcastAddress(%q, %v) error = %v, wantErr %v", tt.host, tt.directed, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("defineBroadcastAddress(%q, %v) = %q, want %q", tt.host, tt.directed, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	matrixCommand = "matrix"
+
+	outputMarkdown = "markdown"
+
+	verdictAllow = "allow"
+	verdictDeny  = "deny"
+	verdictError = "error"
+)
+
+// matrix is a connectivity truth table: every source is tested against every target and the observed
+// verdict is compared to the expected one. Allow cells run as positive tests, deny cells as negative tests
+type matrix struct {
+	Concurrency int                          `yaml:"concurrency"`
+	Default     string                       `yaml:"default"`
+	Defaults    planTest                     `yaml:"defaults"`
+	Sources     []matrixSource               `yaml:"sources"`
+	Targets     []matrixTarget               `yaml:"targets"`
+	Expect      map[string]map[string]string `yaml:"expect"`
+}
+
+// matrixSource defines where the traffic comes from, a row of the table
+type matrixSource struct {
+	Name      string `yaml:"name"`
+	Interface string `yaml:"interface"`
+	VRF       string `yaml:"vrf"`
+	Source    string `yaml:"source"`
+	Mark      int    `yaml:"mark"`
+}
+
+// matrixTarget defines destination, port and protocol, a column of the table
+type matrixTarget struct {
+	Name     string `yaml:"name"`
+	Protocol string `yaml:"protocol"`
+	Server   string `yaml:"server"`
+	Family   string `yaml:"family"`
+	Port     int    `yaml:"port"`
+	Expect   string `yaml:"expect"`
+}
+
+// matrixReport is the rendered truth table
+type matrixReport struct {
+	Matched    int          `json:"matched"`
+	Mismatched int          `json:"mismatched"`
+	Duration   string       `json:"duration"`
+	Sources    []string     `json:"sources"`
+	Targets    []string     `json:"targets"`
+	Cells      []matrixCell `json:"cells"`
+}
+
+type matrixCell struct {
+	Source   string `json:"source"`
+	Target   string `json:"target"`
+	Protocol string `json:"protocol"`
+	Server   string `json:"server"`
+	Port     int    `json:"port,omitempty"`
+	Expected string `json:"expected"`
+	Observed string `json:"observed"`
+	Match    bool   `json:"match"`
+	Duration string `json:"duration"`
+	Error    string `json:"error,omitempty"`
+}
+
+// runMatrix runs the matrix command and returns the exit code
+func runMatrix(args []string) int {
+	flags := flag.NewFlagSet(matrixCommand, flag.ExitOnError)
+	file := flags.String("file", "", "YAML or JSON file with the matrix")
+	concurrency := flags.Int("concurrency", 0, "Number of cells tested in parallel. Options: Any int in range 1-64 (default from the file or 1)")
+	output := flags.String("output", outputText, "Report format. Options: text/markdown/json")
+	flags.Parse(args)
+
+	connectivityMatrix, err := readMatrix(*file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	if *concurrency != 0 {
+		connectivityMatrix.Concurrency = *concurrency
+	}
+	if connectivityMatrix.Concurrency == 0 {
+		connectivityMatrix.Concurrency = 1
+	}
+	err = validateIntInRange(connectivityMatrix.Concurrency, 1, 64)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: unsupported parameter concurrency %v\n", err)
+		return 1
+	}
+	if *output != outputText && *output != outputMarkdown && *output != outputJSON {
+		fmt.Fprintf(os.Stderr, "error: unsupported parameter output=%s\n", *output)
+		return 1
+	}
+
+	stdout := redirectTestOutput()
+	report := connectivityMatrix.run()
+	switch *output {
+	case outputJSON:
+		err = report.writeJSON(stdout)
+	case outputMarkdown:
+		err = report.writeMarkdown(stdout)
+	default:
+		err = report.writeText(stdout)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	if report.Mismatched != 0 {
+		return 1
+	}
+	return 0
+}
+
+// readMatrix reads the matrix. A matrix without sources has single
+// source testing from the default interface
+func readMatrix(file string) (*matrix, error) {
+	if file == "" {
+		return nil, fmt.Errorf("matrix file is required")
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	connectivityMatrix := &matrix{}
+	err = decodeStrict(data, connectivityMatrix)
+	if err != nil {
+		return nil, fmt.Errorf("can not parse matrix %s: %w", file, err)
+	}
+	if len(connectivityMatrix.Targets) == 0 {
+		return nil, fmt.Errorf("matrix %s has no targets", file)
+	}
+	if len(connectivityMatrix.Sources) == 0 {
+		connectivityMatrix.Sources = []matrixSource{{Name: "local"}}
+	}
+	err = validateVerdict(connectivityMatrix.Default, true)
+	if err != nil {
+		return nil, fmt.Errorf("matrix %s default: %w", file, err)
+	}
+
+	sources := map[string]bool{}
+	for i := range connectivityMatrix.Sources {
+		source := &connectivityMatrix.Sources[i]
+		if source.Name == "" {
+			source.Name = source.defaultName(i)
+		}
+		if sources[source.Name] {
+			return nil, fmt.Errorf("matrix %s has duplicate source name %s", file, source.Name)
+		}
+		sources[source.Name] = true
+	}
+	targets := map[string]bool{}
+	for i := range connectivityMatrix.Targets {
+		target := &connectivityMatrix.Targets[i]
+		if target.Name == "" {
+			target.Name = target.defaultName()
+		}
+		if targets[target.Name] {
+			return nil, fmt.Errorf("matrix %s has duplicate target name %s", file, target.Name)
+		}
+		targets[target.Name] = true
+		err = validateVerdict(target.Expect, true)
+		if err != nil {
+			return nil, fmt.Errorf("matrix %s target %s: %w", file, target.Name, err)
+		}
+	}
+	for sourceName, row := range connectivityMatrix.Expect {
+		if !sources[sourceName] {
+			return nil, fmt.Errorf("matrix %s expects verdicts of unknown source %s", file, sourceName)
+		}
+		for targetName, verdict := range row {
+			if !targets[targetName] {
+				return nil, fmt.Errorf("matrix %s expects verdict of unknown target %s", file, targetName)
+			}
+			err = validateVerdict(verdict, false)
+			if err != nil {
+				return nil, fmt.Errorf("matrix %s cell %s/%s: %w", file, sourceName, targetName, err)
+			}
+		}
+	}
+	for _, source := range connectivityMatrix.Sources {
+		for _, target := range connectivityMatrix.Targets {
+			if connectivityMatrix.expected(source, target) == "" {
+				return nil, fmt.Errorf("matrix %s has no verdict for cell %s/%s, set expect or default",
+					file, source.Name, target.Name)
+			}
+		}
+	}
+	return connectivityMatrix, nil
+}
+
+func validateVerdict(verdict string, optional bool) error {
+	if verdict == verdictAllow || verdict == verdictDeny || (optional && verdict == "") {
+		return nil
+	}
+	return fmt.Errorf("unsupported verdict %q. Options: %s/%s", verdict, verdictAllow, verdictDeny)
+}
+
+func (source *matrixSource) defaultName(index int) string {
+	switch {
+	case source.Source != "":
+		return source.Source
+	case source.Interface != "":
+		return source.Interface
+	case source.VRF != "":
+		return source.VRF
+	}
+	return fmt.Sprintf("source-%d", index+1)
+}
+
+func (target *matrixTarget) defaultName() string {
+	if target.Port == 0 {
+		return fmt.Sprintf("%s/%s", target.Protocol, target.Server)
+	}
+	return fmt.Sprintf("%s/%s:%d", target.Protocol, target.Server, target.Port)
+}
+
+// expected returns the verdict of the cell, the cell verdict overrides the target and matrix default
+func (connectivityMatrix *matrix) expected(source matrixSource, target matrixTarget) string {
+	if verdict := connectivityMatrix.Expect[source.Name][target.Name]; verdict != "" {
+		return verdict
+	}
+	if target.Expect != "" {
+		return target.Expect
+	}
+	return connectivityMatrix.Default
+}
+
+// cellTest merges the defaults, the source and the target into plan test
+func (connectivityMatrix *matrix) cellTest(source matrixSource, target matrixTarget) planTest {
+	test := connectivityMatrix.Defaults
+	test.Name = source.Name + "/" + target.Name
+	if source.Interface != "" {
+		test.Interface = source.Interface
+	}
+	if source.VRF != "" {
+		test.VRF = source.VRF
+	}
+	if source.Source != "" {
+		test.Source = source.Source
+	}
+	if source.Mark != 0 {
+		test.Mark = source.Mark
+	}
+	test.Protocol = target.Protocol
+	test.Server = target.Server
+	if target.Family != "" {
+		test.Family = target.Family
+	}
+	if target.Port != 0 {
+		test.Port = target.Port
+	}
+	test.Negative = connectivityMatrix.expected(source, target) == verdictDeny
+	return test
+}
+
+// run tests every cell as positive or negative plan test and compares observed verdicts
+func (connectivityMatrix *matrix) run() *matrixReport {
+	start := time.Now()
+	report := &matrixReport{}
+	cellPlan := &plan{Concurrency: connectivityMatrix.Concurrency}
+	for _, source := range connectivityMatrix.Sources {
+		report.Sources = append(report.Sources, source.Name)
+		for _, target := range connectivityMatrix.Targets {
+			cellPlan.Tests = append(cellPlan.Tests, connectivityMatrix.cellTest(source, target))
+		}
+	}
+	for _, target := range connectivityMatrix.Targets {
+		report.Targets = append(report.Targets, target.Name)
+	}
+
+	planResults := cellPlan.run()
+	i := 0
+	for _, source := range connectivityMatrix.Sources {
+		for _, target := range connectivityMatrix.Targets {
+			cell := newMatrixCell(source, target, connectivityMatrix.expected(source, target), planResults.Tests[i])
+			if cell.Match {
+				report.Matched++
+			} else {
+				report.Mismatched++
+			}
+			report.Cells = append(report.Cells, cell)
+			i++
+		}
+	}
+	report.Duration = time.Since(start).Round(time.Millisecond).String()
+	return report
+}
+
+// newMatrixCell derives the observed verdict: passed test observed the expected verdict, failed test
+// observed the opposite one unless the connectivity was not observed at all
+func newMatrixCell(source matrixSource, target matrixTarget, expected string, test planTestReport) matrixCell {
+	cell := matrixCell{
+		Source:   source.Name,
+		Target:   target.Name,
+		Protocol: target.Protocol,
+		Server:   target.Server,
+		Port:     target.Port,
+		Expected: expected,
+		Duration: test.Duration,
+		Match:    test.Passed,
+		Error:    test.Error,
+	}
+	inconclusive := len(test.Results) == 0
+	for _, result := range test.Results {
+		inconclusive = inconclusive || result.Inconclusive
+	}
+	switch {
+	case inconclusive && !test.Passed:
+		cell.Observed = verdictError
+	case test.Passed:
+		cell.Observed = expected
+	case expected == verdictAllow:
+		cell.Observed = verdictDeny
+	default:
+		cell.Observed = verdictAllow
+	}
+	if cell.Error == "" {
+		var errs []string
+		for _, result := range test.Results {
+			if result.Error != "" {
+				errs = append(errs, fmt.Sprintf("%s: %s", result.Address, result.Error))
+			}
+		}
+		cell.Error = strings.Join(errs, "; ")
+	}
+	return cell
+}
+
+func (report *matrixReport) cell(source string, target string) *matrixCell {
+	for i := range report.Cells {
+		if report.Cells[i].Source == source && report.Cells[i].Target == target {
+			return &report.Cells[i]
+		}
+	}
+	return nil
+}
+
+func (report *matrixReport) writeJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(report)
+}
+
+// writeText renders the observed verdicts, mismatched cells are marked with ! and followed by the expectation
+func (report *matrixReport) writeText(w io.Writer) error {
+	fmt.Fprintf(w, "--- matrix report ---\n")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "SOURCE \\ TARGET\t%s\n", strings.Join(report.Targets, "\t"))
+	for _, source := range report.Sources {
+		row := []string{source}
+		for _, target := range report.Targets {
+			cell := report.cell(source, target)
+			if cell.Match {
+				row = append(row, cell.Observed)
+			} else {
+				row = append(row, fmt.Sprintf("!%s (expected %s)", cell.Observed, cell.Expected))
+			}
+		}
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	err := tw.Flush()
+	if err != nil {
+		return err
+	}
+	report.writeMismatches(w, "")
+	_, err = fmt.Fprintf(w, "%d matched, %d mismatched, time %s\n", report.Matched, report.Mismatched, report.Duration)
+	return err
+}
+
+// writeMarkdown renders the truth table as markdown table, mismatched cells are bold and marked with ❌
+func (report *matrixReport) writeMarkdown(w io.Writer) error {
+	fmt.Fprintf(w, "| source \\ target | %s |\n", strings.Join(report.Targets, " | "))
+	fmt.Fprintf(w, "|---|%s\n", strings.Repeat("---|", len(report.Targets)))
+	for _, source := range report.Sources {
+		row := []string{source}
+		for _, target := range report.Targets {
+			cell := report.cell(source, target)
+			if cell.Match {
+				row = append(row, cell.Observed+" ✅")
+			} else {
+				row = append(row, fmt.Sprintf("**%s** ❌ (expected %s)", cell.Observed, cell.Expected))
+			}
+		}
+		fmt.Fprintf(w, "| %s |\n", strings.Join(row, " | "))
+	}
+	fmt.Fprintln(w)
+	report.writeMismatches(w, "* ")
+	_, err := fmt.Fprintf(w, "\n%d matched, %d mismatched, time %s\n", report.Matched, report.Mismatched, report.Duration)
+	return err
+}
+
+func (report *matrixReport) writeMismatches(w io.Writer, prefix string) {
+	for _, cell := range report.Cells {
+		if cell.Match {
+			continue
+		}
+		fmt.Fprintf(w, "%s%s -> %s: expected %s, observed %s", prefix, cell.Source, cell.Target, cell.Expected, cell.Observed)
+		if cell.Error != "" {
+			fmt.Fprintf(w, ": %s", cell.Error)
+		}
+		fmt.Fprintln(w)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import "testing"
+
+func TestNewMatrixCellVerdict(t *testing.T) {
+	passed := planAddressReport{Address: "10.10.0.2", Passed: true}
+	failed := planAddressReport{Address: "10.10.0.2", Error: "TCP test failed"}
+	setupFailed := planAddressReport{Address: "10.10.0.2", Inconclusive: true, Error: "bind: address not available"}
+	tests := []struct {
+		name     string
+		expected string
+		test     planTestReport
+		observed string
+		match    bool
+		error    string
+	}{
+		{name: "allow passed", expected: verdictAllow,
+			test: planTestReport{Passed: true, Results: []planAddressReport{passed}}, observed: verdictAllow, match: true},
+		{name: "deny passed", expected: verdictDeny,
+			test: planTestReport{Passed: true, Results: []planAddressReport{passed}}, observed: verdictDeny, match: true},
+		{name: "allow failed", expected: verdictAllow,
+			test: planTestReport{Results: []planAddressReport{failed}}, observed: verdictDeny,
+			error: "10.10.0.2: TCP test failed"},
+		{name: "deny failed", expected: verdictDeny,
+			test: planTestReport{Results: []planAddressReport{failed}}, observed: verdictAllow,
+			error: "10.10.0.2: TCP test failed"},
+		{name: "allow inconclusive", expected: verdictAllow,
+			test: planTestReport{Results: []planAddressReport{setupFailed}}, observed: verdictError,
+			error: "10.10.0.2: bind: address not available"},
+		{name: "deny inconclusive", expected: verdictDeny,
+			test: planTestReport{Results: []planAddressReport{setupFailed}}, observed: verdictError,
+			error: "10.10.0.2: bind: address not available"},
+		{name: "one address inconclusive", expected: verdictDeny,
+			test: planTestReport{Results: []planAddressReport{
+				{Address: "10.10.0.2", Passed: true}, {Address: "fd10::2", Inconclusive: true, Error: "route"}}},
+			observed: verdictError, error: "fd10::2: route"},
+		{name: "no results", expected: verdictDeny,
+			test: planTestReport{Error: "lookup api.prod.svc: no such host"}, observed: verdictError,
+			error: "lookup api.prod.svc: no such host"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cell := newMatrixCell(matrixSource{Name: "frontend"}, matrixTarget{Name: "api"}, tt.expected, tt.test)
+			if cell.Observed != tt.observed {
+				t.Errorf("Observed = %s, want %s", cell.Observed, tt.observed)
+			}
+			if cell.Match != tt.match {
+				t.Errorf("Match = %v, want %v", cell.Match, tt.match)
+			}
+			if cell.Error != tt.error {
+				t.Errorf("Error = %q, want %q", cell.Error, tt.error)
+			}
+		})
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	monitorCommand = "monitor"
+
+	// monitorMaxErrorLength limits the last error label, the label value is kept for every probe target
+	monitorMaxErrorLength = 256
+)
+
+// monitorConfig is a set of probes executed repeatedly
+type monitorConfig struct {
+	Interval time.Duration  `yaml:"interval"`
+	Probes   []monitorProbe `yaml:"probes"`
+}
+
+// monitorProbe is a plan test executed every interval
+type monitorProbe struct {
+	Interval time.Duration `yaml:"interval"`
+	Test     planTest      `yaml:",inline"`
+}
+
+// monitor keeps metrics of the probe targets
+type monitor struct {
+	mutex   sync.Mutex
+	targets map[string]*targetMetrics
+}
+
+// targetMetrics are metrics of single address tested by the probe, probes failing before any
+// address is tested are recorded against the configured server
+type targetMetrics struct {
+	probe     string
+	protocol  string
+	target    string
+	rtt       *histogram
+	sent      uint64
+	lost      uint64
+	runs      uint64
+	failures  uint64
+	success   bool
+	lastError string
+	lastRun   time.Time
+	duration  time.Duration
+}
+
+// runMonitor runs the monitor command and returns the exit code
+func runMonitor(args []string) int {
+	flags := flag.NewFlagSet(monitorCommand, flag.ExitOnError)
+	file := flags.String("file", "", "YAML or JSON file with the probes")
+	address := flags.String("listen-address", ":9091", "Address of the metrics endpoint")
+	interval := flags.Duration("interval", 0, "Default interval of the probes (default from the file or 30s)")
+	flags.Parse(args)
+
+	config, err := readMonitorConfig(*file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	if *interval != 0 {
+		config.Interval = *interval
+	}
+	if config.Interval == 0 {
+		config.Interval = 30 * time.Second
+	}
+
+	probeMonitor := &monitor{targets: map[string]*targetMetrics{}}
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	var wg sync.WaitGroup
+	for i := range config.Probes {
+		probe := config.Probes[i]
+		if probe.Interval == 0 {
+			probe.Interval = config.Interval
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			probeMonitor.runProbe(ctx, probe)
+		}()
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(metricsPath, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		probeMonitor.writeMetrics(w)
+	})
+	mux.HandleFunc(healthPath, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	httpServer := &http.Server{Addr: *address, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		log.Print("Monitor stopping")
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer shutdownCancel()
+		httpServer.Shutdown(shutdownCtx)
+	}()
+	log.Printf("Start monitor of %d probes, metrics on %s%s", len(config.Probes), *address, metricsPath)
+	err = httpServer.ListenAndServe()
+	cancel()
+	wg.Wait()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// readMonitorConfig reads the probes, names identify the probes in the metrics and must be unique
+func readMonitorConfig(file string) (*monitorConfig, error) {
+	if file == "" {
+		return nil, fmt.Errorf("monitor file is required")
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	config := &monitorConfig{}
+	err = decodeStrict(data, config)
+	if err != nil {
+		return nil, fmt.Errorf("can not parse monitor %s: %w", file, err)
+	}
+	if len(config.Probes) == 0 {
+		return nil, fmt.Errorf("monitor %s has no probes", file)
+	}
+	if config.Interval < 0 {
+		return nil, fmt.Errorf("monitor %s has negative interval", file)
+	}
+	names := map[string]bool{}
+	for i := range config.Probes {
+		probe := &config.Probes[i]
+		if probe.Test.Name == "" {
+			probe.Test.Name = fmt.Sprintf("probe-%d", i+1)
+		}
+		if names[probe.Test.Name] {
+			return nil, fmt.Errorf("monitor %s has duplicate probe name %s", file, probe.Test.Name)
+		}
+		names[probe.Test.Name] = true
+		if probe.Interval < 0 {
+			return nil, fmt.Errorf("monitor %s probe %s has negative interval", file, probe.Test.Name)
+		}
+		err = validateProtocol(probe.Test.Protocol)
+		if err != nil {
+			return nil, fmt.Errorf("monitor %s probe %s: %w", file, probe.Test.Name, err)
+		}
+	}
+	return config, nil
+}
+
+// runProbe executes the probe immediately and then every interval until the context is done. Runs
+// longer than the interval delay the next run
+func (probeMonitor *monitor) runProbe(ctx context.Context, probe monitorProbe) {
+	ticker := time.NewTicker(probe.Interval)
+	defer ticker.Stop()
+	for {
+		probeMonitor.executeProbe(probe.Test)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// executeProbe runs the test once and records the metrics of every tested address
+func (probeMonitor *monitor) executeProbe(test planTest) {
+	start := time.Now()
+	client, err := test.clientTest()
+	var results []clientResult
+	if err == nil {
+		results, _, err = client.runAll()
+	}
+	if err != nil {
+		log.Printf("Probe %s failed: %v", test.Name, err)
+		probeMonitor.record(test.Name, test.Protocol, test.Server, start, time.Since(start), nil, err)
+		probeMonitor.expire(test.Name, map[string]bool{test.Server: true})
+		return
+	}
+	tested := map[string]bool{}
+	for i := range results {
+		result := results[i]
+		report := test.Thresholds.evaluate(test.Negative, result)
+		var resultErr error
+		if !report.Passed {
+			resultErr = errors.New(report.Error)
+			log.Printf("Probe %s target %s failed: %s", test.Name, result.Address, report.Error)
+		}
+		probeMonitor.record(test.Name, test.Protocol, result.Address, start, result.Duration, &result, resultErr)
+		tested[result.Address] = true
+	}
+	probeMonitor.expire(test.Name, tested)
+}
+
+// expire removes targets of the probe not tested by the last run, e.g. addresses the hostname no longer
+// resolves to, so their last values are not served forever
+func (probeMonitor *monitor) expire(probe string, tested map[string]bool) {
+	probeMonitor.mutex.Lock()
+	defer probeMonitor.mutex.Unlock()
+	for key, metrics := range probeMonitor.targets {
+		if metrics.probe == probe && !tested[metrics.target] {
+			delete(probeMonitor.targets, key)
+		}
+	}
+}
+
+func (probeMonitor *monitor) record(
+	probe string, protocol string, target string, start time.Time, duration time.Duration, result *clientResult, err error) {
+	probeMonitor.mutex.Lock()
+	defer probeMonitor.mutex.Unlock()
+	key := probe + "\x00" + target
+	metrics, ok := probeMonitor.targets[key]
+	if !ok {
+		metrics = &targetMetrics{probe: probe, protocol: protocol, target: target, rtt: newHistogram(rttBuckets)}
+		probeMonitor.targets[key] = metrics
+	}
+	metrics.runs++
+	metrics.lastRun = start
+	metrics.duration = duration
+	metrics.success = err == nil
+	metrics.lastError = ""
+	if err != nil {
+		metrics.failures++
+		metrics.lastError = err.Error()
+		metrics.lastError = truncateUTF8(metrics.lastError, monitorMaxErrorLength)
+	}
+	if result != nil && result.Result != nil {
+		metrics.sent += uint64(result.Result.Transmitted)
+		metrics.lost += uint64(result.Result.Transmitted - result.Result.Received)
+		for _, rtt := range result.Result.RTTs {
+			metrics.rtt.observe(rtt.Seconds())
+		}
+	}
+}
+
+// truncateUTF8 cuts the string to at most max bytes on the rune boundary
+func truncateUTF8(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	for max > 0 && !utf8.RuneStart(s[max]) {
+		max--
+	}
+	return s[:max]
+}
+
+// writeMetrics writes the metrics in Prometheus text exposition format
+func (probeMonitor *monitor) writeMetrics(w io.Writer) {
+	probeMonitor.mutex.Lock()
+	defer probeMonitor.mutex.Unlock()
+	keys := make([]string, 0, len(probeMonitor.targets))
+	for key := range probeMonitor.targets {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	targets := make([]*targetMetrics, 0, len(keys))
+	for _, key := range keys {
+		targets = append(targets, probeMonitor.targets[key])
+	}
+
+	writeMetricHeader(w, "testcmd_probe_rtt_seconds", "histogram", "Round trip time of received packets.")
+	for _, target := range targets {
+		target.rtt.write(w, "testcmd_probe_rtt_seconds", target.labels())
+	}
+	writeMetricHeader(w, "testcmd_probe_packets_sent_total", "counter", "Packets sent by the probe.")
+	for _, target := range targets {
+		writeMetric(w, "testcmd_probe_packets_sent_total", target.labels(), float64(target.sent))
+	}
+	writeMetricHeader(w, "testcmd_probe_packets_lost_total", "counter", "Packets sent by the probe without reply.")
+	for _, target := range targets {
+		writeMetric(w, "testcmd_probe_packets_lost_total", target.labels(), float64(target.lost))
+	}
+	writeMetricHeader(w, "testcmd_probe_runs_total", "counter", "Runs of the probe.")
+	for _, target := range targets {
+		writeMetric(w, "testcmd_probe_runs_total", target.labels(), float64(target.runs))
+	}
+	writeMetricHeader(w, "testcmd_probe_failures_total", "counter", "Runs of the probe not matching the expectation.")
+	for _, target := range targets {
+		writeMetric(w, "testcmd_probe_failures_total", target.labels(), float64(target.failures))
+	}
+	writeMetricHeader(w, "testcmd_probe_success", "gauge", "Whether the last run matched the expectation.")
+	for _, target := range targets {
+		writeMetric(w, "testcmd_probe_success", target.labels(), boolMetric(target.success))
+	}
+	writeMetricHeader(w, "testcmd_probe_last_error", "gauge", "Error of the last run, 1 if the last run failed.")
+	for _, target := range targets {
+		writeMetric(w, "testcmd_probe_last_error", target.labels()+","+metricLabels("error", target.lastError),
+			boolMetric(!target.success))
+	}
+	writeMetricHeader(w, "testcmd_probe_duration_seconds", "gauge", "Duration of the last run.")
+	for _, target := range targets {
+		writeMetric(w, "testcmd_probe_duration_seconds", target.labels(), target.duration.Seconds())
+	}
+	writeMetricHeader(w, "testcmd_probe_last_run_timestamp_seconds", "gauge", "Start time of the last run.")
+	for _, target := range targets {
+		writeMetric(w, "testcmd_probe_last_run_timestamp_seconds", target.labels(),
+			float64(target.lastRun.UnixMilli())/1000)
+	}
+}
+
+func (target *targetMetrics) labels() string {
+	return metricLabels("probe", target.probe, "protocol", target.protocol, "target", target.target)
+}
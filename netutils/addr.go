@@ -0,0 +1,88 @@
+package netutils
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	ifaFlags = 8
+)
+
+// Addr keeps interface address read from netlink
+type Addr struct {
+	IP             net.IP
+	PrefixLen      int
+	InterfaceIndex int
+	Flags          uint32
+}
+
+// Tentative reports IPv6 address which did not finish duplicate address detection yet
+func (addr *Addr) Tentative() bool {
+	return addr.Flags&syscall.IFA_F_TENTATIVE != 0
+}
+
+// DADFailed reports IPv6 address which failed duplicate address detection
+func (addr *Addr) DADFailed() bool {
+	return addr.Flags&syscall.IFA_F_DADFAILED != 0
+}
+
+// String returns address in ip addr notation
+func (addr *Addr) String() string {
+	fields := []string{fmt.Sprintf("%s/%d", addr.IP, addr.PrefixLen)}
+	if addr.Tentative() {
+		fields = append(fields, "tentative")
+	}
+	if addr.DADFailed() {
+		fields = append(fields, "dadfailed")
+	}
+	if addr.Flags&syscall.IFA_F_DEPRECATED != 0 {
+		fields = append(fields, "deprecated")
+	}
+	return strings.Join(fields, " ")
+}
+
+// Addrs returns addresses of the interface with the given index, zero index returns addresses of all interfaces
+func Addrs(index int) ([]Addr, error) {
+	rib, err := syscall.NetlinkRIB(syscall.RTM_GETADDR, syscall.AF_UNSPEC)
+	if err != nil {
+		return nil, fmt.Errorf("netlink address dump failed: %w", err)
+	}
+	msgs, err := syscall.ParseNetlinkMessage(rib)
+	if err != nil {
+		return nil, fmt.Errorf("netlink address dump parse failed: %w", err)
+	}
+	var addrs []Addr
+	for i := range msgs {
+		if msgs[i].Header.Type != syscall.RTM_NEWADDR || len(msgs[i].Data) < syscall.SizeofIfAddrmsg {
+			continue
+		}
+		ifAddr := (*syscall.IfAddrmsg)(unsafe.Pointer(&msgs[i].Data[0]))
+		if index != 0 && int(ifAddr.Index) != index {
+			continue
+		}
+		attrs, err := syscall.ParseNetlinkRouteAttr(&msgs[i])
+		if err != nil {
+			return nil, fmt.Errorf("netlink address attributes parse failed: %w", err)
+		}
+		addr := Addr{PrefixLen: int(ifAddr.Prefixlen), InterfaceIndex: int(ifAddr.Index), Flags: uint32(ifAddr.Flags)}
+		for _, attr := range attrs {
+			switch attr.Attr.Type & nlaTypeMask {
+			case syscall.IFA_ADDRESS:
+				if addr.IP == nil {
+					addr.IP = net.IP(attr.Value)
+				}
+			case syscall.IFA_LOCAL:
+				// on point-to-point links IFA_ADDRESS is the peer address
+				addr.IP = net.IP(attr.Value)
+			case ifaFlags:
+				addr.Flags = attrUint32(attr.Value)
+			}
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
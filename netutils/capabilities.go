@@ -0,0 +1,140 @@
+package netutils
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Linux capabilities used by the tool
+const (
+	CapNetBindService = 10
+	CapNetAdmin       = 12
+	CapNetRaw         = 13
+	CapSysAdmin       = 21
+)
+
+var capabilityNames = map[int]string{
+	CapNetBindService: "CAP_NET_BIND_SERVICE",
+	CapNetAdmin:       "CAP_NET_ADMIN",
+	CapNetRaw:         "CAP_NET_RAW",
+	CapSysAdmin:       "CAP_SYS_ADMIN",
+}
+
+// CapabilityName returns the name of the capability
+func CapabilityName(capability int) string {
+	if name, ok := capabilityNames[capability]; ok {
+		return name
+	}
+	return fmt.Sprintf("CAP_%d", capability)
+}
+
+// EffectiveCapabilities reads the effective capability set of the process from /proc/self/status
+func EffectiveCapabilities() (uint64, error) {
+	file, err := os.Open("/proc/self/status")
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		value, found := strings.CutPrefix(scanner.Text(), "CapEff:")
+		if found {
+			return strconv.ParseUint(strings.TrimSpace(value), 16, 64)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("CapEff not found in /proc/self/status")
+}
+
+// HasCapability reports whether the capability is in the effective set, unknown set counts as present
+// so the kernel reports the actual error
+func HasCapability(capability int) bool {
+	effective, err := EffectiveCapabilities()
+	if err != nil {
+		return true
+	}
+	return effective&(1<<uint(capability)) != 0
+}
+
+// PingGroupRange returns net.ipv4.ping_group_range, groups allowed to open unprivileged icmp sockets.
+// The range applies to ICMPv6 sockets too
+func PingGroupRange() (uint32, uint32, error) {
+	value, err := ReadSysctl("net.ipv4.ping_group_range")
+	if err != nil {
+		return 0, 0, err
+	}
+	fields := strings.Fields(value)
+	if len(fields) != 2 {
+		return 0, 0, fmt.Errorf("unexpected ping_group_range %q", value)
+	}
+	low, err := strconv.ParseUint(fields[0], 10, 32)
+	if err != nil {
+		return 0, 0, err
+	}
+	high, err := strconv.ParseUint(fields[1], 10, 32)
+	if err != nil {
+		return 0, 0, err
+	}
+	return uint32(low), uint32(high), nil
+}
+
+// UnprivilegedPingAllowed reports whether a group of the process is in ping_group_range
+func UnprivilegedPingAllowed() bool {
+	low, high, err := PingGroupRange()
+	if err != nil {
+		return false
+	}
+	groups, err := syscall.Getgroups()
+	if err != nil {
+		groups = nil
+	}
+	groups = append(groups, syscall.Getegid())
+	for _, gid := range groups {
+		if uint32(gid) >= low && uint32(gid) <= high {
+			return true
+		}
+	}
+	return false
+}
+
+// UnprivilegedPortStart returns the lowest port bound without CAP_NET_BIND_SERVICE
+func UnprivilegedPortStart() int {
+	value, err := ReadSysctl("net.ipv4.ip_unprivileged_port_start")
+	if err != nil {
+		return 1024
+	}
+	port, err := strconv.Atoi(value)
+	if err != nil {
+		return 1024
+	}
+	return port
+}
+
+// BindToDeviceNeedsCapability reports whether SO_BINDTODEVICE requires CAP_NET_RAW, kernels since 5.7
+// allow unprivileged binding of unbound sockets
+func BindToDeviceNeedsCapability() bool {
+	var uname syscall.Utsname
+	err := syscall.Uname(&uname)
+	if err != nil {
+		return true
+	}
+	var release strings.Builder
+	for _, c := range uname.Release {
+		if c == 0 {
+			break
+		}
+		release.WriteByte(byte(c))
+	}
+	var major, minor int
+	_, err = fmt.Sscanf(release.String(), "%d.%d", &major, &minor)
+	if err != nil {
+		return true
+	}
+	return major < 5 || (major == 5 && minor < 7)
+}
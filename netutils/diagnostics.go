@@ -0,0 +1,120 @@
+package netutils
+
+import (
+	"fmt"
+	"io"
+	"net"
+)
+
+// Sysctl keeps sysctl name and value
+type Sysctl struct {
+	Name  string
+	Value string
+}
+
+// Diagnostics keeps network state collected after a failed test, read from netlink and /proc
+type Diagnostics struct {
+	Route      *Route
+	Link       *Link
+	Addresses  []Addr
+	Neighbour  *Neighbour
+	Sysctls    []Sysctl
+	ErrorQueue []SockError
+	// Errors keeps failures to collect parts of the diagnostics
+	Errors []string
+}
+
+// CollectDiagnostics gathers route lookup, egress interface state and addresses, next hop neighbour entry
+// and forwarding related sysctls for the traffic to dst
+func CollectDiagnostics(dst net.IP, src net.IP, mark int, oif int) *Diagnostics {
+	diag := &Diagnostics{}
+	route, err := RouteGet(dst, src, mark, oif)
+	if err != nil {
+		diag.Errors = append(diag.Errors, fmt.Sprintf("route lookup: %v", err))
+	}
+	diag.Route = route
+
+	var link *Link
+	switch {
+	case route != nil && route.Interface != "":
+		link, err = LinkByName(route.Interface)
+	case oif != 0:
+		link, err = LinkByIndex(oif)
+	default:
+		err = nil
+	}
+	if err != nil {
+		diag.Errors = append(diag.Errors, fmt.Sprintf("link: %v", err))
+	}
+	diag.Link = link
+
+	if link != nil {
+		diag.Addresses, err = Addrs(link.Index)
+		if err != nil {
+			diag.Errors = append(diag.Errors, fmt.Sprintf("addresses: %v", err))
+		}
+		nextHop := dst
+		if route != nil && route.Gateway != "" {
+			nextHop = net.ParseIP(route.Gateway)
+		}
+		if !nextHop.IsMulticast() {
+			diag.Neighbour, err = NeighbourByIP(nextHop, link.Index)
+			if err != nil {
+				diag.Errors = append(diag.Errors, fmt.Sprintf("neighbour: %v", err))
+			}
+		}
+	}
+
+	diag.Sysctls = collectSysctls(dst.To4() == nil, link)
+	return diag
+}
+
+func collectSysctls(ipv6 bool, link *Link) []Sysctl {
+	names := []string{"net/ipv4/ip_forward", "net/ipv4/conf/all/rp_filter", "net/ipv4/conf/all/accept_local"}
+	if link != nil {
+		names = append(names,
+			fmt.Sprintf("net/ipv4/conf/%s/rp_filter", link.Name),
+			fmt.Sprintf("net/ipv4/conf/%s/accept_local", link.Name))
+	}
+	if ipv6 {
+		names = append(names, "net/ipv6/conf/all/forwarding")
+		if link != nil {
+			names = append(names, fmt.Sprintf("net/ipv6/conf/%s/forwarding", link.Name))
+		}
+	}
+	var sysctls []Sysctl
+	for _, name := range names {
+		value, err := ReadSysctl(name)
+		if err != nil {
+			value = err.Error()
+		}
+		sysctls = append(sysctls, Sysctl{Name: name, Value: value})
+	}
+	return sysctls
+}
+
+// Print writes the diagnostics in human readable form
+func (diag *Diagnostics) Print(w io.Writer) {
+	fmt.Fprintln(w, "--- diagnostics ---")
+	if diag.Route != nil {
+		fmt.Fprintf(w, "route: %s\n", diag.Route)
+	}
+	if diag.Link != nil {
+		fmt.Fprintf(w, "link: %s\n", diag.Link)
+	}
+	for i := range diag.Addresses {
+		fmt.Fprintf(w, "address: %s\n", &diag.Addresses[i])
+	}
+	if diag.Neighbour != nil {
+		fmt.Fprintf(w, "neighbour: %s\n", diag.Neighbour)
+	}
+	for _, sysctl := range diag.Sysctls {
+		fmt.Fprintf(w, "sysctl: %s = %s\n", sysctl.Name, sysctl.Value)
+	}
+	for i := range diag.ErrorQueue {
+		fmt.Fprintf(w, "socket error: %s\n", &diag.ErrorQueue[i])
+	}
+	for _, collectErr := range diag.Errors {
+		fmt.Fprintf(w, "not collected: %s\n", collectErr)
+	}
+}
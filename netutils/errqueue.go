@@ -0,0 +1,111 @@
+package netutils
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+const (
+	sizeofSockExtendedErr = 16
+
+	// SockErrOriginLocal is an error generated by the local stack, e.g. message too long
+	SockErrOriginLocal = 1
+	// SockErrOriginICMP is ICMPv4 error received from the offender
+	SockErrOriginICMP = 2
+	// SockErrOriginICMP6 is ICMPv6 error received from the offender
+	SockErrOriginICMP6 = 3
+)
+
+// SockError keeps struct sock_extended_err read from the socket error queue
+type SockError struct {
+	Errno    syscall.Errno
+	Origin   uint8
+	Type     uint8
+	Code     uint8
+	Info     uint32
+	Offender net.IP
+}
+
+// String returns the socket error in human readable form
+func (sockErr *SockError) String() string {
+	switch sockErr.Origin {
+	case SockErrOriginICMP, SockErrOriginICMP6:
+		protocol := "icmp"
+		if sockErr.Origin == SockErrOriginICMP6 {
+			protocol = "icmpv6"
+		}
+		info := ""
+		if sockErr.Info != 0 {
+			info = fmt.Sprintf(" info %d", sockErr.Info)
+		}
+		return fmt.Sprintf("%s type %d code %d%s from %s: %s",
+			protocol, sockErr.Type, sockErr.Code, info, sockErr.Offender, sockErr.Errno)
+	case SockErrOriginLocal:
+		return fmt.Sprintf("local error mtu %d: %s", sockErr.Info, sockErr.Errno)
+	}
+	return fmt.Sprintf("origin %d: %s", sockErr.Origin, sockErr.Errno)
+}
+
+// EnableErrorQueue makes the kernel queue ICMP errors of the socket, they are read by ReadErrorQueue
+func EnableErrorQueue(fd int, protocolVersion int) error {
+	if protocolVersion == 6 {
+		return os.NewSyscallError("setsockopt", syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_RECVERR, 1))
+	}
+	return os.NewSyscallError("setsockopt", syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_RECVERR, 1))
+}
+
+// ReadErrorQueue drains the socket error queue without blocking
+func ReadErrorQueue(fd int) ([]SockError, error) {
+	var sockErrors []SockError
+	buffer := make([]byte, 512)
+	oob := make([]byte, 512)
+	for {
+		_, oobn, _, _, err := syscall.Recvmsg(fd, buffer, oob, syscall.MSG_ERRQUEUE|syscall.MSG_DONTWAIT)
+		if err == syscall.EAGAIN {
+			return sockErrors, nil
+		}
+		if err != nil {
+			return sockErrors, err
+		}
+		cmsgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+		if err != nil {
+			return sockErrors, err
+		}
+		for _, cmsg := range cmsgs {
+			isRecvErr := (cmsg.Header.Level == syscall.IPPROTO_IP && cmsg.Header.Type == syscall.IP_RECVERR) ||
+				(cmsg.Header.Level == syscall.IPPROTO_IPV6 && cmsg.Header.Type == syscall.IPV6_RECVERR)
+			if !isRecvErr || len(cmsg.Data) < sizeofSockExtendedErr {
+				continue
+			}
+			sockErrors = append(sockErrors, parseSockError(cmsg.Data))
+		}
+	}
+}
+
+func parseSockError(data []byte) SockError {
+	sockErr := SockError{
+		Errno:  syscall.Errno(binary.LittleEndian.Uint32(data[0:4])),
+		Origin: data[4],
+		Type:   data[5],
+		Code:   data[6],
+		Info:   binary.LittleEndian.Uint32(data[8:12]),
+	}
+	// offender sockaddr follows the extended error
+	offender := data[sizeofSockExtendedErr:]
+	if len(offender) >= 2 {
+		switch binary.LittleEndian.Uint16(offender[0:2]) {
+		case syscall.AF_INET:
+			if len(offender) >= 8 {
+				sockErr.Offender = net.IP(offender[4:8])
+			}
+		case syscall.AF_INET6:
+			if len(offender) >= 24 {
+				sockErr.Offender = net.IP(offender[8:24])
+			}
+		}
+	}
+	return sockErr
+}
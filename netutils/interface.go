@@ -0,0 +1,107 @@
+package netutils
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// ResolveInterface returns the interface given by name, alternative name or index.
+// Empty value means no interface was requested and returns nil interface without error.
+func ResolveInterface(interfaceName string) (*net.Interface, error) {
+	if interfaceName == "" {
+		return nil, nil
+	}
+	if index, err := strconv.Atoi(interfaceName); err == nil {
+		intFace, err := net.InterfaceByIndex(index)
+		if err != nil {
+			return nil, fmt.Errorf("can not find interface with index %d: %w", index, err)
+		}
+		return intFace, nil
+	}
+	intFace, err := net.InterfaceByName(interfaceName)
+	if err == nil {
+		return intFace, nil
+	}
+	links, linksErr := Links()
+	if linksErr != nil {
+		return nil, fmt.Errorf("can not find interface %s: %w", interfaceName, err)
+	}
+	for _, link := range links {
+		for _, altName := range link.AltNames {
+			if altName == interfaceName {
+				return net.InterfaceByIndex(link.Index)
+			}
+		}
+	}
+	return nil, fmt.Errorf("can not find interface %s by name, alternative name or index: %w", interfaceName, err)
+}
+
+// BindDevice returns the device sockets are bound to: the interface if set, otherwise the vrf
+func BindDevice(interfaceName string, vrfName string) string {
+	if interfaceName != "" {
+		return interfaceName
+	}
+	return vrfName
+}
+
+// BindToDevice binds socket to the device, empty device leaves the socket unbound
+func BindToDevice(fd int, device string) error {
+	if device == "" {
+		return nil
+	}
+	err := syscall.SetsockoptString(fd, syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, device)
+	if err == nil {
+		return nil
+	}
+	err = os.NewSyscallError("setsockopt", err)
+	if errors.Is(err, syscall.EPERM) {
+		return fmt.Errorf("binding to interface %s requested but not permitted, CAP_NET_RAW is required: %w", device, err)
+	}
+	return fmt.Errorf("binding to interface %s requested but failed: %w", device, err)
+}
+
+// SetMark sets socket firewall mark used by policy routing, zero mark leaves the socket unchanged
+func SetMark(fd int, mark int) error {
+	if mark == 0 {
+		return nil
+	}
+	err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_MARK, mark)
+	if err == nil {
+		return nil
+	}
+	err = os.NewSyscallError("setsockopt", err)
+	if errors.Is(err, syscall.EPERM) {
+		return fmt.Errorf("setting mark 0x%x requested but not permitted, CAP_NET_ADMIN is required: %w", mark, err)
+	}
+	return fmt.Errorf("setting mark 0x%x requested but failed: %w", mark, err)
+}
+
+// ControlBindToDevice returns net.Dialer/net.ListenConfig control function binding the socket to the device
+func ControlBindToDevice(device string) func(network string, address string, c syscall.RawConn) error {
+	return ControlSocket(device, 0)
+}
+
+// ControlSocket returns net.Dialer/net.ListenConfig control function binding the socket to the device
+// and setting the firewall mark
+func ControlSocket(device string, mark int) func(network string, address string, c syscall.RawConn) error {
+	return func(network string, address string, c syscall.RawConn) error {
+		if device == "" && mark == 0 {
+			return nil
+		}
+		var operr error
+		fn := func(fd uintptr) {
+			operr = BindToDevice(int(fd), device)
+			if operr == nil {
+				operr = SetMark(int(fd), mark)
+			}
+		}
+		if err := c.Control(fn); err != nil {
+			return err
+		}
+		return operr
+	}
+}
@@ -0,0 +1,189 @@
+package netutils
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// LinkKindVRF is the kind of L3 master device
+	LinkKindVRF = "vrf"
+	iffLowerUp  = 0x10000
+)
+
+var operStates = []string{"unknown", "notpresent", "down", "lowerlayerdown", "testing", "dormant", "up"}
+
+// Link keeps link attributes read from netlink
+type Link struct {
+	Index       int
+	Name        string
+	AltNames    []string
+	Kind        string
+	MTU         int
+	Flags       uint32
+	OperState   string
+	MasterIndex int
+	VRFTable    uint32
+}
+
+// Links returns all links of the current network namespace
+func Links() ([]Link, error) {
+	rib, err := syscall.NetlinkRIB(syscall.RTM_GETLINK, syscall.AF_UNSPEC)
+	if err != nil {
+		return nil, fmt.Errorf("netlink link dump failed: %w", err)
+	}
+	msgs, err := syscall.ParseNetlinkMessage(rib)
+	if err != nil {
+		return nil, fmt.Errorf("netlink link dump parse failed: %w", err)
+	}
+	var links []Link
+	for i := range msgs {
+		if msgs[i].Header.Type != syscall.RTM_NEWLINK || len(msgs[i].Data) < syscall.SizeofIfInfomsg {
+			continue
+		}
+		ifInfo := (*syscall.IfInfomsg)(unsafe.Pointer(&msgs[i].Data[0]))
+		attrs, err := syscall.ParseNetlinkRouteAttr(&msgs[i])
+		if err != nil {
+			return nil, fmt.Errorf("netlink link attributes parse failed: %w", err)
+		}
+		link := Link{Index: int(ifInfo.Index), Flags: ifInfo.Flags}
+		for _, attr := range attrs {
+			switch attr.Attr.Type & nlaTypeMask {
+			case syscall.IFLA_IFNAME:
+				link.Name = attrString(attr.Value)
+			case syscall.IFLA_MTU:
+				link.MTU = int(attrUint32(attr.Value))
+			case syscall.IFLA_OPERSTATE:
+				if len(attr.Value) > 0 && int(attr.Value[0]) < len(operStates) {
+					link.OperState = operStates[attr.Value[0]]
+				}
+			case syscall.IFLA_MASTER:
+				link.MasterIndex = int(attrUint32(attr.Value))
+			case syscall.IFLA_LINKINFO:
+				link.parseLinkInfo(attr.Value)
+			case iflaPropList:
+				for _, prop := range parseAttrs(attr.Value) {
+					if prop.Attr.Type == iflaAltName {
+						link.AltNames = append(link.AltNames, attrString(prop.Value))
+					}
+				}
+			}
+		}
+		links = append(links, link)
+	}
+	return links, nil
+}
+
+// String returns link state in ip link notation
+func (link *Link) String() string {
+	var flags []string
+	if link.Flags&syscall.IFF_UP != 0 {
+		flags = append(flags, "UP")
+	}
+	if link.Flags&iffLowerUp != 0 {
+		flags = append(flags, "LOWER_UP")
+	}
+	return fmt.Sprintf("%s <%s> mtu %d state %s", link.Name, strings.Join(flags, ","), link.MTU, strings.ToUpper(link.OperState))
+}
+
+func (link *Link) parseLinkInfo(value []byte) {
+	for _, info := range parseAttrs(value) {
+		switch info.Attr.Type {
+		case iflaInfoKind:
+			link.Kind = attrString(info.Value)
+		case iflaInfoData:
+			if link.Kind != LinkKindVRF {
+				continue
+			}
+			for _, data := range parseAttrs(info.Value) {
+				if data.Attr.Type == iflaVRFTable {
+					link.VRFTable = attrUint32(data.Value)
+				}
+			}
+		}
+	}
+}
+
+// LinkByName returns link with the given name
+func LinkByName(name string) (*Link, error) {
+	links, err := Links()
+	if err != nil {
+		return nil, err
+	}
+	for i := range links {
+		if links[i].Name == name {
+			return &links[i], nil
+		}
+	}
+	return nil, fmt.Errorf("link %s not found", name)
+}
+
+// LinkByIndex returns link with the given index
+func LinkByIndex(index int) (*Link, error) {
+	links, err := Links()
+	if err != nil {
+		return nil, err
+	}
+	for i := range links {
+		if links[i].Index == index {
+			return &links[i], nil
+		}
+	}
+	return nil, fmt.Errorf("link with index %d not found", index)
+}
+
+// VRFByName returns L3 master device and validates its kind is vrf
+func VRFByName(name string) (*Link, error) {
+	link, err := LinkByName(name)
+	if err != nil {
+		return nil, err
+	}
+	if link.Kind != LinkKindVRF {
+		return nil, fmt.Errorf("link %s is not a vrf device (kind %q)", name, link.Kind)
+	}
+	return link, nil
+}
+
+// VRFs returns all vrf devices
+func VRFs() ([]Link, error) {
+	links, err := Links()
+	if err != nil {
+		return nil, err
+	}
+	var vrfs []Link
+	for _, link := range links {
+		if link.Kind == LinkKindVRF {
+			vrfs = append(vrfs, link)
+		}
+	}
+	return vrfs, nil
+}
+
+// ValidateVRFMember checks the interface is enslaved to the vrf device
+func ValidateVRFMember(interfaceName string, vrf *Link) error {
+	link, err := LinkByName(interfaceName)
+	if err != nil {
+		return err
+	}
+	if link.MasterIndex != vrf.Index {
+		return fmt.Errorf("interface %s is not enslaved to vrf %s", interfaceName, vrf.Name)
+	}
+	return nil
+}
+
+// ReadSysctl returns value of the sysctl given in dotted notation, e.g. net.ipv4.ip_forward,
+// or in path notation when a component contains dots, e.g. net/ipv4/conf/eth0.100/rp_filter
+func ReadSysctl(name string) (string, error) {
+	path := name
+	if !strings.Contains(name, "/") {
+		path = strings.ReplaceAll(name, ".", "/")
+	}
+	value, err := os.ReadFile("/proc/sys/" + path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(value)), nil
+}
@@ -0,0 +1,91 @@
+package netutils
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+)
+
+const (
+	sizeofNdMsg = 12
+	ndaDst      = 1
+	ndaLLAddr   = 2
+)
+
+var neighbourStates = []struct {
+	state uint16
+	name  string
+}{
+	{0x01, "INCOMPLETE"},
+	{0x02, "REACHABLE"},
+	{0x04, "STALE"},
+	{0x08, "DELAY"},
+	{0x10, "PROBE"},
+	{0x20, "FAILED"},
+	{0x40, "NOARP"},
+	{0x80, "PERMANENT"},
+}
+
+// Neighbour keeps neighbour (arp/ndp) entry read from netlink
+type Neighbour struct {
+	IP             net.IP
+	HardwareAddr   net.HardwareAddr
+	InterfaceIndex int
+	State          uint16
+}
+
+// String returns neighbour entry in ip neigh notation
+func (neigh *Neighbour) String() string {
+	fields := []string{neigh.IP.String()}
+	if len(neigh.HardwareAddr) > 0 {
+		fields = append(fields, "lladdr", neigh.HardwareAddr.String())
+	}
+	for _, state := range neighbourStates {
+		if neigh.State&state.state != 0 {
+			fields = append(fields, state.name)
+		}
+	}
+	return strings.Join(fields, " ")
+}
+
+// NeighbourByIP returns neighbour entry of the ip address on the interface with the given index
+func NeighbourByIP(ip net.IP, index int) (*Neighbour, error) {
+	family := syscall.AF_INET
+	if ip.To4() == nil {
+		family = syscall.AF_INET6
+	}
+	rib, err := syscall.NetlinkRIB(syscall.RTM_GETNEIGH, family)
+	if err != nil {
+		return nil, fmt.Errorf("netlink neighbour dump failed: %w", err)
+	}
+	msgs, err := syscall.ParseNetlinkMessage(rib)
+	if err != nil {
+		return nil, fmt.Errorf("netlink neighbour dump parse failed: %w", err)
+	}
+	for _, msg := range msgs {
+		if msg.Header.Type != syscall.RTM_NEWNEIGH || len(msg.Data) < sizeofNdMsg {
+			continue
+		}
+		neigh := Neighbour{
+			InterfaceIndex: int(int32(binary.LittleEndian.Uint32(msg.Data[4:8]))),
+			State:          binary.LittleEndian.Uint16(msg.Data[8:10]),
+		}
+		if index != 0 && neigh.InterfaceIndex != index {
+			continue
+		}
+		for _, attr := range parseAttrs(msg.Data[sizeofNdMsg:]) {
+			switch attr.Attr.Type {
+			case ndaDst:
+				neigh.IP = net.IP(attr.Value)
+			case ndaLLAddr:
+				neigh.HardwareAddr = net.HardwareAddr(attr.Value)
+			}
+		}
+		if neigh.IP.Equal(ip) {
+			return &neigh, nil
+		}
+	}
+	return nil, fmt.Errorf("no neighbour entry for %s", ip)
+}
@@ -0,0 +1,136 @@
+package netutils
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// Nested link attributes missing in syscall package
+	iflaInfoKind = 1
+	iflaInfoData = 2
+	iflaVRFTable = 1
+	iflaPropList = 52
+	iflaAltName  = 53
+	nlaTypeMask  = 0x3fff
+)
+
+var netlinkSeq uint32
+
+// netlinkRequest sends single request to the route netlink socket and returns response messages
+func netlinkRequest(msgType uint16, flags uint16, body []byte) ([]syscall.NetlinkMessage, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, fmt.Errorf("can not open netlink socket: %w", err)
+	}
+	defer syscall.Close(fd)
+	err = syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK})
+	if err != nil {
+		return nil, fmt.Errorf("can not bind netlink socket: %w", err)
+	}
+
+	seq := atomic.AddUint32(&netlinkSeq, 1)
+	request := make([]byte, syscall.SizeofNlMsghdr, syscall.SizeofNlMsghdr+len(body))
+	request = append(request, body...)
+	header := (*syscall.NlMsghdr)(unsafe.Pointer(&request[0]))
+	header.Len = uint32(len(request))
+	header.Type = msgType
+	header.Flags = syscall.NLM_F_REQUEST | flags
+	header.Seq = seq
+	err = syscall.Sendto(fd, request, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK})
+	if err != nil {
+		return nil, fmt.Errorf("netlink request failed: %w", err)
+	}
+
+	var response []syscall.NetlinkMessage
+	buffer := make([]byte, syscall.Getpagesize()*4)
+	for {
+		n, _, err := syscall.Recvfrom(fd, buffer, 0)
+		if err != nil {
+			return nil, fmt.Errorf("netlink response read failed: %w", err)
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buffer[:n])
+		if err != nil {
+			return nil, fmt.Errorf("netlink response parse failed: %w", err)
+		}
+		for _, msg := range msgs {
+			if msg.Header.Seq != seq {
+				continue
+			}
+			switch msg.Header.Type {
+			case syscall.NLMSG_DONE:
+				return response, nil
+			case syscall.NLMSG_ERROR:
+				if len(msg.Data) < 4 {
+					return nil, fmt.Errorf("netlink error message too short")
+				}
+				errno := -int32(binary.LittleEndian.Uint32(msg.Data[0:4]))
+				if errno != 0 {
+					return nil, syscall.Errno(errno)
+				}
+				return response, nil
+			}
+			response = append(response, msg)
+			if msg.Header.Flags&syscall.NLM_F_MULTI == 0 {
+				return response, nil
+			}
+		}
+	}
+}
+
+// appendAttr appends netlink attribute with padding to the request body
+func appendAttr(b []byte, attrType uint16, value []byte) []byte {
+	length := syscall.SizeofRtAttr + len(value)
+	attr := make([]byte, (length+syscall.RTA_ALIGNTO-1) & ^(syscall.RTA_ALIGNTO-1))
+	binary.LittleEndian.PutUint16(attr[0:2], uint16(length))
+	binary.LittleEndian.PutUint16(attr[2:4], attrType)
+	copy(attr[syscall.SizeofRtAttr:], value)
+	return append(b, attr...)
+}
+
+func uint32Value(value uint32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, value)
+	return b
+}
+
+// parseAttrs parses netlink attributes, used for nested attributes which syscall package does not handle
+func parseAttrs(b []byte) []syscall.NetlinkRouteAttr {
+	var attrs []syscall.NetlinkRouteAttr
+	for len(b) >= syscall.SizeofRtAttr {
+		length := int(binary.LittleEndian.Uint16(b[0:2]))
+		attrType := binary.LittleEndian.Uint16(b[2:4])
+		if length < syscall.SizeofRtAttr || length > len(b) {
+			break
+		}
+		attrs = append(attrs, syscall.NetlinkRouteAttr{
+			Attr:  syscall.RtAttr{Len: uint16(length), Type: attrType & nlaTypeMask},
+			Value: b[syscall.SizeofRtAttr:length],
+		})
+		aligned := (length + syscall.NLMSG_ALIGNTO - 1) & ^(syscall.NLMSG_ALIGNTO - 1)
+		if aligned > len(b) {
+			break
+		}
+		b = b[aligned:]
+	}
+	return attrs
+}
+
+func attrString(value []byte) string {
+	for i, c := range value {
+		if c == 0 {
+			return string(value[:i])
+		}
+	}
+	return string(value)
+}
+
+func attrUint32(value []byte) uint32 {
+	if len(value) < 4 {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(value)
+}
@@ -0,0 +1,61 @@
+package netutils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	netNSRunDir = "/var/run/netns"
+	// netNSEnv marks the re-executed process which already runs inside the requested namespace
+	netNSEnv = "TESTCMD_NETNS"
+)
+
+// NetNSPath converts namespace name, path or process pid to the namespace file path
+func NetNSPath(netNS string) string {
+	if strings.Contains(netNS, "/") {
+		return netNS
+	}
+	if _, err := strconv.Atoi(netNS); err == nil {
+		return fmt.Sprintf("/proc/%s/ns/net", netNS)
+	}
+	return filepath.Join(netNSRunDir, netNS)
+}
+
+// EnterNetNS switches the process into the network namespace given by name, path or pid.
+// setns(2) only affects the calling thread, while Go runs goroutines on many threads and never
+// clones new ones from a locked thread. Therefore the locked thread is switched first and then
+// re-executes the binary, so every thread of the new process starts inside the namespace
+// before any interface is resolved or socket is opened.
+func EnterNetNS(netNS string) error {
+	if netNS == "" || os.Getenv(netNSEnv) == netNS {
+		return nil
+	}
+	nsFile, err := os.Open(NetNSPath(netNS))
+	if err != nil {
+		return fmt.Errorf("can not open network namespace %s: %w", netNS, err)
+	}
+	defer nsFile.Close()
+
+	runtime.LockOSThread()
+	err = unix.Setns(int(nsFile.Fd()), unix.CLONE_NEWNET)
+	if errors.Is(err, syscall.EPERM) {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("switching to network namespace %s requested but not permitted, CAP_SYS_ADMIN is required: %w", netNS, err)
+	}
+	if err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("can not switch to network namespace %s: %w", netNS, err)
+	}
+	err = syscall.Exec("/proc/self/exe", os.Args, append(os.Environ(), fmt.Sprintf("%s=%s", netNSEnv, netNS)))
+	// Exec returns only on failure, the thread stays in the target namespace and must not be reused
+	return fmt.Errorf("can not restart in network namespace %s: %w", netNS, err)
+}
@@ -0,0 +1,134 @@
+package netutils
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// NetworkStatusAnnotation is the pod annotation Multus reports attached networks in
+	NetworkStatusAnnotation = "k8s.v1.cni.cncf.io/network-status"
+	// DefaultAnnotationsFile is the usual mount path of the downward API pod annotations file
+	DefaultAnnotationsFile = "/etc/podinfo/annotations"
+)
+
+// NetworkStatus is the network attachment entry of the network-status annotation
+type NetworkStatus struct {
+	Name       string      `json:"name"`
+	Interface  string      `json:"interface"`
+	IPs        []string    `json:"ips"`
+	Mac        string      `json:"mac"`
+	Default    bool        `json:"default"`
+	DeviceInfo *DeviceInfo `json:"device-info"`
+}
+
+// DeviceInfo describes the device backing the attachment, e.g. SR-IOV virtual function
+type DeviceInfo struct {
+	Type    string   `json:"type"`
+	Version string   `json:"version"`
+	PCI     *PCIInfo `json:"pci"`
+}
+
+// PCIInfo keeps the PCI addresses of the device
+type PCIInfo struct {
+	PCIAddress   string `json:"pci-address"`
+	PFPCIAddress string `json:"pf-pci-address"`
+	RdmaDevice   string `json:"rdma-device"`
+}
+
+func (status *NetworkStatus) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s interface %s", status.Name, status.Interface)
+	if len(status.IPs) > 0 {
+		fmt.Fprintf(&b, " ips %s", strings.Join(status.IPs, ","))
+	}
+	if status.Mac != "" {
+		fmt.Fprintf(&b, " mac %s", status.Mac)
+	}
+	if status.DeviceInfo != nil {
+		fmt.Fprintf(&b, " device %s", status.DeviceInfo.Type)
+		if status.DeviceInfo.PCI != nil && status.DeviceInfo.PCI.PCIAddress != "" {
+			fmt.Fprintf(&b, " pci %s", status.DeviceInfo.PCI.PCIAddress)
+		}
+	}
+	return b.String()
+}
+
+// SourceIP returns the first attachment address of the protocol version or empty string
+func (status *NetworkStatus) SourceIP(protocolVersion int) string {
+	for _, addr := range status.IPs {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			continue
+		}
+		if (ip.To4() != nil) == (protocolVersion == 4) {
+			return ip.String()
+		}
+	}
+	return ""
+}
+
+// ReadAnnotations parses downward API annotations file, one key="quoted value" per line
+func ReadAnnotations(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	annotations := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		key, value, found := strings.Cut(scanner.Text(), "=")
+		if !found {
+			continue
+		}
+		unquoted, err := strconv.Unquote(value)
+		if err != nil {
+			return nil, fmt.Errorf("can not parse annotation %s in %s: %w", key, path, err)
+		}
+		annotations[key] = unquoted
+	}
+	return annotations, scanner.Err()
+}
+
+// NetworkStatusByName returns the attachment of the network namespace/name from the annotations file.
+// The network given without namespace matches the attachment name in any namespace
+func NetworkStatusByName(path string, network string) (*NetworkStatus, error) {
+	annotations, err := ReadAnnotations(path)
+	if err != nil {
+		return nil, err
+	}
+	value, ok := annotations[NetworkStatusAnnotation]
+	if !ok {
+		return nil, fmt.Errorf("annotation %s not found in %s", NetworkStatusAnnotation, path)
+	}
+	var statuses []NetworkStatus
+	err = json.Unmarshal([]byte(value), &statuses)
+	if err != nil {
+		return nil, fmt.Errorf("can not parse annotation %s: %w", NetworkStatusAnnotation, err)
+	}
+	var found *NetworkStatus
+	for i := range statuses {
+		name := statuses[i].Name
+		if name != network && (strings.Contains(network, "/") || name[strings.LastIndex(name, "/")+1:] != network) {
+			continue
+		}
+		if found != nil {
+			return nil, fmt.Errorf("network %s is ambiguous: %s and %s", network, found.Name, name)
+		}
+		found = &statuses[i]
+	}
+	if found == nil {
+		return nil, fmt.Errorf("network %s not found in annotation %s", network, NetworkStatusAnnotation)
+	}
+	if found.Interface == "" {
+		return nil, fmt.Errorf("network %s has no interface in annotation %s", network, NetworkStatusAnnotation)
+	}
+	return found, nil
+}
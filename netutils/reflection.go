@@ -0,0 +1,176 @@
+package netutils
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	reflectionPrefix = "testcmd-reflect"
+	// ReflectionMaxSize is the buffer size large enough for any reflection message
+	ReflectionMaxSize = 512
+)
+
+// Reflection is the client address observed by the server together with the local address and
+// interface the packet arrived on. Comparing it with the client address reveals SNAT or egress IP.
+// Identity names the server behind load balancer, e.g. pod or node name
+type Reflection struct {
+	Source      string
+	Destination string
+	Interface   string
+	Identity    string
+}
+
+// NewReflection returns the reflection of the observed addresses, interface is looked up by the
+// destination address unless known
+func NewReflection(source net.Addr, destination net.Addr, interfaceName string) *Reflection {
+	reflection := &Reflection{Source: addrString(source), Destination: addrString(destination), Interface: interfaceName}
+	if reflection.Interface == "" && destination != nil {
+		host, _, err := net.SplitHostPort(reflection.Destination)
+		if err == nil {
+			reflection.Interface = AddressInterface(ParseIP(host))
+		}
+	}
+	return reflection
+}
+
+// Marshal returns the reflection message sent by the server instead of the echo
+func (reflection *Reflection) Marshal() []byte {
+	return []byte(fmt.Sprintf("%s source=%s destination=%s interface=%s identity=%s\n",
+		reflectionPrefix, reflection.Source, reflection.Destination, reflection.Interface,
+		url.QueryEscape(reflection.Identity)))
+}
+
+// IsReflection reports the reflection message, clients accept it from reflecting servers instead of the echo
+func IsReflection(data []byte) bool {
+	return strings.HasPrefix(string(data), reflectionPrefix+" ")
+}
+
+// ParseReflection parses the reflection message, the message is expected as the first line of data
+func ParseReflection(data []byte) (*Reflection, error) {
+	line, _, _ := strings.Cut(string(data), "\n")
+	fields := strings.Fields(line)
+	if len(fields) == 0 || fields[0] != reflectionPrefix {
+		return nil, fmt.Errorf("server did not reflect the observed address, is it started with -reflect or -identity?")
+	}
+	reflection := &Reflection{}
+	for _, field := range fields[1:] {
+		key, value, _ := strings.Cut(field, "=")
+		switch key {
+		case "source":
+			reflection.Source = value
+		case "destination":
+			reflection.Destination = value
+		case "interface":
+			reflection.Interface = value
+		case "identity":
+			identity, err := url.QueryUnescape(value)
+			if err != nil {
+				return nil, fmt.Errorf("reflection %q has malformed identity: %w", line, err)
+			}
+			reflection.Identity = identity
+		}
+	}
+	if reflection.SourceIP() == nil {
+		return nil, fmt.Errorf("reflection %q has no source address", line)
+	}
+	return reflection, nil
+}
+
+// SourceIP returns the observed client address
+func (reflection *Reflection) SourceIP() net.IP {
+	host, _, err := net.SplitHostPort(reflection.Source)
+	if err != nil {
+		host = reflection.Source
+	}
+	return ParseIP(host)
+}
+
+// String returns the reflection in the notation of the test output
+func (reflection *Reflection) String() string {
+	description := fmt.Sprintf("source %s destination %s", reflection.Source, reflection.Destination)
+	if reflection.Interface != "" {
+		description += fmt.Sprintf(" interface %s", reflection.Interface)
+	}
+	if reflection.Identity != "" {
+		description += fmt.Sprintf(" identity %s", reflection.Identity)
+	}
+	return description
+}
+
+// AddressInterface returns the name of the interface the address is configured on, empty if unknown
+func AddressInterface(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	addrs, err := Addrs(0)
+	if err != nil {
+		return ""
+	}
+	for _, addr := range addrs {
+		if addr.IP.Equal(ip) {
+			intFace, err := net.InterfaceByIndex(addr.InterfaceIndex)
+			if err != nil {
+				return ""
+			}
+			return intFace.Name
+		}
+	}
+	return ""
+}
+
+// EnablePacketInfo makes the kernel pass the local address and interface of received datagrams,
+// dual-stack socket receives the information of both families
+func EnablePacketInfo(fd int) error {
+	errV6 := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_RECVPKTINFO, 1)
+	errV4 := syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_PKTINFO, 1)
+	if errV4 != nil && errV6 != nil {
+		return fmt.Errorf("enabling packet info failed: %w", errV4)
+	}
+	return nil
+}
+
+// ParsePacketInfo returns the local address and interface index from the control messages of the datagram
+func ParsePacketInfo(oob []byte) (net.IP, int) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, 0
+	}
+	for _, msg := range msgs {
+		switch {
+		case msg.Header.Level == syscall.IPPROTO_IP && msg.Header.Type == syscall.IP_PKTINFO &&
+			len(msg.Data) >= syscall.SizeofInet4Pktinfo:
+			info := (*syscall.Inet4Pktinfo)(unsafe.Pointer(&msg.Data[0]))
+			return net.IP(info.Addr[:]).To16(), int(info.Ifindex)
+		case msg.Header.Level == syscall.IPPROTO_IPV6 && msg.Header.Type == syscall.IPV6_PKTINFO &&
+			len(msg.Data) >= syscall.SizeofInet6Pktinfo:
+			info := (*syscall.Inet6Pktinfo)(unsafe.Pointer(&msg.Data[0]))
+			return net.IP(info.Addr[:]), int(info.Ifindex)
+		}
+	}
+	return nil, 0
+}
+
+// addrString returns host:port of the address with IPv4-mapped IPv6 address unmapped
+func addrString(addr net.Addr) string {
+	switch addr := addr.(type) {
+	case nil:
+		return ""
+	case *net.UDPAddr:
+		return net.JoinHostPort(zonedIP(addr.IP, addr.Zone), fmt.Sprint(addr.Port))
+	case *net.TCPAddr:
+		return net.JoinHostPort(zonedIP(addr.IP, addr.Zone), fmt.Sprint(addr.Port))
+	}
+	return addr.String()
+}
+
+func zonedIP(ip net.IP, zone string) string {
+	if zone == "" {
+		return ip.String()
+	}
+	return ip.String() + "%" + zone
+}
@@ -0,0 +1,68 @@
+package netutils
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	// FamilyIPv4 resolves A records only
+	FamilyIPv4 = "4"
+	// FamilyIPv6 resolves AAAA records only
+	FamilyIPv6 = "6"
+	// FamilyAny resolves both A and AAAA records
+	FamilyAny = "any"
+	// FamilyDual resolves both A and AAAA records and requires both families
+	FamilyDual = "dual"
+
+	resolveTimeout = 10 * time.Second
+)
+
+// Resolution keeps addresses the host resolved to and the resolution time
+type Resolution struct {
+	Host      string
+	Addresses []net.IP
+	Duration  time.Duration
+}
+
+func (resolution *Resolution) String() string {
+	addresses := make([]string, 0, len(resolution.Addresses))
+	for _, ip := range resolution.Addresses {
+		addresses = append(addresses, ip.String())
+	}
+	return fmt.Sprintf("%s resolved to %s in %s",
+		resolution.Host, strings.Join(addresses, ","), resolution.Duration.Round(time.Microsecond))
+}
+
+// ResolveHost resolves literal address or hostname, including Kubernetes service names completed by
+// resolv.conf search domains, to addresses of the family in the resolver preference order
+func ResolveHost(host string, family string) (*Resolution, error) {
+	network := "ip"
+	switch family {
+	case FamilyIPv4:
+		network = "ip4"
+	case FamilyIPv6:
+		network = "ip6"
+	case FamilyAny, FamilyDual:
+	default:
+		return nil, fmt.Errorf("unsupported address family %s", family)
+	}
+	if host == "" {
+		return nil, fmt.Errorf("server is not set")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	start := time.Now()
+	addresses, err := net.DefaultResolver.LookupIP(ctx, network, host)
+	resolution := &Resolution{Host: host, Addresses: addresses, Duration: time.Since(start)}
+	if err != nil {
+		return resolution, fmt.Errorf("can not resolve %s with family %s: %w", host, family, err)
+	}
+	if len(addresses) == 0 {
+		return resolution, fmt.Errorf("%s has no address of family %s", host, family)
+	}
+	return resolution, nil
+}
@@ -0,0 +1,171 @@
+package netutils
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	rtaMark         = 16
+	rtmFLookupTable = 0x1000
+)
+
+// Route keeps result of the kernel route lookup, the equivalent of ip route get
+type Route struct {
+	Destination string
+	Source      string
+	Gateway     string
+	Interface   string
+	Table       uint32
+	Mark        int
+	MTU         int
+	Type        string
+	// Unreachable keeps the lookup error, e.g. network is unreachable or prohibited by policy
+	Unreachable string
+}
+
+// String returns route in ip route get notation
+func (route *Route) String() string {
+	if route.Unreachable != "" {
+		return fmt.Sprintf("%s %s", route.Destination, route.Unreachable)
+	}
+	fields := []string{route.Destination}
+	if route.Type != "" && route.Type != "unicast" {
+		fields = []string{route.Type, route.Destination}
+	}
+	if route.Gateway != "" {
+		fields = append(fields, "via", route.Gateway)
+	}
+	if route.Interface != "" {
+		fields = append(fields, "dev", route.Interface)
+	}
+	if route.Table != 0 {
+		fields = append(fields, "table", fmt.Sprint(route.Table))
+	}
+	if route.Source != "" {
+		fields = append(fields, "src", route.Source)
+	}
+	if route.Mark != 0 {
+		fields = append(fields, "mark", fmt.Sprintf("0x%x", route.Mark))
+	}
+	if route.MTU != 0 {
+		fields = append(fields, "mtu", fmt.Sprint(route.MTU))
+	}
+	return strings.Join(fields, " ")
+}
+
+var routeTypes = map[uint8]string{
+	syscall.RTN_UNICAST:     "unicast",
+	syscall.RTN_LOCAL:       "local",
+	syscall.RTN_BROADCAST:   "broadcast",
+	syscall.RTN_MULTICAST:   "multicast",
+	syscall.RTN_BLACKHOLE:   "blackhole",
+	syscall.RTN_UNREACHABLE: "unreachable",
+	syscall.RTN_PROHIBIT:    "prohibit",
+}
+
+// RouteGet asks the kernel which route the traffic to dst takes for the given source,
+// firewall mark and outgoing interface index. Zero values are not included in the lookup.
+func RouteGet(dst net.IP, src net.IP, mark int, oif int) (*Route, error) {
+	family := syscall.AF_INET
+	addrLen := net.IPv4len
+	if dst.To4() == nil {
+		family = syscall.AF_INET6
+		addrLen = net.IPv6len
+	}
+	body := make([]byte, syscall.SizeofRtMsg)
+	rtMsg := (*syscall.RtMsg)(unsafe.Pointer(&body[0]))
+	rtMsg.Family = uint8(family)
+	rtMsg.Dst_len = uint8(addrLen * 8)
+	rtMsg.Flags = rtmFLookupTable
+	body = appendAttr(body, syscall.RTA_DST, ipBytes(dst, family))
+	if src != nil && !src.IsUnspecified() {
+		rtMsg = (*syscall.RtMsg)(unsafe.Pointer(&body[0]))
+		rtMsg.Src_len = uint8(addrLen * 8)
+		body = appendAttr(body, syscall.RTA_SRC, ipBytes(src, family))
+	}
+	if mark != 0 {
+		body = appendAttr(body, rtaMark, uint32Value(uint32(mark)))
+	}
+	if oif != 0 {
+		body = appendAttr(body, syscall.RTA_OIF, uint32Value(uint32(oif)))
+	}
+
+	route := &Route{Destination: dst.String(), Mark: mark}
+	msgs, err := netlinkRequest(syscall.RTM_GETROUTE, 0, body)
+	if err != nil {
+		var errno syscall.Errno
+		if errors.As(err, &errno) {
+			// the lookup itself worked, the kernel has no usable route
+			route.Unreachable = errno.Error()
+			return route, nil
+		}
+		return nil, err
+	}
+	for i := range msgs {
+		if msgs[i].Header.Type != syscall.RTM_NEWROUTE || len(msgs[i].Data) < syscall.SizeofRtMsg {
+			continue
+		}
+		reply := (*syscall.RtMsg)(unsafe.Pointer(&msgs[i].Data[0]))
+		route.Type = routeTypes[reply.Type]
+		route.Table = uint32(reply.Table)
+		attrs, err := syscall.ParseNetlinkRouteAttr(&msgs[i])
+		if err != nil {
+			return nil, fmt.Errorf("netlink route attributes parse failed: %w", err)
+		}
+		for _, attr := range attrs {
+			switch attr.Attr.Type & nlaTypeMask {
+			case syscall.RTA_GATEWAY:
+				route.Gateway = net.IP(attr.Value).String()
+			case syscall.RTA_PREFSRC:
+				route.Source = net.IP(attr.Value).String()
+			case syscall.RTA_OIF:
+				if link, err := LinkByIndex(int(attrUint32(attr.Value))); err == nil {
+					route.Interface = link.Name
+				}
+			case syscall.RTA_TABLE:
+				route.Table = attrUint32(attr.Value)
+			case syscall.RTA_METRICS:
+				for _, metric := range parseAttrs(attr.Value) {
+					if metric.Attr.Type == syscall.RTAX_MTU {
+						route.MTU = int(attrUint32(metric.Value))
+					}
+				}
+			}
+		}
+		return route, nil
+	}
+	return nil, fmt.Errorf("netlink route lookup for %s returned no route", dst)
+}
+
+func ipBytes(ip net.IP, family int) []byte {
+	if family == syscall.AF_INET {
+		return ip.To4()
+	}
+	return ip.To16()
+}
+
+// PathMTU returns the MTU limiting the traffic to dst: the smaller of the egress device MTU and the route MTU,
+// which includes MTU learned by path MTU discovery
+func PathMTU(dst net.IP, src net.IP, mark int, oif int) (int, *Route, error) {
+	route, err := RouteGet(dst, src, mark, oif)
+	if err != nil {
+		return 0, nil, err
+	}
+	if route.Unreachable != "" {
+		return 0, route, fmt.Errorf("no route to %s: %s", dst, route.Unreachable)
+	}
+	link, err := LinkByName(route.Interface)
+	if err != nil {
+		return 0, route, err
+	}
+	mtu := link.MTU
+	if route.MTU != 0 && route.MTU < mtu {
+		mtu = route.MTU
+	}
+	return mtu, route, nil
+}
@@ -0,0 +1,76 @@
+package netutils
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+const waitPollInterval = 500 * time.Millisecond
+
+// interfaceReady reports why the interface is not ready: missing, link down, no usable address
+// of the family (0 means any) or the address is still tentative during IPv6 duplicate address detection.
+// IPv6 link-local address does not count unless the peer is link-local, it is assigned long before the global one
+func interfaceReady(interfaceName string, protocolVersion int, linkLocal bool, sourceIP net.IP) error {
+	intFace, err := ResolveInterface(interfaceName)
+	if err != nil {
+		return err
+	}
+	link, err := LinkByIndex(intFace.Index)
+	if err != nil {
+		return err
+	}
+	if link.OperState != "up" && link.OperState != "unknown" {
+		return fmt.Errorf("link %s is %s", link.Name, link.OperState)
+	}
+	addrs, err := Addrs(link.Index)
+	if err != nil {
+		return err
+	}
+	for i := range addrs {
+		addr := &addrs[i]
+		isIPv4 := addr.IP.To4() != nil
+		if (protocolVersion == 4 && !isIPv4) || (protocolVersion == 6 && isIPv4) {
+			continue
+		}
+		if sourceIP != nil && !addr.IP.Equal(sourceIP) {
+			continue
+		}
+		if sourceIP == nil && !linkLocal && !isIPv4 && addr.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if addr.Tentative() || addr.DADFailed() {
+			err = fmt.Errorf("address %s on %s is not ready", addr, link.Name)
+			continue
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if sourceIP != nil {
+		return fmt.Errorf("address %s is not assigned to %s", sourceIP, link.Name)
+	}
+	return fmt.Errorf("no address assigned to %s", link.Name)
+}
+
+// WaitInterface polls netlink until the interface exists, its link is up and an address of the family
+// (0 means any) or the given source address is assigned and completed IPv6 duplicate address detection.
+// IPv6 link-local address is enough only when linkLocal is set for the link-local peer
+func WaitInterface(interfaceName string, protocolVersion int, linkLocal bool, sourceIP net.IP,
+	timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	start := time.Now()
+	for {
+		err := interfaceReady(interfaceName, protocolVersion, linkLocal, sourceIP)
+		if err == nil {
+			log.Printf("Interface %s is ready after %s", interfaceName, time.Since(start).Round(time.Millisecond))
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("interface %s is not ready within %s: %w", interfaceName, timeout, err)
+		}
+		time.Sleep(waitPollInterval)
+	}
+}
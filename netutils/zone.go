@@ -0,0 +1,50 @@
+package netutils
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// SplitZone splits the IPv6 zone from the address, e.g. fe80::1%net1 returns fe80::1 and net1
+func SplitZone(address string) (string, string) {
+	if i := strings.LastIndex(address, "%"); i >= 0 {
+		return address[:i], address[i+1:]
+	}
+	return address, ""
+}
+
+// ParseIP parses the address with optional IPv6 zone, the zone is dropped
+func ParseIP(address string) net.IP {
+	host, _ := SplitZone(address)
+	return net.ParseIP(host)
+}
+
+// NeedsZone reports whether the address is only meaningful together with the interface
+func NeedsZone(ip net.IP) bool {
+	return ip.To4() == nil && (ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast())
+}
+
+// ScopedIPAddr parses the address with optional zone. Link-local address without zone is scoped
+// to the interface, the zone may be interface name or index
+func ScopedIPAddr(address string, interfaceName string) (*net.IPAddr, error) {
+	host, zone := SplitZone(address)
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid ip address %s", address)
+	}
+	if !NeedsZone(ip) {
+		return &net.IPAddr{IP: ip}, nil
+	}
+	if zone == "" {
+		zone = interfaceName
+	}
+	if zone == "" {
+		return nil, fmt.Errorf("link-local address %s requires zone or interface", address)
+	}
+	intFace, err := ResolveInterface(zone)
+	if err != nil {
+		return nil, err
+	}
+	return &net.IPAddr{IP: ip, Zone: intFace.Name}, nil
+}
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/kononovn/testcmd/netutils"
+	"github.com/kononovn/testcmd/protocols"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	planCommand = "plan"
+
+	outputText = "text"
+	outputJSON = "json"
+)
+
+// plan is a suite of client tests read from YAML or JSON file
+type plan struct {
+	Concurrency int        `yaml:"concurrency"`
+	Tests       []planTest `yaml:"tests"`
+}
+
+// planTest is a named client test, keys follow the command line flags
+type planTest struct {
+	Name                  string         `yaml:"name"`
+	Protocol              string         `yaml:"protocol"`
+	Server                string         `yaml:"server"`
+	Family                string         `yaml:"family"`
+	AllAddresses          bool           `yaml:"all-addresses"`
+	Port                  int            `yaml:"port"`
+	Packages              int            `yaml:"packages"`
+	MTU                   string         `yaml:"mtu"`
+	MTUStrict             bool           `yaml:"mtu-strict"`
+	Negative              bool           `yaml:"negative"`
+	Timeout               int            `yaml:"timeout"`
+	Interface             string         `yaml:"interface"`
+	VRF                   string         `yaml:"vrf"`
+	Source                string         `yaml:"source"`
+	SourcePort            int            `yaml:"source-port"`
+	Multicast             bool           `yaml:"multicast"`
+	Broadcast             bool           `yaml:"broadcast"`
+	Directed              bool           `yaml:"directed"`
+	Mark                  int            `yaml:"mark"`
+	ExpectEgressInterface string         `yaml:"expect-egress-interface"`
+	ExpectGateway         string         `yaml:"expect-gateway"`
+	Reflect               bool           `yaml:"reflect"`
+	ExpectSourceIP        string         `yaml:"expect-source-ip"`
+	Tally                 bool           `yaml:"tally"`
+	ExpectAffinity        bool           `yaml:"expect-affinity"`
+	ExpectBackends        int            `yaml:"expect-backends"`
+	Flows                 int            `yaml:"flows"`
+	SourcePortRange       string         `yaml:"source-port-range"`
+	FlowSources           []string       `yaml:"flow-sources"`
+	Trace                 bool           `yaml:"trace"`
+	MaxHops               int            `yaml:"max-hops"`
+	Diagnostics           bool           `yaml:"diagnostics"`
+	WaitPeer              time.Duration  `yaml:"wait-peer"`
+	Thresholds            planThresholds `yaml:"thresholds"`
+}
+
+// planThresholds relax or tighten the pass criteria of positive test. Packet loss up to max-loss percent
+// is tolerated, the round trip times of received packets must not exceed the limits
+type planThresholds struct {
+	MaxLoss   *int          `yaml:"max-loss"`
+	MaxAvgRTT time.Duration `yaml:"max-avg-rtt"`
+	MaxRTT    time.Duration `yaml:"max-rtt"`
+}
+
+// planReport is the aggregated result of the plan
+type planReport struct {
+	Passed   int              `json:"passed"`
+	Failed   int              `json:"failed"`
+	Duration string           `json:"duration"`
+	Tests    []planTestReport `json:"tests"`
+}
+
+type planTestReport struct {
+	Name     string              `json:"name"`
+	Agent    string              `json:"agent,omitempty"`
+	Protocol string              `json:"protocol"`
+	Server   string              `json:"server"`
+	Negative bool                `json:"negative"`
+	Passed   bool                `json:"passed"`
+	Duration string              `json:"duration"`
+	Error    string              `json:"error,omitempty"`
+	Results  []planAddressReport `json:"results,omitempty"`
+}
+
+type planAddressReport struct {
+	Address     string `json:"address"`
+	Passed      bool   `json:"passed"`
+	Transmitted int    `json:"transmitted"`
+	Received    int    `json:"received"`
+	Loss        int    `json:"loss"`
+	AvgRTT      string `json:"avgRtt"`
+	MaxRTT      string `json:"maxRtt"`
+	// Inconclusive is set when the test could not run, the local socket setup or the route verification
+	// failed, so the connectivity was not observed
+	Inconclusive bool `json:"inconclusive,omitempty"`
+	// Observed addresses are the client address and local address reflected by the server
+	ObservedSource      string `json:"observedSource,omitempty"`
+	ObservedDestination string `json:"observedDestination,omitempty"`
+	ObservedInterface   string `json:"observedInterface,omitempty"`
+	ServerIdentity      string `json:"serverIdentity,omitempty"`
+	// Backends counts the replies per server identity in tally mode
+	Backends map[string]int   `json:"backends,omitempty"`
+	Flows    []planFlowReport `json:"flows,omitempty"`
+	Trace    []planHopReport  `json:"trace,omitempty"`
+	Error    string           `json:"error,omitempty"`
+}
+
+// planFlowReport is the outcome of single flow in multi-flow mode
+type planFlowReport struct {
+	Source      string `json:"source"`
+	Transmitted int    `json:"transmitted"`
+	Received    int    `json:"received"`
+	BlackHoled  bool   `json:"blackHoled,omitempty"`
+	Failed      bool   `json:"failed,omitempty"`
+	Backend     string `json:"backend,omitempty"`
+	Interface   string `json:"interface,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// planHopReport is single hop of the trace mode, probe without address got no reply
+type planHopReport struct {
+	TTL    int               `json:"ttl"`
+	Probes []planProbeReport `json:"probes"`
+}
+
+type planProbeReport struct {
+	Address string   `json:"address,omitempty"`
+	RTT     string   `json:"rtt,omitempty"`
+	Reply   string   `json:"reply,omitempty"`
+	MTU     int      `json:"mtu,omitempty"`
+	MPLS    []string `json:"mpls,omitempty"`
+}
+
+// runPlan runs the plan command and returns the exit code
+func runPlan(args []string) int {
+	flags := flag.NewFlagSet(planCommand, flag.ExitOnError)
+	file := flags.String("file", "", "YAML or JSON file with the tests")
+	concurrency := flags.Int("concurrency", 0, "Number of tests run in parallel. Options: Any int in range 1-64 (default from the file or 1)")
+	output := flags.String("output", outputText, "Report format. Options: text/json")
+	flags.Parse(args)
+
+	testPlan, err := readPlan(*file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	if *concurrency != 0 {
+		testPlan.Concurrency = *concurrency
+	}
+	if testPlan.Concurrency == 0 {
+		testPlan.Concurrency = 1
+	}
+	err = validateIntInRange(testPlan.Concurrency, 1, 64)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: unsupported parameter concurrency %v\n", err)
+		return 1
+	}
+	if *output != outputText && *output != outputJSON {
+		fmt.Fprintf(os.Stderr, "error: unsupported parameter output=%s\n", *output)
+		return 1
+	}
+
+	stdout := redirectTestOutput()
+	report := testPlan.run()
+	if *output == outputJSON {
+		err = report.writeJSON(stdout)
+	} else {
+		err = report.writeText(stdout)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	if report.Failed != 0 {
+		return 1
+	}
+	return 0
+}
+
+// redirectTestOutput sends the output printed by the testers to stderr, so
+// that the report is the only output on stdout, and returns the original stdout
+func redirectTestOutput() *os.File {
+	stdout := os.Stdout
+	os.Stdout = os.Stderr
+	return stdout
+}
+
+// readPlan reads the plan
+func readPlan(file string) (*plan, error) {
+	if file == "" {
+		return nil, fmt.Errorf("plan file is required")
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	testPlan := &plan{}
+	err = decodeStrict(data, testPlan)
+	if err != nil {
+		return nil, fmt.Errorf("can not parse plan %s: %w", file, err)
+	}
+	if len(testPlan.Tests) == 0 {
+		return nil, fmt.Errorf("plan %s has no tests", file)
+	}
+	names := map[string]bool{}
+	for i := range testPlan.Tests {
+		test := &testPlan.Tests[i]
+		if test.Name == "" {
+			test.Name = fmt.Sprintf("test-%d", i+1)
+		}
+		if names[test.Name] {
+			return nil, fmt.Errorf("plan %s has duplicate test name %s", file, test.Name)
+		}
+		names[test.Name] = true
+	}
+	return testPlan, nil
+}
+
+// decodeStrict decodes YAML or JSON document, JSON is parsed as YAML subset, unknown keys are rejected
+func decodeStrict(data []byte, out interface{}) error {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	err := decoder.Decode(out)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// run runs the tests with bounded concurrency, the report keeps the order of the plan
+func (testPlan *plan) run() *planReport {
+	return runTests(testPlan.Concurrency, testPlan.Tests, func(i int) planTestReport {
+		return testPlan.Tests[i].run()
+	})
+}
+
+// runTests runs the tests with bounded concurrency by the runner, the report keeps the order of the tests
+func runTests(concurrency int, tests []planTest, runner func(i int) planTestReport) *planReport {
+	start := time.Now()
+	report := &planReport{Tests: make([]planTestReport, len(tests))}
+	semaphore := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i := range tests {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			log.Printf("Plan test %s started", tests[i].Name)
+			report.Tests[i] = runner(i)
+			log.Printf("Plan test %s finished, passed=%t", tests[i].Name, report.Tests[i].Passed)
+		}(i)
+	}
+	wg.Wait()
+	for _, test := range report.Tests {
+		if test.Passed {
+			report.Passed++
+		} else {
+			report.Failed++
+		}
+	}
+	report.Duration = time.Since(start).Round(time.Millisecond).String()
+	return report
+}
+
+// clientTest validates the plan test the way command line flags are validated
+func (test *planTest) clientTest() (*clientTest, error) {
+	err := validateProtocol(test.Protocol)
+	if err != nil {
+		return nil, err
+	}
+	if test.Family == "" {
+		test.Family = netutils.FamilyAny
+	}
+	err = validateFamily(test.Family)
+	if err != nil {
+		return nil, err
+	}
+	if test.MTU == "" {
+		test.MTU = defaultMtu
+	}
+	mtu, err := parseMtu(test.MTU)
+	if err != nil {
+		return nil, err
+	}
+	err = validateSourcePort(test.SourcePort)
+	if err != nil {
+		return nil, err
+	}
+	intFace, err := netutils.ResolveInterface(test.Interface)
+	if err != nil {
+		return nil, err
+	}
+	if intFace != nil {
+		test.Interface = intFace.Name
+	}
+	err = validateVRF(test.VRF, test.Interface)
+	if err != nil {
+		return nil, err
+	}
+	portFirst, portLast, err := parseSourcePortRange(test.SourcePortRange)
+	if err != nil {
+		return nil, err
+	}
+	err = checkCapabilities(false, test.Protocol, test.Mark, netutils.BindDevice(test.Interface, test.VRF), test.Port, test.SourcePort,
+		test.Multicast, test.Broadcast, test.Trace)
+	if err != nil {
+		return nil, err
+	}
+	client := &clientTest{
+		Protocol:     test.Protocol,
+		Server:       test.Server,
+		Family:       test.Family,
+		AllAddresses: test.AllAddresses,
+		Port:         test.Port,
+		Packages:     test.Packages,
+		MTU:          mtu,
+		MTUStrict:    test.MTUStrict,
+		Negative:     test.Negative,
+		TimeoutTCP:   test.Timeout,
+		TimeoutUDP:   test.Timeout,
+		Interface:    test.Interface,
+		VRF:          test.VRF,
+		Source:       test.Source,
+		SourcePort:   test.SourcePort,
+		Multicast:    test.Multicast,
+		Broadcast:    test.Broadcast,
+		Directed:     test.Directed,
+		Routing: protocols.Routing{
+			Mark:                  test.Mark,
+			ExpectEgressInterface: test.ExpectEgressInterface,
+			ExpectGateway:         test.ExpectGateway,
+		},
+		Reflect: protocols.Reflect{Enabled: test.Reflect, ExpectSourceIP: test.ExpectSourceIP, Tally: test.Tally,
+			ExpectAffinity: test.ExpectAffinity, ExpectBackends: test.ExpectBackends},
+		Flows:       protocols.Flows{Count: test.Flows, PortFirst: portFirst, PortLast: portLast, Sources: test.FlowSources},
+		Trace:       test.Trace,
+		MaxHops:     test.MaxHops,
+		Diagnostics: test.Diagnostics,
+		WaitPeer:    test.WaitPeer,
+	}
+	if client.Port == 0 {
+		client.Port = defaultPort
+	}
+	if client.Packages == 0 {
+		client.Packages = defaultPackages
+	}
+	if client.MaxHops == 0 {
+		client.MaxHops = defaultMaxHops
+	}
+	if test.Timeout == 0 {
+		client.TimeoutTCP, client.TimeoutUDP = defaultTimeoutTCP, defaultTimeoutUDP
+	}
+	return client, nil
+}
+
+func (test *planTest) run() (report planTestReport) {
+	report = planTestReport{Name: test.Name, Protocol: test.Protocol, Server: test.Server, Negative: test.Negative}
+	start := time.Now()
+	defer func() { report.Duration = time.Since(start).Round(time.Millisecond).String() }()
+	client, err := test.clientTest()
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	results, _, err := client.runAll()
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	report.Passed = true
+	for _, result := range results {
+		addressReport := test.Thresholds.evaluate(test.Negative, result)
+		if !addressReport.Passed {
+			report.Passed = false
+		}
+		report.Results = append(report.Results, addressReport)
+	}
+	return report
+}
+
+// evaluate applies the thresholds to the result of positive test
+func (thresholds *planThresholds) evaluate(negative bool, result clientResult) planAddressReport {
+	err := result.Err
+	report := planAddressReport{Address: result.Address}
+	report.Inconclusive = result.Result == nil || result.Result.RouteErr != nil || result.Result.SetupErr != nil
+	if result.Result != nil {
+		report.Transmitted = result.Result.Transmitted
+		report.Received = result.Result.Received
+		report.Loss = result.Result.Loss()
+		report.AvgRTT = result.Result.AvgRTT().String()
+		report.MaxRTT = result.Result.MaxRTT().String()
+		if result.Result.Reflection != nil {
+			report.ObservedSource = result.Result.Reflection.Source
+			report.ObservedDestination = result.Result.Reflection.Destination
+			report.ObservedInterface = result.Result.Reflection.Interface
+			report.ServerIdentity = result.Result.Reflection.Identity
+		}
+		report.Backends = result.Result.Backends
+		for _, flow := range result.Result.Flows {
+			flowReport := planFlowReport{Source: flow.Source, Transmitted: flow.Transmitted, Received: flow.Received,
+				BlackHoled: flow.BlackHoled(), Failed: flow.Failed(), Backend: flow.Backend, Interface: flow.Interface}
+			if flow.Err != nil {
+				flowReport.Error = flow.Err.Error()
+			}
+			report.Flows = append(report.Flows, flowReport)
+		}
+		for _, hop := range result.Result.Trace {
+			hopReport := planHopReport{TTL: hop.TTL}
+			for _, probe := range hop.Probes {
+				probeReport := planProbeReport{Address: probe.Address, Reply: probe.Reply, MTU: probe.MTU}
+				if probe.Address != "" {
+					probeReport.RTT = probe.RTT.String()
+				}
+				for _, label := range probe.MPLS {
+					probeReport.MPLS = append(probeReport.MPLS, label.String())
+				}
+				hopReport.Probes = append(hopReport.Probes, probeReport)
+			}
+			report.Trace = append(report.Trace, hopReport)
+		}
+	}
+	if !negative && !report.Inconclusive && result.Result.Transmitted > 0 {
+		switch {
+		case thresholds.MaxLoss != nil && report.Loss > *thresholds.MaxLoss:
+			err = fmt.Errorf("packet loss %d%% exceeds max-loss %d%%", report.Loss, *thresholds.MaxLoss)
+		case thresholds.MaxLoss != nil && report.Received > 0 && errors.Is(err, protocols.ErrPacketLoss):
+			// tolerated loss, the reflection check hidden behind the loss still applies
+			err = result.Result.ReflectionErr
+		}
+		if err == nil && thresholds.MaxAvgRTT > 0 && result.Result.AvgRTT() > thresholds.MaxAvgRTT {
+			err = fmt.Errorf("average rtt %s exceeds max-avg-rtt %s", result.Result.AvgRTT(), thresholds.MaxAvgRTT)
+		}
+		if err == nil && thresholds.MaxRTT > 0 && result.Result.MaxRTT() > thresholds.MaxRTT {
+			err = fmt.Errorf("rtt %s exceeds max-rtt %s", result.Result.MaxRTT(), thresholds.MaxRTT)
+		}
+	}
+	report.Passed = err == nil
+	if err != nil {
+		report.Error = err.Error()
+	}
+	return report
+}
+
+func (report *planReport) writeJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(report)
+}
+
+func (report *planReport) writeText(w io.Writer) error {
+	fmt.Fprintf(w, "--- plan report ---\n")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tPROTOCOL\tADDRESS\tRESULT\tSENT\tRECEIVED\tLOSS\tAVG RTT\tMAX RTT\tERROR")
+	for _, test := range report.Tests {
+		name := test.Name
+		if test.Agent != "" {
+			// tests run by the controller are prefixed by the agent
+			name = test.Agent + "/" + test.Name
+		}
+		if len(test.Results) == 0 {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t-\t-\t-\t-\t-\t%s\n",
+				name, test.Protocol, test.Server, passedString(test.Passed), test.Error)
+			continue
+		}
+		for _, result := range test.Results {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%d\t%d%%\t%s\t%s\t%s\n",
+				name, test.Protocol, result.Address, passedString(result.Passed), result.Transmitted, result.Received,
+				result.Loss, result.AvgRTT, result.MaxRTT, result.Error)
+		}
+	}
+	err := tw.Flush()
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%d passed, %d failed, time %s\n", report.Passed, report.Failed, report.Duration)
+	return err
+}
+
+func passedString(passed bool) string {
+	if passed {
+		return "passed"
+	}
+	return "failed"
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kononovn/testcmd/protocols"
+)
+
+func TestPlanThresholdsEvaluate(t *testing.T) {
+	maxLoss := func(loss int) *int { return &loss }
+	lossErr := fmt.Errorf("2 packets lost: %w", protocols.ErrPacketLoss)
+	reflectionErr := errors.New("observed source 10.10.0.5, expected 10.10.0.1")
+	rtts := []time.Duration{time.Millisecond, 3 * time.Millisecond}
+	tests := []struct {
+		name         string
+		thresholds   planThresholds
+		negative     bool
+		err          error
+		result       *protocols.Result
+		passed       bool
+		inconclusive bool
+		wantError    string
+	}{
+		{name: "no thresholds", result: &protocols.Result{Transmitted: 10, Received: 10}, passed: true},
+		{name: "loss without max-loss", err: lossErr, result: &protocols.Result{Transmitted: 10, Received: 8},
+			wantError: "packet loss"},
+		{name: "loss equal to max-loss", thresholds: planThresholds{MaxLoss: maxLoss(20)}, err: lossErr,
+			result: &protocols.Result{Transmitted: 10, Received: 8}, passed: true},
+		{name: "loss above max-loss", thresholds: planThresholds{MaxLoss: maxLoss(19)}, err: lossErr,
+			result: &protocols.Result{Transmitted: 10, Received: 8}, wantError: "exceeds max-loss 19%"},
+		{name: "zero max-loss", thresholds: planThresholds{MaxLoss: maxLoss(0)}, err: lossErr,
+			result: &protocols.Result{Transmitted: 10, Received: 9}, wantError: "exceeds max-loss 0%"},
+		{name: "total loss within max-loss", thresholds: planThresholds{MaxLoss: maxLoss(100)}, err: lossErr,
+			result: &protocols.Result{Transmitted: 10}, wantError: "packet loss"},
+		{name: "tolerated loss keeps reflection error", thresholds: planThresholds{MaxLoss: maxLoss(50)},
+			err: lossErr, result: &protocols.Result{Transmitted: 10, Received: 8, ReflectionErr: reflectionErr},
+			wantError: reflectionErr.Error()},
+		{name: "failure other than loss", thresholds: planThresholds{MaxLoss: maxLoss(50)},
+			err: errors.New("1 packets mismatched"), result: &protocols.Result{Transmitted: 10, Received: 9},
+			wantError: "mismatched"},
+		{name: "avg rtt equal to max-avg-rtt", thresholds: planThresholds{MaxAvgRTT: 2 * time.Millisecond},
+			result: &protocols.Result{Transmitted: 2, Received: 2, RTTs: rtts}, passed: true},
+		{name: "avg rtt above max-avg-rtt", thresholds: planThresholds{MaxAvgRTT: 2*time.Millisecond - 1},
+			result: &protocols.Result{Transmitted: 2, Received: 2, RTTs: rtts}, wantError: "exceeds max-avg-rtt"},
+		{name: "max rtt equal to max-rtt", thresholds: planThresholds{MaxRTT: 3 * time.Millisecond},
+			result: &protocols.Result{Transmitted: 2, Received: 2, RTTs: rtts}, passed: true},
+		{name: "max rtt above max-rtt", thresholds: planThresholds{MaxRTT: 3*time.Millisecond - 1},
+			result: &protocols.Result{Transmitted: 2, Received: 2, RTTs: rtts}, wantError: "exceeds max-rtt"},
+		{name: "rtt checked after tolerated loss",
+			thresholds: planThresholds{MaxLoss: maxLoss(50), MaxRTT: time.Millisecond}, err: lossErr,
+			result: &protocols.Result{Transmitted: 4, Received: 2, RTTs: rtts}, wantError: "exceeds max-rtt"},
+		{name: "negative ignores thresholds", thresholds: planThresholds{MaxLoss: maxLoss(0)}, negative: true,
+			result: &protocols.Result{Transmitted: 10}, passed: true},
+		{name: "setup error", thresholds: planThresholds{MaxLoss: maxLoss(100)}, err: lossErr,
+			result:       &protocols.Result{Transmitted: 1, SetupErr: errors.New("bind: address not available")},
+			inconclusive: true, wantError: "packet loss"},
+		{name: "route error", err: errors.New("route verification failed"),
+			result: &protocols.Result{RouteErr: errors.New("route verification failed")}, inconclusive: true,
+			wantError: "route verification failed"},
+		{name: "no result", err: errors.New("resolve failed"), inconclusive: true, wantError: "resolve failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report := tt.thresholds.evaluate(tt.negative, clientResult{Address: "10.10.0.2", Err: tt.err, Result: tt.result})
+			if report.Passed != tt.passed {
+				t.Errorf("Passed = %v, want %v, error %q", report.Passed, tt.passed, report.Error)
+			}
+			if report.Inconclusive != tt.inconclusive {
+				t.Errorf("Inconclusive = %v, want %v", report.Inconclusive, tt.inconclusive)
+			}
+			if !strings.Contains(report.Error, tt.wantError) || (tt.wantError == "") != (report.Error == "") {
+				t.Errorf("Error = %q, want %q", report.Error, tt.wantError)
+			}
+		})
+	}
+}
@@ -1,10 +1,45 @@
 package protocols
 
 import (
+	"errors"
 	"fmt"
-	"os/exec"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/kononovn/testcmd/netutils"
 )
 
+const (
+	// GatewayNone is expected gateway of directly connected destinations
+	GatewayNone = "none"
+
+	ipv4HeaderSize = 20
+	ipv6HeaderSize = 40
+	udpHeaderSize  = 8
+	tcpHeaderSize  = 20
+	// sctp common header and data chunk header
+	sctpHeaderSize = 28
+
+	waitPeerInterval = 1 * time.Second
+)
+
+// ErrPacketLoss is the failure caused only by lost packets, the plan tolerates it up to max-loss
+var ErrPacketLoss = errors.New("packet loss")
+
+// Test is connectivity test of any protocol
+type Test interface {
+	// Run runs the test and returns error when the result does not match the expectation
+	Run() error
+	// WaitPeer waits until the server answers or the timeout expires
+	WaitPeer(timeout time.Duration)
+	// Result returns statistics and details of the test run
+	Result() *Result
+}
+
 // CommonTest keeps common vars from connectivity tests
 type CommonTest struct {
 	MTU             int
@@ -12,16 +47,392 @@ type CommonTest struct {
 	ProtocolVersion int
 	PackagesNumber  int
 	Negative        bool
+	SourceIP        string
+	SourcePort      int
+	VRF             string
+	Routing         Routing
+	Reflect         Reflect
+	Flows           Flows
+	Diagnostics     bool
+	Result          Result
+	// mismatched counts replies with unexpected payload, they fail the test regardless of tolerated loss
+	mismatched int
+}
+
+// Reflect requests the client address observed by the reflecting server instead of the echo, the
+// observed source differing from ExpectSourceIP fails the test. Tally opens new connection per package
+// and counts the replies per server identity, the distribution is checked against the affinity
+// expectation or the expected number of backends
+type Reflect struct {
+	Enabled        bool
+	ExpectSourceIP string
+	Tally          bool
+	ExpectAffinity bool
+	ExpectBackends int
+}
+
+// unidentifiedBackend counts the replies of servers without identity
+const unidentifiedBackend = "unidentified"
+
+// Routing defines firewall mark of the test traffic and its expected egress route
+type Routing struct {
+	Mark                  int
+	ExpectEgressInterface string
+	ExpectGateway         string
+}
+
+// Result keeps details of the test run reported together with the test statistics
+type Result struct {
+	Transmitted int
+	Received    int
+	RTTs        []time.Duration
+	RouteBefore *netutils.Route
+	RouteAfter  *netutils.Route
+	// RouteErr is the egress route verification failure, it fails the test regardless of the expectation
+	RouteErr    error
+	Diagnostics *netutils.Diagnostics
+	// Sources counts the packets received by multicast/broadcast receiver per source address
+	Sources map[string]int
+	// Reflection is the client address observed by the reflecting server in the last reply
+	Reflection *netutils.Reflection
+	// Backends counts the replies per server identity in tally mode
+	Backends map[string]int
+	// Flows keeps the outcome of every flow in multi-flow mode
+	Flows []FlowResult
+	// Trace keeps the hops of the trace mode
+	Trace []TraceHop
+	// ReflectionErr is the missing reflection or unexpected observed source, it fails positive test
+	ReflectionErr error
+	// SetupErr is the local failure to open, bind or configure the socket, it fails the test regardless
+	// of the expectation
+	SetupErr   error
+	errorQueue []netutils.SockError
+}
+
+// Loss returns the packet loss in percent
+func (result *Result) Loss() int {
+	return totalPackageLoss(result.Transmitted, result.Transmitted-result.Received)
+}
+
+// AvgRTT returns average round trip time of the received packets
+func (result *Result) AvgRTT() time.Duration {
+	if len(result.RTTs) == 0 {
+		return 0
+	}
+	var total time.Duration
+	for _, rtt := range result.RTTs {
+		total += rtt
+	}
+	return total / time.Duration(len(result.RTTs))
+}
+
+// MaxRTT returns the largest round trip time of the received packets
+func (result *Result) MaxRTT() time.Duration {
+	var max time.Duration
+	for _, rtt := range result.RTTs {
+		if rtt > max {
+			max = rtt
+		}
+	}
+	return max
+}
+
+// bindDevice returns the device sockets are bound to: the egress interface if set, otherwise the vrf
+func (ct *CommonTest) bindDevice(interfaceName string) string {
+	return netutils.BindDevice(interfaceName, ct.VRF)
+}
+
+// runChecked runs the test between egress route lookups, the route verification failure fails the
+// test loudly regardless of the connectivity expectation
+func (ct *CommonTest) runChecked(device string, testFunc func() error) error {
+	ct.Result.RouteBefore, ct.Result.RouteErr = ct.checkRoute("before", device)
+	if ct.Result.RouteErr != nil {
+		return ct.Result.RouteErr
+	}
+	err := testFunc()
+	if isSetupError(err) {
+		ct.Result.SetupErr = err
+	}
+	if ct.Reflect.Tally {
+		ct.checkBackends()
+	}
+	if err == nil && !ct.Negative && ct.Result.ReflectionErr != nil {
+		err = ct.Result.ReflectionErr
+	}
+	ct.Result.RouteAfter, ct.Result.RouteErr = ct.checkRoute("after", device)
+	if ct.Result.RouteBefore != nil && ct.Result.RouteAfter != nil &&
+		ct.Result.RouteBefore.String() != ct.Result.RouteAfter.String() {
+		log.Printf("Route changed during the test: %s -> %s", ct.Result.RouteBefore, ct.Result.RouteAfter)
+	}
+	if ct.Diagnostics && (err != nil) != ct.Negative {
+		ct.collectDiagnostics(device)
+	}
+	return err
 }
 
-// RunCommand runs command and return output
-func (ct *CommonTest) RunCommand(cmd string) (string, error) {
-	commandOutput, err := exec.Command("/bin/sh", "-c", cmd).Output()
+// isSetupError reports whether the error is the local failure to open, bind or configure the socket,
+// which says nothing about the network. Local address in use fails connect of the bound socket as well
+func isSetupError(err error) bool {
+	if errors.Is(err, syscall.EADDRINUSE) || errors.Is(err, syscall.EADDRNOTAVAIL) {
+		return true
+	}
+	var sysErr *os.SyscallError
+	if !errors.As(err, &sysErr) {
+		return false
+	}
+	switch sysErr.Syscall {
+	case "socket", "bind", "setsockopt":
+		return true
+	}
+	return false
+}
+
+// waitPeer polls the route to the server and probes it until the server answers or the timeout expires.
+// The test runs afterwards regardless, so the failure is reported by the test itself
+func (ct *CommonTest) waitPeer(device string, timeout time.Duration, probe func() error) {
+	if ct.Negative {
+		log.Printf("Parameter -wait-peer ignored in negative test")
+		return
+	}
+	start := time.Now()
+	deadline := start.Add(timeout)
+	for {
+		route, err := ct.lookupRoute(device)
+		if err == nil && route.Unreachable != "" {
+			err = fmt.Errorf("no route to %s: %s", route.Destination, route.Unreachable)
+		}
+		if err == nil {
+			err = probe()
+		}
+		if err == nil {
+			log.Printf("Peer %s answered after %s", ct.ServerIP, time.Since(start).Round(time.Millisecond))
+			return
+		}
+		if time.Now().After(deadline) {
+			log.Printf("Peer %s did not answer within %s: %v", ct.ServerIP, timeout, err)
+			return
+		}
+		time.Sleep(waitPeerInterval)
+	}
+}
+
+func (ct *CommonTest) collectDiagnostics(device string) {
+	oif, err := deviceIndex(device)
+	if err != nil {
+		log.Printf("Diagnostics: %v", err)
+	}
+	ct.Result.Diagnostics = netutils.CollectDiagnostics(
+		netutils.ParseIP(ct.ServerIP), netutils.ParseIP(ct.SourceIP), ct.Routing.Mark, oif)
+	ct.Result.Diagnostics.ErrorQueue = ct.Result.errorQueue
+	ct.Result.Diagnostics.Print(os.Stdout)
+}
+
+// sourceAddr returns the source address or nil if not set, link-local address is scoped to the interface
+func (ct *CommonTest) sourceAddr(interfaceName string) (*net.IPAddr, error) {
+	if ct.SourceIP == "" {
+		return nil, nil
+	}
+	return netutils.ScopedIPAddr(ct.SourceIP, interfaceName)
+}
+
+// enableErrorQueue makes the kernel queue ICMP errors of the socket when diagnostics are requested
+func (ct *CommonTest) enableErrorQueue(fd int) error {
+	if !ct.Diagnostics {
+		return nil
+	}
+	return netutils.EnableErrorQueue(fd, ct.ProtocolVersion)
+}
+
+// readErrorQueue keeps queued ICMP errors of the socket for the diagnostics
+func (ct *CommonTest) readErrorQueue(conn syscall.Conn) {
+	if !ct.Diagnostics {
+		return
+	}
+	rawConn, err := conn.SyscallConn()
 	if err != nil {
-		return "", fmt.Errorf("command execution failed - %s due to the error - %s", cmd, err)
+		return
+	}
+	rawConn.Control(func(fd uintptr) {
+		sockErrors, _ := netutils.ReadErrorQueue(int(fd))
+		ct.Result.errorQueue = append(ct.Result.errorQueue, sockErrors...)
+	})
+}
+
+// recordPacket keeps the packet outcome in the test result, zero rtt is not measured
+func (ct *CommonTest) recordPacket(received bool, rtt time.Duration) {
+	ct.Result.Transmitted++
+	if !received {
+		return
+	}
+	ct.Result.Received++
+	if rtt > 0 {
+		ct.Result.RTTs = append(ct.Result.RTTs, rtt)
+	}
+}
+
+// recordMismatch counts the reply with unexpected payload as not received
+func (ct *CommonTest) recordMismatch() {
+	ct.recordPacket(false, 0)
+	ct.mismatched++
+}
+
+// packetsError returns the failure of lost or mismatched packets, only the loss wraps ErrPacketLoss
+func (ct *CommonTest) packetsError(message string) error {
+	if ct.mismatched > 0 {
+		return fmt.Errorf("%s: %d replies with mismatched payload", message, ct.mismatched)
+	}
+	return fmt.Errorf("%s: %w", message, ErrPacketLoss)
+}
+
+// recordSource counts the packet received from the source
+func (ct *CommonTest) recordSource(source net.IP) {
+	if ct.Result.Sources == nil {
+		ct.Result.Sources = map[string]int{}
+	}
+	ct.Result.Sources[source.String()]++
+}
+
+// recordReflection keeps the reflection of the reply, the first failure of the reflection check is kept
+func (ct *CommonTest) recordReflection(data []byte) {
+	reflection, err := netutils.ParseReflection(data)
+	if err == nil {
+		fmt.Printf("Reflected %s\n", reflection)
+		ct.Result.Reflection = reflection
+		if ct.Reflect.Tally {
+			ct.recordBackend(reflection.Identity)
+		}
+		expected := netutils.ParseIP(ct.Reflect.ExpectSourceIP)
+		if expected != nil && !reflection.SourceIP().Equal(expected) {
+			err = fmt.Errorf("server observed source %s, expected %s", reflection.SourceIP(), expected)
+		}
+	}
+	if err != nil {
+		fmt.Printf("Reflection check failed: %v\n", err)
+		if ct.Result.ReflectionErr == nil {
+			ct.Result.ReflectionErr = err
+		}
+	}
+}
+
+func (ct *CommonTest) recordBackend(identity string) {
+	if identity == "" {
+		identity = unidentifiedBackend
+	}
+	if ct.Result.Backends == nil {
+		ct.Result.Backends = map[string]int{}
+	}
+	ct.Result.Backends[identity]++
+}
+
+// checkBackends prints the distribution of the replies per backend and keeps the failure of the affinity
+// or backends expectation as the reflection failure
+func (ct *CommonTest) checkBackends() {
+	backends := make([]string, 0, len(ct.Result.Backends))
+	replies, width := 0, 0
+	for backend, count := range ct.Result.Backends {
+		backends = append(backends, backend)
+		replies += count
+		if len(backend) > width {
+			width = len(backend)
+		}
+	}
+	sort.Strings(backends)
+	fmt.Println("--- backend distribution ---")
+	for _, backend := range backends {
+		count := ct.Result.Backends[backend]
+		fmt.Printf("%-*s  %d  %d%%\n", width, backend, count, count*100/replies)
+	}
+	fmt.Printf("%d backends, %d replies\n", len(backends), replies)
+
+	var err error
+	switch {
+	case ct.Reflect.ExpectAffinity && len(backends) > 1:
+		err = fmt.Errorf("session affinity broken, replies from %d backends", len(backends))
+	case ct.Reflect.ExpectBackends > 0 && len(backends) < ct.Reflect.ExpectBackends:
+		err = fmt.Errorf("replies from %d backends, expected at least %d", len(backends), ct.Reflect.ExpectBackends)
+	}
+	if err != nil && ct.Result.ReflectionErr == nil {
+		ct.Result.ReflectionErr = err
+	}
+}
+
+func (ct *CommonTest) checkRoute(stage string, device string) (*netutils.Route, error) {
+	route, err := ct.lookupRoute(device)
+	if err != nil {
+		if ct.Routing.ExpectEgressInterface != "" || ct.Routing.ExpectGateway != "" {
+			return nil, fmt.Errorf("Route lookup %s test failed: %w", stage, err)
+		}
+		log.Printf("Route lookup %s test failed: %v", stage, err)
+		return nil, nil
+	}
+	fmt.Printf("Route %s test: %s\n", stage, route)
+	err = ct.Routing.verify(route)
+	if err != nil {
+		return route, fmt.Errorf("Route verification %s test failed: %w", stage, err)
+	}
+	return route, nil
+}
+
+func deviceIndex(device string) (int, error) {
+	if device == "" {
+		return 0, nil
+	}
+	intFace, err := net.InterfaceByName(device)
+	if err != nil {
+		return 0, err
+	}
+	return intFace.Index, nil
+}
+
+func (ct *CommonTest) lookupRoute(device string) (*netutils.Route, error) {
+	oif, err := deviceIndex(device)
+	if err != nil {
+		return nil, err
+	}
+	return netutils.RouteGet(netutils.ParseIP(ct.ServerIP), netutils.ParseIP(ct.SourceIP), ct.Routing.Mark, oif)
+}
+
+func (routing *Routing) verify(route *netutils.Route) error {
+	if routing.ExpectEgressInterface == "" && routing.ExpectGateway == "" {
+		return nil
+	}
+	if route.Unreachable != "" {
+		return fmt.Errorf("no route to %s: %s", route.Destination, route.Unreachable)
+	}
+	if routing.ExpectEgressInterface != "" && route.Interface != routing.ExpectEgressInterface {
+		return fmt.Errorf("traffic leaves via interface %s, expected %s", route.Interface, routing.ExpectEgressInterface)
+	}
+	switch routing.ExpectGateway {
+	case "":
+	case GatewayNone:
+		if route.Gateway != "" {
+			return fmt.Errorf("traffic leaves via gateway %s, expected directly connected destination", route.Gateway)
+		}
+	default:
+		if !net.ParseIP(route.Gateway).Equal(net.ParseIP(routing.ExpectGateway)) {
+			return fmt.Errorf("traffic leaves via gateway %q, expected %s", route.Gateway, routing.ExpectGateway)
+		}
+	}
+	return nil
+}
+
+// MaxPayload returns the largest payload of the protocol fitting into the MTU without fragmentation
+func MaxPayload(protocol string, protocolVersion int, mtu int) int {
+	payload := mtu - ipv4HeaderSize
+	if protocolVersion == 6 {
+		payload = mtu - ipv6HeaderSize
+	}
+	switch protocol {
+	case ProtocolICMP:
+		return payload - icmpHeaderSize
+	case ProtocolUDP:
+		return payload - udpHeaderSize
+	case ProtocolTCP:
+		return payload - tcpHeaderSize
+	case ProtocolSCTP:
+		return payload - sctpHeaderSize
 	}
-	fmt.Printf("Executed command: %s", cmd)
-	return string(commandOutput), nil
+	return payload
 }
 
 func totalPackageLoss(total int, loss int) int {
@@ -0,0 +1,50 @@
+package protocols
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestIsSetupError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "nil", err: nil, want: false},
+		{name: "address in use", err: fmt.Errorf("dial: %w", syscall.EADDRINUSE), want: true},
+		{name: "address not available", err: fmt.Errorf("socketConfig.Dial() failed with error: %w",
+			syscall.EADDRNOTAVAIL), want: true},
+		{name: "socket", err: os.NewSyscallError("socket", syscall.EPERM), want: true},
+		{name: "bind", err: fmt.Errorf("icmp: %w", os.NewSyscallError("bind", syscall.EACCES)), want: true},
+		{name: "setsockopt", err: fmt.Errorf("runClient, syscall.SetsockoptInt(SCTP_DISABLE_FRAGMENTS) error: %w",
+			os.NewSyscallError("setsockopt", syscall.ENOPROTOOPT)), want: true},
+		{name: "connect", err: os.NewSyscallError("connect", syscall.ECONNREFUSED), want: false},
+		{name: "unwrapped errno", err: fmt.Errorf("socketConfig.Dial() failed with error: %v",
+			syscall.EADDRNOTAVAIL), want: false},
+		{name: "packet loss", err: ErrPacketLoss, want: false},
+		{name: "other", err: errors.New("timeout"), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isSetupError(tt.err); got != tt.want {
+				t.Errorf("isSetupError(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunCheckedSetupError(t *testing.T) {
+	bindErr := fmt.Errorf("socketConfig.Dial() failed with error: %w", syscall.EADDRNOTAVAIL)
+	test := CommonTest{ServerIP: "127.0.0.1", ProtocolVersion: 4, Negative: true}
+	err := test.runChecked("", func() error { return bindErr })
+	if !errors.Is(err, bindErr) {
+		t.Errorf("runChecked returned %v, want %v", err, bindErr)
+	}
+	if test.Result.SetupErr != bindErr {
+		t.Errorf("SetupErr = %v, want %v", test.Result.SetupErr, bindErr)
+	}
+}
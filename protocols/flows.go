@@ -0,0 +1,193 @@
+package protocols
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/kononovn/testcmd/netutils"
+)
+
+// Flows spreads the test over flows of distinct source ports and addresses. Every flow is separate
+// 5-tuple hashed to its own ECMP member or load balancer backend, so single broken member black-holes
+// subset of the flows. Without port range the kernel picks random source port of every flow
+type Flows struct {
+	Count     int
+	PortFirst int
+	PortLast  int
+	Sources   []string
+}
+
+// FlowResult is the outcome of single flow together with the backend and interface the reflecting
+// server reported
+type FlowResult struct {
+	Source      string
+	Transmitted int
+	Received    int
+	Backend     string
+	Interface   string
+	Err         error
+}
+
+// flow is the local address of single flow, zero port is the kernel choice
+type flow struct {
+	source string
+	port   int
+}
+
+// Enabled reports multi-flow mode
+func (flows *Flows) Enabled() bool {
+	return flows.Count > 0 || flows.PortFirst > 0 || len(flows.Sources) > 0
+}
+
+// Failed reports flow whose socket could not be opened or bound locally, it says nothing about the network
+func (result *FlowResult) Failed() bool {
+	return result.Received == 0 && isSetupError(result.Err)
+}
+
+// BlackHoled reports flow without any reply
+func (result *FlowResult) BlackHoled() bool {
+	return result.Received == 0 && !result.Failed()
+}
+
+// Lossy reports flow with some of the packets lost
+func (result *FlowResult) Lossy() bool {
+	return result.Received > 0 && result.Received < result.Transmitted
+}
+
+// list returns the flows: every source with every port of the range, the count limits the flows.
+// Without range count flows with kernel chosen ports cycle the sources
+func (flows *Flows) list(sourceIP string) []flow {
+	sources := flows.Sources
+	if len(sources) == 0 {
+		sources = []string{sourceIP}
+	}
+	var list []flow
+	if flows.PortFirst > 0 {
+		for port := flows.PortFirst; port <= flows.PortLast; port++ {
+			for _, source := range sources {
+				list = append(list, flow{source: source, port: port})
+			}
+		}
+		if flows.Count > 0 && flows.Count < len(list) {
+			list = list[:flows.Count]
+		}
+		return list
+	}
+	count := flows.Count
+	if count == 0 {
+		count = len(sources)
+	}
+	for i := 0; i < count; i++ {
+		list = append(list, flow{source: sources[i%len(sources)]})
+	}
+	return list
+}
+
+// runFlows runs the test of every flow by the run function returning the local address of the flow,
+// the packets are counted per flow and the flows without replies are reported as black-holed
+func (ct *CommonTest) runFlows(interfaceName string, run func(source *net.IPAddr, port int) (net.Addr, error)) error {
+	for _, flow := range ct.Flows.list(ct.SourceIP) {
+		result := FlowResult{Source: net.JoinHostPort(flow.source, fmt.Sprint(flow.port))}
+		transmitted, received := ct.Result.Transmitted, ct.Result.Received
+		ct.Result.Reflection = nil
+		var (
+			source *net.IPAddr
+			local  net.Addr
+			err    error
+		)
+		if flow.source != "" {
+			source, err = netutils.ScopedIPAddr(flow.source, interfaceName)
+		}
+		if err == nil {
+			local, err = run(source, flow.port)
+		}
+		if local != nil {
+			result.Source = local.String()
+		}
+		if ct.Result.Transmitted == transmitted {
+			// the flow could not be opened, it counts as single lost packet
+			ct.recordPacket(false, 0)
+		}
+		result.Transmitted = ct.Result.Transmitted - transmitted
+		result.Received = ct.Result.Received - received
+		result.Err = err
+		if ct.Result.Reflection != nil {
+			result.Backend = ct.Result.Reflection.Identity
+			result.Interface = ct.Result.Reflection.Interface
+		}
+		ct.Result.Flows = append(ct.Result.Flows, result)
+	}
+	return ct.reportFlows()
+}
+
+// reportFlows prints the flows and returns error when any flow failed to open, is black-holed or lossy
+func (ct *CommonTest) reportFlows() error {
+	fmt.Printf("--- %s flow spread ---\n", ct.ServerIP)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "FLOW\tSOURCE\tSENT\tRECEIVED\tBACKEND\tINTERFACE\tRESULT")
+	var failed, blackHoled, lossy []string
+	var failedErr error
+	backends := map[string]int{}
+	for i, result := range ct.Result.Flows {
+		status := "passed"
+		switch {
+		case result.Failed():
+			status = "failed"
+			failed = append(failed, result.Source)
+			if failedErr == nil {
+				failedErr = result.Err
+			}
+		case result.BlackHoled():
+			status = "black-holed"
+			blackHoled = append(blackHoled, result.Source)
+		case result.Lossy():
+			status = "lossy"
+			lossy = append(lossy, result.Source)
+		}
+		if result.Err != nil {
+			status += ": " + result.Err.Error()
+		}
+		if result.Backend != "" {
+			backends[result.Backend]++
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%d\t%d\t%s\t%s\t%s\n", i+1, result.Source, result.Transmitted, result.Received,
+			valueOrDash(result.Backend), valueOrDash(result.Interface), status)
+	}
+	tw.Flush()
+	fmt.Printf("%d flows, %d passed, %d black-holed, %d lossy, %d failed\n", len(ct.Result.Flows),
+		len(ct.Result.Flows)-len(failed)-len(blackHoled)-len(lossy), len(blackHoled), len(lossy), len(failed))
+	if len(backends) > 0 {
+		names := make([]string, 0, len(backends))
+		for backend, count := range backends {
+			names = append(names, fmt.Sprintf("%s=%d", backend, count))
+		}
+		sort.Strings(names)
+		fmt.Printf("flows per backend: %s\n", strings.Join(names, " "))
+	}
+	switch {
+	case len(failed) > 0:
+		// the socket error keeps the failure local, so it is not taken for the network verdict
+		return fmt.Errorf("%d of %d flows failed to open: %s: %w", len(failed), len(ct.Result.Flows),
+			strings.Join(failed, ","), failedErr)
+	case len(blackHoled) == len(ct.Result.Flows):
+		return fmt.Errorf("all %d flows black-holed", len(blackHoled))
+	case len(blackHoled) > 0:
+		return fmt.Errorf("%d of %d flows black-holed: %s", len(blackHoled), len(ct.Result.Flows),
+			strings.Join(blackHoled, ","))
+	case len(lossy) > 0:
+		return fmt.Errorf("%d of %d flows lossy: %s: %w", len(lossy), len(ct.Result.Flows), strings.Join(lossy, ","),
+			ErrPacketLoss)
+	}
+	return nil
+}
+
+func valueOrDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
@@ -0,0 +1,43 @@
+package protocols
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFlowsList(t *testing.T) {
+	tests := []struct {
+		name     string
+		flows    Flows
+		sourceIP string
+		want     []flow
+	}{
+		{name: "count with kernel chosen ports", flows: Flows{Count: 3}, sourceIP: "10.10.0.1",
+			want: []flow{{source: "10.10.0.1"}, {source: "10.10.0.1"}, {source: "10.10.0.1"}}},
+		{name: "count cycles the sources", flows: Flows{Count: 3, Sources: []string{"10.10.0.1", "10.10.0.3"}},
+			want: []flow{{source: "10.10.0.1"}, {source: "10.10.0.3"}, {source: "10.10.0.1"}}},
+		{name: "flow per source", flows: Flows{Sources: []string{"10.10.0.1", "10.10.0.3"}}, sourceIP: "10.10.0.5",
+			want: []flow{{source: "10.10.0.1"}, {source: "10.10.0.3"}}},
+		{name: "port range", flows: Flows{PortFirst: 40000, PortLast: 40002},
+			want: []flow{{port: 40000}, {port: 40001}, {port: 40002}}},
+		{name: "single port", flows: Flows{PortFirst: 40000, PortLast: 40000}, sourceIP: "fd10::1",
+			want: []flow{{source: "fd10::1", port: 40000}}},
+		{name: "every source with every port",
+			flows: Flows{PortFirst: 40000, PortLast: 40001, Sources: []string{"10.10.0.1", "10.10.0.3"}},
+			want: []flow{{source: "10.10.0.1", port: 40000}, {source: "10.10.0.3", port: 40000},
+				{source: "10.10.0.1", port: 40001}, {source: "10.10.0.3", port: 40001}}},
+		{name: "count limits the range", flows: Flows{Count: 2, PortFirst: 40000, PortLast: 40063},
+			want: []flow{{port: 40000}, {port: 40001}}},
+		{name: "count above the range", flows: Flows{Count: 10, PortFirst: 40000, PortLast: 40001},
+			want: []flow{{port: 40000}, {port: 40001}}},
+		{name: "reversed range", flows: Flows{PortFirst: 40063, PortLast: 40000}, want: nil},
+		{name: "disabled", flows: Flows{}, sourceIP: "10.10.0.1", want: []flow{{source: "10.10.0.1"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.flows.list(tt.sourceIP); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("list(%q) = %v, want %v", tt.sourceIP, got, tt.want)
+			}
+		})
+	}
+}
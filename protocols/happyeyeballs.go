@@ -0,0 +1,117 @@
+package protocols
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/kononovn/testcmd/netutils"
+)
+
+// HappyEyeballsFallbackDelay is the delay before racing the secondary family, as recommended by RFC 8305
+const HappyEyeballsFallbackDelay = 250 * time.Millisecond
+
+// HappyEyeballsResult keeps connect times of each family and the family a dual-stack client ends up using
+type HappyEyeballsResult struct {
+	Primary     string
+	Secondary   string
+	ConnectTime map[string]time.Duration
+	ConnectErr  map[string]error
+	Winner      string
+	RaceTime    time.Duration
+}
+
+func (result *HappyEyeballsResult) String() string {
+	format := func(address string) string {
+		if err := result.ConnectErr[address]; err != nil {
+			return fmt.Sprintf("%s failed: %v", address, err)
+		}
+		return fmt.Sprintf("%s %s", address, result.ConnectTime[address].Round(time.Microsecond))
+	}
+	if result.Winner == "" {
+		return fmt.Sprintf("no connection (connect %s, %s)", format(result.Primary), format(result.Secondary))
+	}
+	return fmt.Sprintf("connected to %s in %s (connect %s, %s)",
+		result.Winner, result.RaceTime.Round(time.Microsecond), format(result.Primary), format(result.Secondary))
+}
+
+// MeasureHappyEyeballs connects to each address alone, then races them Happy Eyeballs style: the primary
+// address in resolver preference order first and the secondary after the fallback delay
+func MeasureHappyEyeballs(
+	primary string, secondary string, port int, device string, mark int, timeout time.Duration) *HappyEyeballsResult {
+	result := &HappyEyeballsResult{
+		Primary:     primary,
+		Secondary:   secondary,
+		ConnectTime: map[string]time.Duration{},
+		ConnectErr:  map[string]error{},
+	}
+	dialer := net.Dialer{Timeout: timeout, Control: netutils.ControlSocket(device, mark)}
+	for _, address := range []string{primary, secondary} {
+		start := time.Now()
+		conn, err := dialer.Dial(ProtocolTCP, net.JoinHostPort(address, strconv.Itoa(port)))
+		result.ConnectTime[address] = time.Since(start)
+		result.ConnectErr[address] = err
+		if err == nil {
+			conn.Close()
+		}
+	}
+
+	type attempt struct {
+		address string
+		conn    net.Conn
+		err     error
+	}
+	attempts := make(chan attempt, 2)
+	dial := func(address string) {
+		conn, err := dialer.Dial(ProtocolTCP, net.JoinHostPort(address, strconv.Itoa(port)))
+		attempts <- attempt{address: address, conn: conn, err: err}
+	}
+	start := time.Now()
+	go dial(primary)
+	fallback := time.NewTimer(HappyEyeballsFallbackDelay)
+	defer fallback.Stop()
+	pending := 1
+	started := false
+	for pending > 0 {
+		select {
+		case <-fallback.C:
+			if !started {
+				started = true
+				pending++
+				go dial(secondary)
+			}
+		case a := <-attempts:
+			pending--
+			if a.err != nil {
+				// failed primary starts the secondary at once
+				if !started {
+					started = true
+					pending++
+					go dial(secondary)
+				}
+				continue
+			}
+			if result.Winner == "" {
+				result.Winner = a.address
+				result.RaceTime = time.Since(start)
+				// the other attempt, if still running, is drained and closed
+				if started {
+					go func(pending int) {
+						for ; pending > 0; pending-- {
+							if other := <-attempts; other.conn != nil {
+								other.conn.Close()
+							}
+						}
+					}(pending)
+					pending = 0
+				}
+				a.conn.Close()
+				if !started {
+					return result
+				}
+			}
+		}
+	}
+	return result
+}
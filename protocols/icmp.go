@@ -1,22 +1,54 @@
 package protocols
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"os"
-	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/kononovn/testcmd/netutils"
 )
 
 const (
 	// ProtocolICMP the name of the protocol
 	ProtocolICMP = "icmp"
+
+	icmpv4EchoRequest = 8
+	icmpv4EchoReply   = 0
+	icmpv6EchoRequest = 128
+	icmpv6EchoReply   = 129
+	icmpHeaderSize    = 8
+	timeoutICMP       = 1
 )
 
+var icmpID uint32
+
+var errPayloadMismatch = errors.New("reply payload mismatch")
+
+// nextICMPID returns echo identifier unique for every test of the process, so concurrent tests
+// of the plan or the agent do not take replies of each other
+func nextICMPID() int {
+	return (os.Getpid() + int(atomic.AddUint32(&icmpID, 1))) & 0xffff
+}
+
 // ICMPTest define, run and process return code of icmp test command
 type ICMPTest struct {
 	common        CommonTest
 	InterfaceName string
+	// Unprivileged uses ping socket instead of raw socket when CAP_NET_RAW is missing
+	Unprivileged bool
+}
+
+// icmpConn is raw socket wrapped as *net.IPConn or ping socket wrapped as *net.UDPConn
+type icmpConn interface {
+	net.PacketConn
+	syscall.Conn
 }
 
 // NewICMPTest creates new instance of ConnectivityTestParameters
@@ -25,52 +57,335 @@ func NewICMPTest(
 	protocolVersion int,
 	serverIP string,
 	intefaceName string,
+	vrfName string,
 	packagesNumber int,
-	negative bool) *ICMPTest {
-	if intefaceName != "" {
-		intFace, err := net.InterfaceByName(intefaceName)
-		if err != nil {
-			fmt.Print(err)
-			os.Exit(1)
-		}
+	negative bool,
+	sourceIP string,
+	routing Routing,
+	diagnostics bool) (*ICMPTest, error) {
+	intFace, err := netutils.ResolveInterface(intefaceName)
+	if err != nil {
+		return nil, err
+	}
+	if intFace != nil {
 		intefaceName = intFace.Name
 	}
 	return &ICMPTest{
 		InterfaceName: intefaceName,
+		Unprivileged:  !netutils.HasCapability(netutils.CapNetRaw),
 		common: CommonTest{
 			MTU:             mtu,
 			ServerIP:        serverIP,
 			ProtocolVersion: protocolVersion,
 			PackagesNumber:  packagesNumber,
 			Negative:        negative,
-		}}
+			SourceIP:        sourceIP,
+			VRF:             vrfName,
+			Routing:         routing,
+			Diagnostics:     diagnostics,
+		}}, nil
+}
+
+// openSocket opens icmp socket bound to the interface and source address with DF flag set. Without
+// CAP_NET_RAW unprivileged ping socket is used, the group of the process must be in net.ipv4.ping_group_range
+func (test *ICMPTest) openSocket() (icmpConn, error) {
+	family, proto := syscall.AF_INET, syscall.IPPROTO_ICMP
+	if test.common.ProtocolVersion == 6 {
+		family, proto = syscall.AF_INET6, syscall.IPPROTO_ICMPV6
+	}
+	sotype := syscall.SOCK_RAW
+	if test.Unprivileged {
+		sotype = syscall.SOCK_DGRAM
+	}
+	fd, err := syscall.Socket(family, sotype|syscall.SOCK_CLOEXEC, proto)
+	err = os.NewSyscallError("socket", err)
+	if err != nil && test.Unprivileged {
+		return nil, fmt.Errorf("can not open unprivileged icmp socket, CAP_NET_RAW or group in net.ipv4.ping_group_range is required: %w", err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can not open raw icmp socket: %w", err)
+	}
+	file := os.NewFile(uintptr(fd), "icmp")
+	defer file.Close()
+
+	err = netutils.BindToDevice(fd, test.common.bindDevice(test.InterfaceName))
+	if err != nil {
+		return nil, err
+	}
+	err = netutils.SetMark(fd, test.common.Routing.Mark)
+	if err != nil {
+		return nil, err
+	}
+	err = test.common.enableErrorQueue(fd)
+	if err != nil {
+		return nil, err
+	}
+	err = setDontFragment(fd, test.common.ProtocolVersion)
+	if err != nil {
+		return nil, err
+	}
+	source, err := test.common.sourceAddr(test.InterfaceName)
+	if err != nil {
+		return nil, err
+	}
+	if source != nil {
+		sa, err := sockaddr(source, test.common.ProtocolVersion)
+		if err != nil {
+			return nil, err
+		}
+		err = syscall.Bind(fd, sa)
+		if err != nil {
+			return nil, fmt.Errorf("can not bind source address %s: %w", test.common.SourceIP,
+				os.NewSyscallError("bind", err))
+		}
+	}
+	conn, err := net.FilePacketConn(file)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(icmpConn), nil
+}
+
+// remoteAddr returns the server address in the form of the socket type
+func (test *ICMPTest) remoteAddr() (net.Addr, error) {
+	raddr, err := net.ResolveIPAddr(fmt.Sprintf("ip%d", test.common.ProtocolVersion), test.common.ServerIP)
+	if err != nil {
+		return nil, err
+	}
+	if test.Unprivileged {
+		return &net.UDPAddr{IP: raddr.IP, Zone: raddr.Zone}, nil
+	}
+	return raddr, nil
+}
+
+// sockaddr converts the address to socket address, IPv6 zone becomes the scope id
+func sockaddr(ipAddr *net.IPAddr, protocolVersion int) (syscall.Sockaddr, error) {
+	if protocolVersion == 4 {
+		addr := &syscall.SockaddrInet4{}
+		copy(addr.Addr[:], ipAddr.IP.To4())
+		return addr, nil
+	}
+	addr := &syscall.SockaddrInet6{}
+	copy(addr.Addr[:], ipAddr.IP.To16())
+	if ipAddr.Zone != "" {
+		intFace, err := net.InterfaceByName(ipAddr.Zone)
+		if err != nil {
+			return nil, err
+		}
+		addr.ZoneId = uint32(intFace.Index)
+	}
+	return addr, nil
+}
+
+func icmpChecksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i : i+2]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
+
+// echoRequest builds echo request message, the kernel computes ICMPv6 checksum itself
+func (test *ICMPTest) echoRequest(id int, seq int, payload []byte) []byte {
+	msg := make([]byte, icmpHeaderSize+len(payload))
+	msg[0] = icmpv4EchoRequest
+	if test.common.ProtocolVersion == 6 {
+		msg[0] = icmpv6EchoRequest
+	}
+	binary.BigEndian.PutUint16(msg[4:6], uint16(id))
+	binary.BigEndian.PutUint16(msg[6:8], uint16(seq))
+	copy(msg[icmpHeaderSize:], payload)
+	if test.common.ProtocolVersion == 4 {
+		binary.BigEndian.PutUint16(msg[2:4], icmpChecksum(msg))
+	}
+	return msg
+}
+
+// addrIP returns IP address of the raw or ping socket address
+func addrIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.IPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	}
+	return nil
+}
+
+// readEchoReply waits for the reply of the server matching id and seq, other icmp messages seen by the raw
+// socket are skipped. Ping socket replaces id with its own and receives only its replies
+func (test *ICMPTest) readEchoReply(conn net.PacketConn, raddr net.Addr, id int, seq int,
+	payload []byte) (int, net.Addr, error) {
+	replyType := byte(icmpv4EchoReply)
+	if test.common.ProtocolVersion == 6 {
+		replyType = icmpv6EchoReply
+	}
+	buffer := make([]byte, test.common.MTU+icmpHeaderSize+60)
+	for {
+		n, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			return 0, nil, err
+		}
+		if !addrIP(addr).Equal(addrIP(raddr)) {
+			continue
+		}
+		if udpAddr, ok := addr.(*net.UDPAddr); ok {
+			addr = &net.IPAddr{IP: udpAddr.IP, Zone: udpAddr.Zone}
+		}
+		// ip header of the raw IPv4 socket is stripped by ReadFrom
+		msg := buffer[:n]
+		if len(msg) < icmpHeaderSize || msg[0] != replyType {
+			continue
+		}
+		if (!test.Unprivileged && int(binary.BigEndian.Uint16(msg[4:6])) != id) || int(binary.BigEndian.Uint16(msg[6:8])) != seq {
+			continue
+		}
+		if !bytes.Equal(msg[icmpHeaderSize:], payload) {
+			return 0, addr, fmt.Errorf("icmp_seq=%d %w", seq, errPayloadMismatch)
+		}
+		return len(msg), addr, nil
+	}
+}
+
+func (test *ICMPTest) runICMPPing(
+	conn icmpConn,
+	raddr net.Addr,
+	id int,
+	packetNumber int,
+	payload []byte,
+	statPacketLost *int,
+	statPacketReceived *int,
+	statTotalTime *int64,
+	exitCode *int) {
+
+	if packetNumber > 1 {
+		time.Sleep(1 * time.Second)
+	}
+	deadline := time.Now().Add(timeoutICMP * time.Second)
+	conn.SetDeadline(deadline)
+	startTime := time.Now()
+	_, err := conn.WriteTo(test.echoRequest(id, packetNumber, payload), raddr)
+	if err != nil {
+		fmt.Println(err)
+		test.common.readErrorQueue(conn)
+		*statPacketLost++
+		test.common.recordPacket(false, 0)
+		*exitCode = 1
+		return
+	}
+	n, addr, err := test.readEchoReply(conn, raddr, id, packetNumber, payload)
+	elapsed := time.Since(startTime)
+	if errors.Is(err, errPayloadMismatch) {
+		fmt.Println(err)
+		*statPacketLost++
+		test.common.recordMismatch()
+		*exitCode = 1
+		return
+	}
+	if err != nil {
+		fmt.Printf("Package lost\n")
+		test.common.readErrorQueue(conn)
+		*statPacketLost++
+		test.common.recordPacket(false, 0)
+		*exitCode = 1
+		return
+	}
+	*statTotalTime += elapsed.Microseconds()
+	fmt.Printf("%d bytes from %s: icmp_seq=%d time=%dms\n", n, addr, packetNumber, elapsed.Microseconds())
+	*statPacketReceived++
+	test.common.recordPacket(true, elapsed)
 }
 
-func (test *ICMPTest) defineCommand() string {
-	command := []string{"ping", fmt.Sprintf("-%d", test.common.ProtocolVersion),
-		test.common.ServerIP, "-c", fmt.Sprintf("%d", test.common.PackagesNumber), "-w",
-		fmt.Sprintf("%d", test.common.PackagesNumber),
-		"-s", fmt.Sprintf("%d", test.common.MTU), "-M", "do"}
-	if test.InterfaceName != "" {
-		command = append(command, fmt.Sprintf("-I %s", test.InterfaceName))
+func (test *ICMPTest) testICMP() error {
+	conn, err := test.openSocket()
+	if err != nil {
+		return err
 	}
-	return strings.Join(command, " ")
+	defer conn.Close()
+	raddr, err := test.remoteAddr()
+	if err != nil {
+		return err
+	}
+	payload := bytes.Repeat([]byte("a"), test.common.MTU)
+	id := nextICMPID()
+
+	fmt.Printf("PING %s %d(%d) bytes of data.\n",
+		test.common.ServerIP, test.common.MTU, test.common.MTU+28)
+	var (
+		statTotalTime      int64
+		exitCode           int
+		statPacketLost     int
+		statPacketReceived int
+	)
+	for i := 1; i <= test.common.PackagesNumber; i++ {
+		test.runICMPPing(conn, raddr, id, i, payload, &statPacketLost, &statPacketReceived, &statTotalTime, &exitCode)
+	}
+	fmt.Printf("--- %s ping statistics ---\n", test.common.ServerIP)
+	fmt.Printf("%d packets transmitted, %d received, %d packet loss, time %dms\n",
+		test.common.PackagesNumber, statPacketReceived,
+		totalPackageLoss(test.common.PackagesNumber, statPacketLost), statTotalTime)
+	if exitCode != 0 {
+		return test.common.packetsError("ICMP connectivity test failed")
+	}
+	return nil
 }
 
-// RunTest runs the test
-func (test *ICMPTest) RunTest() {
-	_, err := test.common.RunCommand(test.defineCommand())
+// probe sends single echo request of minimal size and waits for the reply
+func (test *ICMPTest) probe() error {
+	conn, err := test.openSocket()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	raddr, err := test.remoteAddr()
+	if err != nil {
+		return err
+	}
+	id := nextICMPID()
+	conn.SetDeadline(time.Now().Add(timeoutICMP * time.Second))
+	_, err = conn.WriteTo(test.echoRequest(id, 0, nil), raddr)
+	if err != nil {
+		return err
+	}
+	_, _, err = test.readEchoReply(conn, raddr, id, 0, nil)
+	return err
+}
+
+// WaitPeer waits until the server answers icmp echo requests
+func (test *ICMPTest) WaitPeer(timeout time.Duration) {
+	test.common.waitPeer(test.common.bindDevice(test.InterfaceName), timeout, test.probe)
+}
+
+// Result returns statistics and details of the test run
+func (test *ICMPTest) Result() *Result {
+	return &test.common.Result
+}
+
+// Run runs the test and returns error when the result does not match the expectation
+func (test *ICMPTest) Run() error {
+	err := test.common.runChecked(test.common.bindDevice(test.InterfaceName), test.testICMP)
+	if test.common.Result.RouteErr != nil {
+		return test.common.Result.RouteErr
+	}
+	if test.common.Result.SetupErr != nil {
+		return test.common.Result.SetupErr
+	}
 	if test.common.Negative {
 		if err != nil {
 			log.Print("ICMP test failed as expected")
-			os.Exit(0)
-		} else {
-			log.Fatalf("negative test failed to return code 1")
-			os.Exit(1)
+			return nil
 		}
+		return fmt.Errorf("negative test failed to return code 1")
 	}
 	if err != nil {
-		log.Fatalf("cmd.Run() failed with %s\n", err)
-		os.Exit(1)
+		return fmt.Errorf("ICMP test failed with %w", err)
 	}
+	log.Print("ICMP test passed as expected")
+	return nil
 }
@@ -5,20 +5,26 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"os"
 	"syscall"
+	"time"
 
 	"github.com/ishidawataru/sctp"
+	"github.com/kononovn/testcmd/netutils"
 )
 
 const (
 	// ProtocolSCTP is sctp's protocol name
 	ProtocolSCTP = "sctp"
+	// sctpReflectionTimeout bounds the wait for the reflection, sctp connection does not support deadlines
+	sctpReflectionTimeout = 10
 )
 
 // SCTPTest is a struct with information for sctp test
 type SCTPTest struct {
-	common     CommonTest
-	ServerPort int
+	common        CommonTest
+	ServerPort    int
+	InterfaceName string
 }
 
 // NewSCTPTest returns a new SCTP test
@@ -28,16 +34,37 @@ func NewSCTPTest(
 	protocolVersion int,
 	serverPort int,
 	numOfStreams int,
-	negative bool) *SCTPTest {
+	negative bool,
+	interfaceName string,
+	vrfName string,
+	sourceIP string,
+	sourcePort int,
+	routing Routing,
+	reflect Reflect,
+	diagnostics bool) (*SCTPTest, error) {
+	intFace, err := netutils.ResolveInterface(interfaceName)
+	if err != nil {
+		return nil, err
+	}
+	if intFace != nil {
+		interfaceName = intFace.Name
+	}
 	return &SCTPTest{
-		ServerPort: serverPort,
+		ServerPort:    serverPort,
+		InterfaceName: interfaceName,
 		common: CommonTest{
 			MTU:             mtu,
 			ServerIP:        serverIP,
 			ProtocolVersion: protocolVersion,
 			PackagesNumber:  numOfStreams,
 			Negative:        negative,
-		}}
+			SourceIP:        sourceIP,
+			SourcePort:      sourcePort,
+			VRF:             vrfName,
+			Routing:         routing,
+			Reflect:         reflect,
+			Diagnostics:     diagnostics,
+		}}, nil
 }
 
 func runClient(
@@ -47,7 +74,11 @@ func runClient(
 	interfaceName string,
 	numOfStreams int,
 	protocolVersion int,
-) error {
+	sourceIP string,
+	sourcePort int,
+	mark int,
+	reflect bool,
+) ([]byte, error) {
 	address, _ := net.ResolveIPAddr("ip", serverAddr)
 	server := &sctp.SCTPAddr{
 		IPAddrs: []net.IPAddr{*address},
@@ -56,22 +87,30 @@ func runClient(
 
 	socketConfig := &sctp.SocketConfig{
 		Control: func(network, address string, c syscall.RawConn) error {
+			var operr error
 			err := c.Control(
 				func(fd uintptr) {
 					// value is 1 to set SCTP_DISABLE_FRAGMENTS to true
-					err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_SCTP, sctp.SCTP_DISABLE_FRAGMENTS, 1)
-					if err != nil {
-						log.Fatalf("runClient, syscall.SetsockoptInt(SCTP_DISABLE_FRAGMENTS) error: %v", err)
+					operr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_SCTP, sctp.SCTP_DISABLE_FRAGMENTS, 1)
+					if operr != nil {
+						operr = fmt.Errorf("runClient, syscall.SetsockoptInt(SCTP_DISABLE_FRAGMENTS) error: %w",
+							os.NewSyscallError("setsockopt", operr))
+						return
+					}
+					operr = netutils.BindToDevice(int(fd), interfaceName)
+					if operr == nil {
+						operr = netutils.SetMark(int(fd), mark)
 					}
-					if interfaceName != "" {
-						err = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, interfaceName)
-						if err != nil {
-							log.Fatalf("runClient, syscall.SetsockoptInt(SO_BINDTODEVICE) error: %v", err)
-						}
+					if operr == nil && reflect {
+						operr = os.NewSyscallError("setsockopt", syscall.SetsockoptTimeval(int(fd), syscall.SOL_SOCKET,
+							syscall.SO_RCVTIMEO, &syscall.Timeval{Sec: sctpReflectionTimeout}))
 					}
 				},
 			)
-			return err
+			if err != nil {
+				return err
+			}
+			return operr
 		},
 		InitMsg: sctp.InitMsg{
 			NumOstreams:  uint16(numOfStreams),
@@ -82,46 +121,107 @@ func runClient(
 
 	laddr := &sctp.SCTPAddr{
 		IPAddrs: nil,
-		Port:    0,
+		Port:    sourcePort,
+	}
+	if sourceIP != "" {
+		source, err := netutils.ScopedIPAddr(sourceIP, interfaceName)
+		if err != nil {
+			return nil, err
+		}
+		laddr.IPAddrs = []net.IPAddr{*source}
 	}
 
 	network := fmt.Sprintf("ipv%d", protocolVersion)
 
 	conn, err := socketConfig.Dial(network, laddr, server)
 	if err != nil {
-		return fmt.Errorf("socketConfig.Dial() failed with error: %v", err)
+		return nil, fmt.Errorf("socketConfig.Dial() failed with error: %w", err)
 	}
 
 	buff := make([]byte, mtu)
 	info := &sctp.SndRcvInfo{}
 	n, err := conn.SCTPWrite(buff, info)
 	if err != nil {
-		return fmt.Errorf("conn.SCTPWrite failed with error: %v", err)
+		return nil, fmt.Errorf("conn.SCTPWrite failed with error: %w", err)
 	} else if n != mtu {
-		return errors.New("SCTPWrite() failed to write all of the buffer")
+		return nil, errors.New("SCTPWrite() failed to write all of the buffer")
+	}
+	if !reflect {
+		return nil, conn.Close()
 	}
 
-	return conn.Close()
+	reply := make([]byte, netutils.ReflectionMaxSize)
+	n, err = conn.Read(reply)
+	if err != nil && n == 0 {
+		conn.Close()
+		return nil, fmt.Errorf("conn.Read of the reflection failed with error: %w", err)
+	}
+	return reply[:n], conn.Close()
 }
 
-// RunTest runs the sctp test
-func (sctpTest *SCTPTest) RunTest() {
-	err := runClient(
+func (sctpTest *SCTPTest) testSCTP() error {
+	startTime := time.Now()
+	reply, err := runClient(
 		sctpTest.common.ServerIP,
 		sctpTest.ServerPort,
 		sctpTest.common.MTU,
-		"",
+		sctpTest.common.bindDevice(sctpTest.InterfaceName),
 		sctpTest.common.PackagesNumber,
-		sctpTest.common.ProtocolVersion)
+		sctpTest.common.ProtocolVersion,
+		sctpTest.common.SourceIP,
+		sctpTest.common.SourcePort,
+		sctpTest.common.Routing.Mark,
+		sctpTest.common.Reflect.Enabled)
+	sctpTest.common.recordPacket(err == nil, time.Since(startTime))
+	if err == nil && sctpTest.common.Reflect.Enabled {
+		sctpTest.common.recordReflection(reply)
+	}
+	return err
+}
+
+// WaitPeer waits until the server accepts sctp association, the probe sends single byte message
+func (sctpTest *SCTPTest) WaitPeer(timeout time.Duration) {
+	device := sctpTest.common.bindDevice(sctpTest.InterfaceName)
+	sctpTest.common.waitPeer(device, timeout, func() error {
+		_, err := runClient(
+			sctpTest.common.ServerIP,
+			sctpTest.ServerPort,
+			1,
+			device,
+			1,
+			sctpTest.common.ProtocolVersion,
+			sctpTest.common.SourceIP,
+			0,
+			sctpTest.common.Routing.Mark,
+			false)
+		return err
+	})
+}
+
+// Result returns statistics and details of the test run
+func (sctpTest *SCTPTest) Result() *Result {
+	return &sctpTest.common.Result
+}
+
+// Run runs the sctp test and returns error when the result does not match the expectation
+func (sctpTest *SCTPTest) Run() error {
+	err := sctpTest.common.runChecked(sctpTest.common.bindDevice(sctpTest.InterfaceName), sctpTest.testSCTP)
+	if sctpTest.common.Result.RouteErr != nil {
+		return sctpTest.common.Result.RouteErr
+	}
+	if sctpTest.common.Result.SetupErr != nil {
+		return sctpTest.common.Result.SetupErr
+	}
 	if sctpTest.common.Negative {
 		if err != nil {
 			log.Printf("SCTP test failed as expected with error: %v\n", err)
-			return
+			return nil
 		}
-		log.Fatalln("SCTP Negative test failed.")
+		return errors.New("SCTP Negative test failed")
 	}
 	if err != nil {
-		log.Fatalf("SCTP test failed with error: %v\n", err)
+		return fmt.Errorf("SCTP test failed with error: %w", err)
 	}
 	log.Println("SCTP test passed as expected")
+	return nil
 }
@@ -0,0 +1,27 @@
+package protocols
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestSCTPBindFailureIsSetupError(t *testing.T) {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, syscall.IPPROTO_SCTP)
+	if err != nil {
+		t.Skipf("sctp is not supported: %v", err)
+	}
+	syscall.Close(fd)
+
+	// 192.0.2.1 (TEST-NET-1) is not a local address, so binding it fails
+	test, err := NewSCTPTest(100, "127.0.0.1", 4, 5003, 1, true, "", "", "192.0.2.1", 0,
+		Routing{}, Reflect{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := test.Run(); err == nil {
+		t.Error("negative test with failed bind passed")
+	}
+	if test.Result().SetupErr == nil {
+		t.Error("bind failure is not reported as setup error")
+	}
+}
@@ -1,12 +1,16 @@
 package protocols
 
 import (
+	"bufio"
 	"fmt"
 	"log"
 	"net"
 	"os"
+	"strings"
 	"syscall"
 	"time"
+
+	"github.com/kononovn/testcmd/netutils"
 )
 
 const (
@@ -32,11 +36,17 @@ func NewTCPTest(
 	packagesNumber int,
 	negative bool,
 	timeout int,
-	interfaceName string) *TCPTest {
-	intFace, err := net.InterfaceByName(interfaceName)
+	interfaceName string,
+	vrfName string,
+	sourceIP string,
+	sourcePort int,
+	routing Routing,
+	reflect Reflect,
+	flows Flows,
+	diagnostics bool) (*TCPTest, error) {
+	intFace, err := netutils.ResolveInterface(interfaceName)
 	if err != nil {
-		fmt.Print(err)
-		os.Exit(1)
+		return nil, err
 	}
 	return &TCPTest{
 		InterfaceName: intFace,
@@ -48,35 +58,96 @@ func NewTCPTest(
 			ProtocolVersion: protocolVersion,
 			PackagesNumber:  packagesNumber,
 			Negative:        negative,
-		}}
+			SourceIP:        sourceIP,
+			SourcePort:      sourcePort,
+			VRF:             vrfName,
+			Routing:         routing,
+			Reflect:         reflect,
+			Flows:           flows,
+			Diagnostics:     diagnostics,
+		}}, nil
+}
+
+// probe opens and closes the connection to the server
+func (test *TCPTest) probe() error {
+	dialer := net.Dialer{
+		Timeout: waitPeerInterval,
+		Control: netutils.ControlSocket(test.common.bindDevice(test.interfaceName()), test.common.Routing.Mark),
+	}
+	source, err := test.common.sourceAddr(test.interfaceName())
+	if err != nil {
+		return err
+	}
+	if source != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: source.IP, Zone: source.Zone}
+	}
+	raddr, err := test.resolveAddress()
+	if err != nil {
+		return err
+	}
+	conn, err := dialer.Dial(fmt.Sprintf("%s%d", ProtocolTCP, test.common.ProtocolVersion), raddr.String())
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// WaitPeer waits until the server accepts connections
+func (test *TCPTest) WaitPeer(timeout time.Duration) {
+	test.common.waitPeer(test.common.bindDevice(test.interfaceName()), timeout, test.probe)
 }
 
-// RunTest runs the test
-func (test *TCPTest) RunTest() {
-	err := test.testTCP()
+// Result returns statistics and details of the test run
+func (test *TCPTest) Result() *Result {
+	return &test.common.Result
+}
+
+// Run runs the test and returns error when the result does not match the expectation
+func (test *TCPTest) Run() error {
+	err := test.common.runChecked(test.common.bindDevice(test.interfaceName()), test.testTCP)
+	if test.common.Result.RouteErr != nil {
+		return test.common.Result.RouteErr
+	}
+	if test.common.Result.SetupErr != nil {
+		return test.common.Result.SetupErr
+	}
 	if test.common.Negative {
 		if err != nil {
 			log.Print("Negative TCP test passed")
-			os.Exit(0)
+			return nil
 		}
-		log.Print("Negative TCP test failed")
-		os.Exit(1)
+		return fmt.Errorf("Negative TCP test failed")
 	}
-
 	if err == nil {
 		log.Print("TCP test passed as expected")
-		os.Exit(0)
+		return nil
 	}
-	log.Print("TCP test failed")
-	os.Exit(1)
+	return fmt.Errorf("TCP test failed: %w", err)
 }
 
 func (test *TCPTest) testTCP() error {
-	raddr := test.resolveAddress()
-	dialer := net.Dialer{Timeout: timeoutDialTCP * time.Second, Control: controlOnConnSetup(test.InterfaceName.Name)}
-	connection, err := dialer.Dial(
-		fmt.Sprintf("%s%d", ProtocolTCP, test.common.ProtocolVersion),
-		raddr.String())
+	raddr, err := test.resolveAddress()
+	if err != nil {
+		return err
+	}
+	dialer := net.Dialer{
+		Timeout: timeoutDialTCP * time.Second,
+		Control: netutils.ControlSocket(test.common.bindDevice(test.interfaceName()), test.common.Routing.Mark),
+	}
+	source, err := test.common.sourceAddr(test.interfaceName())
+	if err != nil {
+		return err
+	}
+	if source != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: source.IP, Zone: source.Zone, Port: test.common.SourcePort}
+	} else if test.common.SourcePort != 0 {
+		dialer.LocalAddr = &net.TCPAddr{Port: test.common.SourcePort}
+	}
+	network := fmt.Sprintf("%s%d", ProtocolTCP, test.common.ProtocolVersion)
+	if test.common.Flows.Enabled() {
+		return test.testFlows(dialer, network, raddr)
+	}
+	connection, err := dialer.Dial(network, raddr.String())
 
 	if err != nil {
 		return err
@@ -94,9 +165,34 @@ func (test *TCPTest) testTCP() error {
 		statPacketLost     int
 		statPacketReceived int
 	)
+	var reflectionReader *bufio.Reader
+	if test.common.Reflect.Enabled {
+		// reflection is line per server read, not the echo of the payload size
+		reflectionReader = bufio.NewReaderSize(connection, netutils.ReflectionMaxSize)
+	}
 	for i := 1; i <= test.common.PackagesNumber; i++ {
+		if test.common.Reflect.Tally && i > 1 {
+			// new connection of every package may be balanced to another backend
+			if connection != nil {
+				connection.Close()
+			}
+			connection, err = dialer.Dial(network, raddr.String())
+			if err != nil {
+				fmt.Printf("Connection failed: %v\n", err)
+				statPacketLost++
+				test.common.recordPacket(false, 0)
+				exitCode = 1
+				connection = nil
+				continue
+			}
+			reflectionReader = bufio.NewReaderSize(connection, netutils.ReflectionMaxSize)
+		}
 		byteTestString := []byte(testString)
-		test.runTCPPing(connection, i, byteTestString, &statPacketLost, &statPacketReceived, &statTotalTime, &exitCode)
+		test.runTCPPing(connection, reflectionReader, i, byteTestString, &statPacketLost, &statPacketReceived, &statTotalTime,
+			&exitCode)
+	}
+	if test.common.Reflect.Tally && connection != nil {
+		connection.Close()
 	}
 
 	fmt.Printf("--- %s TCP statistics ---\n", test.common.ServerIP)
@@ -108,13 +204,64 @@ func (test *TCPTest) testTCP() error {
 		statTotalTime)
 
 	if exitCode == 1 {
-		return fmt.Errorf("TCP connectivity test returns error code")
+		return test.common.packetsError("TCP connectivity test returns error code")
 	}
 	return nil
 }
 
+// testFlows sends the packages over connection of every flow
+func (test *TCPTest) testFlows(dialer net.Dialer, network string, raddr *net.TCPAddr) error {
+	byteTestString := []byte(strings.Repeat("a", test.common.MTU))
+	fmt.Printf("TCP PING %s %d(%d) bytes of data.\n",
+		test.common.ServerIP, test.common.MTU, test.common.MTU+28)
+	// source port of the previous run is still in TIME_WAIT when the port range is repeated
+	control := dialer.Control
+	dialer.Control = func(network string, address string, c syscall.RawConn) error {
+		var operr error
+		err := c.Control(func(fd uintptr) {
+			operr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+		})
+		if err == nil {
+			err = os.NewSyscallError("setsockopt", operr)
+		}
+		if err != nil {
+			return err
+		}
+		return control(network, address, c)
+	}
+	return test.common.runFlows(test.interfaceName(), func(source *net.IPAddr, port int) (net.Addr, error) {
+		local := &net.TCPAddr{Port: port}
+		if source != nil {
+			local.IP, local.Zone = source.IP, source.Zone
+		}
+		dialer.LocalAddr = local
+		connection, err := dialer.Dial(network, raddr.String())
+		if err != nil {
+			fmt.Printf("Connection from %s failed: %v\n", local, err)
+			return nil, err
+		}
+		defer connection.Close()
+		var reflectionReader *bufio.Reader
+		if test.common.Reflect.Enabled {
+			reflectionReader = bufio.NewReaderSize(connection, netutils.ReflectionMaxSize)
+		}
+		var (
+			statTotalTime      int64
+			exitCode           int
+			statPacketLost     int
+			statPacketReceived int
+		)
+		for i := 1; i <= test.common.PackagesNumber; i++ {
+			test.runTCPPing(connection, reflectionReader, i, byteTestString, &statPacketLost, &statPacketReceived,
+				&statTotalTime, &exitCode)
+		}
+		return connection.LocalAddr(), nil
+	})
+}
+
 func (test *TCPTest) runTCPPing(
 	conn net.Conn,
+	reflectionReader *bufio.Reader,
 	packetNumber int,
 	byteTestString []byte,
 	statPacketLost *int,
@@ -133,50 +280,51 @@ func (test *TCPTest) runTCPPing(
 	}
 
 	buffer := make([]byte, test.common.MTU)
-	readBufferSized, err := conn.Read(buffer)
+	var readBufferSized int
+	if reflectionReader != nil {
+		buffer, err = reflectionReader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			// echo of the payload, the reflection check reports it
+			err = nil
+		}
+		readBufferSized = len(buffer)
+	} else {
+		readBufferSized, err = conn.Read(buffer)
+	}
 	elapsed := time.Since(startTime)
 	if err != nil {
 		fmt.Printf("Package lost\n")
 		*statPacketLost++
+		test.common.recordPacket(false, 0)
 		*exitCode = 1
 		return
 	}
+	reflected := reflectionReader != nil || netutils.IsReflection(buffer[:readBufferSized])
+	if reflected {
+		test.common.recordReflection(buffer[:readBufferSized])
+	}
 
-	if string(buffer) == string(byteTestString) {
+	if reflected || string(buffer) == string(byteTestString) {
 		*statTotalTime += elapsed.Microseconds()
 		fmt.Printf("%d bytes from %s: tcp_seq=%d time=%dms\n",
 			readBufferSized, conn.RemoteAddr(), packetNumber, elapsed.Microseconds())
 		*statPacketReceived++
+		test.common.recordPacket(true, elapsed)
 	} else {
+		fmt.Printf("Package payload mismatch\n")
+		test.common.recordMismatch()
 		*exitCode = 1
 	}
 }
 
-func (test *TCPTest) resolveAddress() *net.TCPAddr {
-	addr, err := net.ResolveTCPAddr(fmt.Sprintf("%s%d", ProtocolTCP, test.common.ProtocolVersion),
-		fmt.Sprintf("[%s]:%d", test.common.ServerIP, test.ServerPort))
-	if err != nil {
-		fmt.Print(err)
-		os.Exit(1)
+func (test *TCPTest) interfaceName() string {
+	if test.InterfaceName == nil {
+		return ""
 	}
-	return addr
+	return test.InterfaceName.Name
 }
 
-func controlOnConnSetup(vrfName string) func(network string, address string, c syscall.RawConn) error {
-	return func(network string, address string, c syscall.RawConn) error {
-		if vrfName == "" {
-			return nil
-		}
-		var operr error
-		fn := func(fd uintptr) {
-			operr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, vrfName)
-		}
-		if err := c.Control(fn); err != nil {
-			return err
-		}
-		if operr != nil {
-			return operr
-		}
-		return nil
-	}
+func (test *TCPTest) resolveAddress() (*net.TCPAddr, error) {
+	return net.ResolveTCPAddr(fmt.Sprintf("%s%d", ProtocolTCP, test.common.ProtocolVersion),
+		fmt.Sprintf("[%s]:%d", test.common.ServerIP, test.ServerPort))
 }
@@ -0,0 +1,809 @@
+package protocols
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ishidawataru/sctp"
+	"github.com/kononovn/testcmd/netutils"
+)
+
+const (
+	// TraceTimeExceeded is the reply of the hop the probe expired at
+	TraceTimeExceeded = "time-exceeded"
+	// TraceReached is the reply of the destination
+	TraceReached = "reached"
+	// TraceUnreachable is destination unreachable reply of the hop dropping the probe
+	TraceUnreachable = "unreachable"
+	// TraceFragNeeded is fragmentation needed or packet too big reply of the hop with smaller MTU
+	TraceFragNeeded = "frag-needed"
+
+	traceProbesPerHop = 3
+	traceProbeTimeout = 1 * time.Second
+	traceReplyQueue   = 64
+
+	icmpv4DestinationUnreachable = 3
+	icmpv4TimeExceeded           = 11
+	icmpv4PortUnreachable        = 3
+	icmpv4FragmentationNeeded    = 4
+	icmpv6DestinationUnreachable = 1
+	icmpv6PacketTooBig           = 2
+	icmpv6TimeExceeded           = 3
+	icmpv6PortUnreachable        = 4
+
+	// routers not following RFC 4884 quote 128 bytes of the original datagram before the extension
+	icmpOriginalDatagramSize = 128
+	icmpExtensionVersion     = 2
+	icmpExtensionMPLSClass   = 1
+	icmpExtensionMPLSType    = 1
+)
+
+// TraceTest sends probes of the test protocol with increasing ttl/hop limit and collects ICMP errors of
+// the hops. The probes keep destination port, payload size and DF flag of the test: udp datagram,
+// tcp SYN, icmp echo request or sctp INIT
+type TraceTest struct {
+	common        CommonTest
+	Protocol      string
+	ServerPort    int
+	InterfaceName string
+	MaxHops       int
+	id            int
+}
+
+// TraceHop is the outcome of the probes sent with the same ttl
+type TraceHop struct {
+	TTL    int
+	Probes []TraceProbe
+}
+
+// TraceProbe is the reply of single probe, empty address is the probe without reply
+type TraceProbe struct {
+	Address string
+	RTT     time.Duration
+	Reply   string
+	// Code is ICMP code of unreachable reply
+	Code int
+	// MTU is the next-hop MTU of fragmentation needed reply
+	MTU int
+	// MPLS is the label stack the probe expired with, quoted by the hop in ICMP extension
+	MPLS []MPLSLabel
+}
+
+// MPLSLabel is single entry of the label stack, RFC 4950
+type MPLSLabel struct {
+	Label int
+	TC    int
+	S     bool
+	TTL   int
+}
+
+// traceReply is ICMP message read by the trace listener together with the fields of the quoted probe
+type traceReply struct {
+	from        *net.IPAddr
+	received    time.Time
+	reply       string
+	code        int
+	mtu         int
+	mpls        []MPLSLabel
+	echoReply   bool
+	protocol    int
+	destination net.IP
+	srcPort     int
+	dstPort     int
+	id          int
+	seq         int
+}
+
+// traceProbe is the probe in flight, zero source port matches ICMP errors quoting any port. Answered
+// receives the reply of the destination transport, nil or connection refused means the destination is reached
+type traceProbe struct {
+	sent     time.Time
+	srcPort  int
+	seq      int
+	answered chan error
+	close    func()
+}
+
+// NewTraceTest returns a new trace of the protocol
+func NewTraceTest(
+	protocol string,
+	mtu int,
+	protocolVersion int,
+	serverIP string,
+	serverPort int,
+	maxHops int,
+	interfaceName string,
+	vrfName string,
+	sourceIP string,
+	sourcePort int,
+	routing Routing) (*TraceTest, error) {
+	intFace, err := netutils.ResolveInterface(interfaceName)
+	if err != nil {
+		return nil, err
+	}
+	if intFace != nil {
+		interfaceName = intFace.Name
+	}
+	return &TraceTest{
+		Protocol:      protocol,
+		ServerPort:    serverPort,
+		InterfaceName: interfaceName,
+		MaxHops:       maxHops,
+		id:            nextICMPID(),
+		common: CommonTest{
+			MTU:             mtu,
+			ServerIP:        serverIP,
+			ProtocolVersion: protocolVersion,
+			SourceIP:        sourceIP,
+			SourcePort:      sourcePort,
+			VRF:             vrfName,
+			Routing:         routing,
+		}}, nil
+}
+
+// String returns MPLS label stack entry in traceroute notation
+func (label MPLSLabel) String() string {
+	bottom := 0
+	if label.S {
+		bottom = 1
+	}
+	return fmt.Sprintf("[MPLS: Lbl %d, TC %d, S %d, TTL %d]", label.Label, label.TC, bottom, label.TTL)
+}
+
+// setTTL sets ttl or hop limit of the packets sent by the socket
+func setTTL(fd int, protocolVersion int, ttl int) error {
+	var err error
+	if protocolVersion == 6 {
+		err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS, ttl)
+	} else {
+		err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_TTL, ttl)
+	}
+	if err != nil {
+		return fmt.Errorf("error define ttl %d %w", ttl, os.NewSyscallError("setsockopt", err))
+	}
+	return nil
+}
+
+// setDontFragment sets DF flag of the packets sent by the socket, IPv6 socket does not fragment locally
+func setDontFragment(fd int, protocolVersion int) error {
+	var err error
+	if protocolVersion == 6 {
+		err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_DO)
+	} else {
+		err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DO)
+	}
+	if err != nil {
+		return fmt.Errorf("error define MTU discovery flag %w", os.NewSyscallError("setsockopt", err))
+	}
+	return nil
+}
+
+// setProbeOptions binds the probe socket to the device and sets the mark, ttl and DF flag
+func (test *TraceTest) setProbeOptions(fd int, ttl int) error {
+	err := netutils.BindToDevice(fd, test.common.bindDevice(test.InterfaceName))
+	if err == nil {
+		err = netutils.SetMark(fd, test.common.Routing.Mark)
+	}
+	if err == nil {
+		err = setTTL(fd, test.common.ProtocolVersion, ttl)
+	}
+	if err == nil {
+		err = setDontFragment(fd, test.common.ProtocolVersion)
+	}
+	return err
+}
+
+// bindProbe binds the probe socket before connect and returns the bound source port, ICMP errors
+// quoting the probe are matched by the port
+func (test *TraceTest) bindProbe(fd int) (int, error) {
+	source, err := test.common.sourceAddr(test.InterfaceName)
+	if err != nil {
+		return 0, err
+	}
+	if source == nil {
+		source = &net.IPAddr{IP: net.IPv4zero}
+		if test.common.ProtocolVersion == 6 {
+			source = &net.IPAddr{IP: net.IPv6unspecified}
+		}
+	}
+	sa, err := sockaddr(source, test.common.ProtocolVersion)
+	if err != nil {
+		return 0, err
+	}
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		sa.Port = test.common.SourcePort
+	case *syscall.SockaddrInet6:
+		sa.Port = test.common.SourcePort
+	}
+	// probes reaching the destination with fixed source port leave the connection in TIME_WAIT
+	err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	if err != nil {
+		return 0, err
+	}
+	err = syscall.Bind(fd, sa)
+	if err != nil {
+		return 0, fmt.Errorf("can not bind source address %s port %d: %w", source.IP, test.common.SourcePort, err)
+	}
+	local, err := syscall.Getsockname(fd)
+	if err != nil {
+		return 0, err
+	}
+	switch local := local.(type) {
+	case *syscall.SockaddrInet4:
+		return local.Port, nil
+	case *syscall.SockaddrInet6:
+		return local.Port, nil
+	}
+	return 0, nil
+}
+
+// openListener opens raw icmp socket receiving the errors of the probes, icmp probes are sent by it too
+func (test *TraceTest) openListener() (icmpConn, error) {
+	icmpTest := &ICMPTest{common: test.common, InterfaceName: test.InterfaceName}
+	conn, err := icmpTest.openSocket()
+	if err != nil {
+		return nil, fmt.Errorf("%w, trace requires %s to receive icmp errors", err, netutils.CapabilityName(netutils.CapNetRaw))
+	}
+	return conn, nil
+}
+
+// listen reads ICMP messages until the listener is closed, replies are dropped when the queue is full
+func (test *TraceTest) listen(conn net.PacketConn, replies chan<- *traceReply) {
+	defer close(replies)
+	buffer := make([]byte, 65536)
+	for {
+		n, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		reply := test.parseReply(buffer[:n])
+		if reply == nil {
+			continue
+		}
+		reply.received = time.Now()
+		reply.from, _ = addr.(*net.IPAddr)
+		if reply.from == nil {
+			continue
+		}
+		select {
+		case replies <- reply:
+		default:
+		}
+	}
+}
+
+// parseReply parses echo reply or ICMP error quoting the probe, other messages return nil. The ip header
+// of the raw IPv4 socket is stripped by ReadFrom
+func (test *TraceTest) parseReply(msg []byte) *traceReply {
+	ipv6 := test.common.ProtocolVersion == 6
+	if len(msg) < icmpHeaderSize {
+		return nil
+	}
+	reply := &traceReply{code: int(msg[1])}
+	// length of the quoted datagram, RFC 4884
+	length := 0
+	switch {
+	case (!ipv6 && msg[0] == icmpv4EchoReply) || (ipv6 && msg[0] == icmpv6EchoReply):
+		reply.echoReply = true
+		reply.reply = TraceReached
+		reply.id = int(binary.BigEndian.Uint16(msg[4:6]))
+		reply.seq = int(binary.BigEndian.Uint16(msg[6:8]))
+		return reply
+	case !ipv6 && msg[0] == icmpv4TimeExceeded:
+		reply.reply = TraceTimeExceeded
+		length = int(msg[5]) * 4
+	case !ipv6 && msg[0] == icmpv4DestinationUnreachable:
+		reply.reply = TraceUnreachable
+		if reply.code == icmpv4FragmentationNeeded {
+			reply.reply = TraceFragNeeded
+			reply.mtu = int(binary.BigEndian.Uint16(msg[6:8]))
+		}
+		length = int(msg[5]) * 4
+	case ipv6 && msg[0] == icmpv6TimeExceeded:
+		reply.reply = TraceTimeExceeded
+		length = int(msg[4]) * 8
+	case ipv6 && msg[0] == icmpv6DestinationUnreachable:
+		reply.reply = TraceUnreachable
+		length = int(msg[4]) * 8
+	case ipv6 && msg[0] == icmpv6PacketTooBig:
+		reply.reply = TraceFragNeeded
+		reply.mtu = int(binary.BigEndian.Uint32(msg[4:8]))
+	default:
+		return nil
+	}
+	if !test.parseQuoted(reply, msg[icmpHeaderSize:]) {
+		return nil
+	}
+	reply.mpls = parseMPLSExtension(msg[icmpHeaderSize:], length)
+	return reply
+}
+
+// parseQuoted parses ip header and the first 8 bytes of the transport header of the quoted probe
+func (test *TraceTest) parseQuoted(reply *traceReply, quoted []byte) bool {
+	headerLen := ipv6HeaderSize
+	if test.common.ProtocolVersion == 6 {
+		if len(quoted) < ipv6HeaderSize {
+			return false
+		}
+		reply.protocol = int(quoted[6])
+		reply.destination = net.IP(quoted[24:40])
+	} else {
+		if len(quoted) < ipv4HeaderSize {
+			return false
+		}
+		headerLen = int(quoted[0]&0x0f) * 4
+		reply.protocol = int(quoted[9])
+		reply.destination = net.IP(quoted[16:20])
+	}
+	if len(quoted) < headerLen+8 {
+		return false
+	}
+	transport := quoted[headerLen:]
+	if reply.protocol == syscall.IPPROTO_ICMP || reply.protocol == syscall.IPPROTO_ICMPV6 {
+		reply.id = int(binary.BigEndian.Uint16(transport[4:6]))
+		reply.seq = int(binary.BigEndian.Uint16(transport[6:8]))
+		return true
+	}
+	reply.srcPort = int(binary.BigEndian.Uint16(transport[0:2]))
+	reply.dstPort = int(binary.BigEndian.Uint16(transport[2:4]))
+	return true
+}
+
+// parseMPLSExtension returns the label stack of ICMP extension following the quoted datagram, RFC 4884.
+// Zero length is the datagram quoted by router not following RFC 4884
+func parseMPLSExtension(payload []byte, length int) []MPLSLabel {
+	if length == 0 {
+		length = icmpOriginalDatagramSize
+	}
+	if len(payload) < length+4 || payload[length]>>4 != icmpExtensionVersion {
+		return nil
+	}
+	var labels []MPLSLabel
+	objects := payload[length+4:]
+	for len(objects) >= 4 {
+		objectLen := int(binary.BigEndian.Uint16(objects[0:2]))
+		if objectLen < 4 || objectLen > len(objects) {
+			break
+		}
+		if objects[2] == icmpExtensionMPLSClass && objects[3] == icmpExtensionMPLSType {
+			for entry := objects[4:objectLen]; len(entry) >= 4; entry = entry[4:] {
+				value := binary.BigEndian.Uint32(entry[0:4])
+				labels = append(labels, MPLSLabel{
+					Label: int(value >> 12),
+					TC:    int(value>>9) & 0x7,
+					S:     value>>8&0x1 == 1,
+					TTL:   int(value & 0xff),
+				})
+			}
+		}
+		objects = objects[objectLen:]
+	}
+	return labels
+}
+
+// transportProtocol returns ip protocol number of the probes
+func (test *TraceTest) transportProtocol() int {
+	switch test.Protocol {
+	case ProtocolUDP:
+		return syscall.IPPROTO_UDP
+	case ProtocolTCP:
+		return syscall.IPPROTO_TCP
+	case ProtocolSCTP:
+		return syscall.IPPROTO_SCTP
+	}
+	if test.common.ProtocolVersion == 6 {
+		return syscall.IPPROTO_ICMPV6
+	}
+	return syscall.IPPROTO_ICMP
+}
+
+// matches reports the reply to the probe: echo reply with its id and seq or ICMP error quoting the probe
+func (test *TraceTest) matches(reply *traceReply, probe *traceProbe) bool {
+	if reply.echoReply {
+		return test.Protocol == ProtocolICMP && reply.id == test.id && reply.seq == probe.seq
+	}
+	if reply.protocol != test.transportProtocol() || !reply.destination.Equal(netutils.ParseIP(test.common.ServerIP)) {
+		return false
+	}
+	if test.Protocol == ProtocolICMP {
+		return reply.id == test.id && reply.seq == probe.seq
+	}
+	return reply.dstPort == test.ServerPort && (probe.srcPort == 0 || reply.srcPort == probe.srcPort)
+}
+
+// sendProbe sends single probe with the ttl
+func (test *TraceTest) sendProbe(conn icmpConn, ttl int, seq int) (*traceProbe, error) {
+	switch test.Protocol {
+	case ProtocolICMP:
+		return test.sendEchoProbe(conn, ttl, seq)
+	case ProtocolUDP:
+		return test.sendUDPProbe(ttl)
+	case ProtocolTCP:
+		return test.sendTCPProbe(ttl)
+	case ProtocolSCTP:
+		return test.sendSCTPProbe(ttl)
+	}
+	return nil, fmt.Errorf("trace does not support protocol %s", test.Protocol)
+}
+
+// sendEchoProbe sends echo request of the test size by the listener socket
+func (test *TraceTest) sendEchoProbe(conn icmpConn, ttl int, seq int) (*traceProbe, error) {
+	raddr, err := net.ResolveIPAddr(fmt.Sprintf("ip%d", test.common.ProtocolVersion), test.common.ServerIP)
+	if err != nil {
+		return nil, err
+	}
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var operr error
+	err = rawConn.Control(func(fd uintptr) {
+		operr = setTTL(int(fd), test.common.ProtocolVersion, ttl)
+	})
+	if err == nil {
+		err = operr
+	}
+	if err != nil {
+		return nil, err
+	}
+	icmpTest := &ICMPTest{common: test.common}
+	request := icmpTest.echoRequest(test.id, seq, bytes.Repeat([]byte("a"), test.common.MTU))
+	probe := &traceProbe{seq: seq, sent: time.Now(), close: func() {}}
+	_, err = conn.WriteTo(request, raddr)
+	if err != nil {
+		return nil, err
+	}
+	return probe, nil
+}
+
+// sendUDPProbe sends datagram of the test size, the reply of the echo server reaches the destination
+func (test *TraceTest) sendUDPProbe(ttl int) (*traceProbe, error) {
+	dialer := net.Dialer{Control: func(network string, address string, c syscall.RawConn) error {
+		var operr error
+		err := c.Control(func(fd uintptr) {
+			operr = test.setProbeOptions(int(fd), ttl)
+		})
+		if err != nil {
+			return err
+		}
+		return operr
+	}}
+	source, err := test.common.sourceAddr(test.InterfaceName)
+	if err != nil {
+		return nil, err
+	}
+	if source != nil || test.common.SourcePort != 0 {
+		laddr := &net.UDPAddr{Port: test.common.SourcePort}
+		if source != nil {
+			laddr.IP, laddr.Zone = source.IP, source.Zone
+		}
+		dialer.LocalAddr = laddr
+	}
+	conn, err := dialer.Dial(fmt.Sprintf("udp%d", test.common.ProtocolVersion),
+		net.JoinHostPort(test.common.ServerIP, fmt.Sprint(test.ServerPort)))
+	if err != nil {
+		return nil, err
+	}
+	probe := &traceProbe{
+		srcPort:  conn.LocalAddr().(*net.UDPAddr).Port,
+		answered: make(chan error, 1),
+		close:    func() { conn.Close() },
+		sent:     time.Now(),
+	}
+	_, err = conn.Write(bytes.Repeat([]byte("a"), test.common.MTU))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go func() {
+		conn.SetReadDeadline(probe.sent.Add(traceProbeTimeout))
+		_, err := conn.Read(make([]byte, test.common.MTU+1))
+		probe.answered <- err
+	}()
+	return probe, nil
+}
+
+// sendTCPProbe sends SYN, SYN-ACK or RST of the destination answers it
+func (test *TraceTest) sendTCPProbe(ttl int) (*traceProbe, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), traceProbeTimeout)
+	address := net.JoinHostPort(test.common.ServerIP, fmt.Sprint(test.ServerPort))
+	probe, err := test.dialProbe(ttl, true, func(control func(string, string, syscall.RawConn) error) error {
+		dialer := net.Dialer{Control: control}
+		conn, err := dialer.DialContext(ctx, fmt.Sprintf("tcp%d", test.common.ProtocolVersion), address)
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	})
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	probe.close = cancel
+	return probe, nil
+}
+
+// sendSCTPProbe sends INIT without retransmission, INIT-ACK or ABORT of the destination answers it. The
+// source port is bound by connect, so ICMP errors are matched by the destination port unless -source-port is set
+func (test *TraceTest) sendSCTPProbe(ttl int) (*traceProbe, error) {
+	raddr, err := net.ResolveIPAddr(fmt.Sprintf("ip%d", test.common.ProtocolVersion), test.common.ServerIP)
+	if err != nil {
+		return nil, err
+	}
+	server := &sctp.SCTPAddr{IPAddrs: []net.IPAddr{*raddr}, Port: test.ServerPort}
+	laddr := &sctp.SCTPAddr{Port: test.common.SourcePort}
+	source, err := test.common.sourceAddr(test.InterfaceName)
+	if err != nil {
+		return nil, err
+	}
+	if source != nil {
+		laddr.IPAddrs = []net.IPAddr{*source}
+	}
+	probe, err := test.dialProbe(ttl, false, func(control func(string, string, syscall.RawConn) error) error {
+		socketConfig := &sctp.SocketConfig{
+			Control: control,
+			InitMsg: sctp.InitMsg{
+				NumOstreams:    1,
+				MaxInstreams:   1,
+				MaxAttempts:    1,
+				MaxInitTimeout: uint16(traceProbeTimeout / time.Millisecond),
+			},
+		}
+		conn, err := socketConfig.Dial(fmt.Sprintf("ipv%d", test.common.ProtocolVersion), laddr, server)
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	probe.close = func() {}
+	return probe, nil
+}
+
+// dialProbe dials the connection in background, errors of the socket setup are returned before the
+// probe is sent. The source port is bound before connect if requested
+func (test *TraceTest) dialProbe(ttl int, bind bool, dial func(control func(string, string, syscall.RawConn) error) error) (*traceProbe, error) {
+	probe := &traceProbe{srcPort: test.common.SourcePort, answered: make(chan error, 1)}
+	ready := make(chan error, 1)
+	control := func(network string, address string, c syscall.RawConn) error {
+		var operr error
+		err := c.Control(func(fd uintptr) {
+			operr = test.setProbeOptions(int(fd), ttl)
+			if operr == nil && bind {
+				probe.srcPort, operr = test.bindProbe(int(fd))
+			}
+		})
+		if err == nil {
+			err = operr
+		}
+		probe.sent = time.Now()
+		select {
+		case ready <- err:
+		default:
+		}
+		return err
+	}
+	go func() {
+		err := dial(control)
+		// dial failed before the socket setup
+		select {
+		case ready <- err:
+		default:
+		}
+		probe.answered <- err
+	}()
+	err := <-ready
+	if err != nil {
+		return nil, err
+	}
+	return probe, nil
+}
+
+// wait waits for the reply of the probe until the timeout expires
+func (test *TraceTest) wait(replies <-chan *traceReply, probe *traceProbe) TraceProbe {
+	timer := time.NewTimer(traceProbeTimeout)
+	defer timer.Stop()
+	answered := probe.answered
+	for {
+		select {
+		case reply, ok := <-replies:
+			if !ok {
+				return TraceProbe{}
+			}
+			if test.matches(reply, probe) {
+				return test.traceProbe(reply, probe)
+			}
+		case err := <-answered:
+			if err == nil || errors.Is(err, syscall.ECONNREFUSED) {
+				return TraceProbe{Address: test.common.ServerIP, RTT: time.Since(probe.sent), Reply: TraceReached}
+			}
+			// ICMP error aborting the connection is read by the listener
+			answered = nil
+		case <-timer.C:
+			return TraceProbe{}
+		}
+	}
+}
+
+// traceProbe returns the probe outcome of the reply, port unreachable of the destination reaches it
+func (test *TraceTest) traceProbe(reply *traceReply, probe *traceProbe) TraceProbe {
+	result := TraceProbe{
+		Address: reply.from.String(),
+		RTT:     reply.received.Sub(probe.sent),
+		Reply:   reply.reply,
+		MTU:     reply.mtu,
+		MPLS:    reply.mpls,
+	}
+	portUnreachable := icmpv4PortUnreachable
+	if test.common.ProtocolVersion == 6 {
+		portUnreachable = icmpv6PortUnreachable
+	}
+	if reply.reply == TraceUnreachable {
+		result.Code = reply.code
+		if reply.code == portUnreachable && reply.from.IP.Equal(netutils.ParseIP(test.common.ServerIP)) {
+			result.Reply = TraceReached
+		}
+	}
+	return result
+}
+
+// annotation returns traceroute notation of the unreachable and fragmentation needed replies
+func (test *TraceTest) annotation(probe *TraceProbe) string {
+	if probe.Reply == TraceFragNeeded {
+		return fmt.Sprintf("!F=%d", probe.MTU)
+	}
+	if probe.Reply != TraceUnreachable {
+		return ""
+	}
+	codes := map[int]string{0: "!N", 1: "!H", 2: "!P", 3: "!U", 9: "!X", 10: "!X", 13: "!X"}
+	if test.common.ProtocolVersion == 6 {
+		codes = map[int]string{0: "!N", 1: "!X", 3: "!H", 4: "!U", 5: "!X", 6: "!X"}
+	}
+	if annotation, ok := codes[probe.Code]; ok {
+		return annotation
+	}
+	return fmt.Sprintf("!<%d>", probe.Code)
+}
+
+// printHop prints the hop in traceroute notation, the address is repeated when the probes take another path
+func (test *TraceTest) printHop(hop *TraceHop) {
+	var line strings.Builder
+	fmt.Fprintf(&line, "%2d ", hop.TTL)
+	address, labels := "", ""
+	var stacks []string
+	for i := range hop.Probes {
+		probe := &hop.Probes[i]
+		if probe.Address == "" {
+			line.WriteString(" *")
+			continue
+		}
+		if probe.Address != address {
+			address = probe.Address
+			fmt.Fprintf(&line, " %s", address)
+		}
+		fmt.Fprintf(&line, "  %.3f ms", float64(probe.RTT.Microseconds())/1000)
+		if annotation := test.annotation(probe); annotation != "" {
+			fmt.Fprintf(&line, " %s", annotation)
+		}
+		stack := make([]string, 0, len(probe.MPLS))
+		for _, label := range probe.MPLS {
+			stack = append(stack, label.String())
+		}
+		if len(stack) > 0 && strings.Join(stack, " ") != labels {
+			labels = strings.Join(stack, " ")
+			stacks = append(stacks, labels)
+		}
+	}
+	fmt.Println(line.String())
+	for _, stack := range stacks {
+		fmt.Printf("     %s\n", stack)
+	}
+}
+
+// hopError returns nil when the destination is reached, error when the hop dropped the probes and
+// done is false when the trace continues with the next hop
+func (test *TraceTest) hopError(hop *TraceHop) (done bool, err error) {
+	for i := range hop.Probes {
+		probe := &hop.Probes[i]
+		if probe.Reply == TraceReached {
+			return true, nil
+		}
+	}
+	for i := range hop.Probes {
+		probe := &hop.Probes[i]
+		switch probe.Reply {
+		case TraceFragNeeded:
+			return true, fmt.Errorf("hop %d %s needs fragmentation, next-hop MTU %d is smaller than the probe",
+				hop.TTL, probe.Address, probe.MTU)
+		case TraceUnreachable:
+			return true, fmt.Errorf("hop %d %s reported destination unreachable %s", hop.TTL, probe.Address,
+				test.annotation(probe))
+		}
+	}
+	return false, nil
+}
+
+func (test *TraceTest) trace() error {
+	conn, err := test.openListener()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	replies := make(chan *traceReply, traceReplyQueue)
+	go test.listen(conn, replies)
+
+	fmt.Printf("TRACE %s %s port %d, %d bytes payload, %d hops max\n", strings.ToUpper(test.Protocol),
+		test.common.ServerIP, test.ServerPort, test.common.MTU, test.MaxHops)
+	seq := 0
+	for ttl := 1; ttl <= test.MaxHops; ttl++ {
+		hop := TraceHop{TTL: ttl}
+		for i := 0; i < traceProbesPerHop; i++ {
+			seq++
+			probe, err := test.sendProbe(conn, ttl, seq)
+			if errors.Is(err, syscall.EMSGSIZE) {
+				err = fmt.Errorf("%w, the payload exceeds path MTU of the local route", err)
+			}
+			if err != nil {
+				if len(hop.Probes) > 0 {
+					test.common.Result.Trace = append(test.common.Result.Trace, hop)
+					test.printHop(&hop)
+				}
+				return fmt.Errorf("probe with ttl %d not sent: %w", ttl, err)
+			}
+			hop.Probes = append(hop.Probes, test.wait(replies, probe))
+			probe.close()
+			// the kernel keeps the next-hop MTU, further probes of the size fail locally
+			if hop.Probes[len(hop.Probes)-1].Reply == TraceFragNeeded {
+				break
+			}
+		}
+		test.common.Result.Trace = append(test.common.Result.Trace, hop)
+		test.printHop(&hop)
+		done, err := test.hopError(&hop)
+		if done {
+			if err == nil {
+				fmt.Printf("--- %s reached in %d hops ---\n", test.common.ServerIP, ttl)
+			}
+			return err
+		}
+	}
+	return fmt.Errorf("destination %s not reached within %d hops", test.common.ServerIP, test.MaxHops)
+}
+
+// WaitPeer does not wait, the trace looks for the hop the path breaks at
+func (test *TraceTest) WaitPeer(timeout time.Duration) {
+	log.Printf("Parameter -wait-peer ignored in trace mode")
+}
+
+// Result returns the hops of the trace
+func (test *TraceTest) Result() *Result {
+	return &test.common.Result
+}
+
+// Run runs the trace and returns error when the destination is not reached
+func (test *TraceTest) Run() error {
+	err := test.common.runChecked(test.common.bindDevice(test.InterfaceName), test.trace)
+	if test.common.Result.RouteErr != nil {
+		return test.common.Result.RouteErr
+	}
+	if test.common.Result.SetupErr != nil {
+		return test.common.Result.SetupErr
+	}
+	if err != nil {
+		return fmt.Errorf("%s trace failed with error: %w", strings.ToUpper(test.Protocol), err)
+	}
+	log.Printf("%s trace reached %s", strings.ToUpper(test.Protocol), test.common.ServerIP)
+	return nil
+}
@@ -0,0 +1,154 @@
+package protocols
+
+import (
+	"encoding/binary"
+	"net"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+// mplsObject returns RFC 4950 MPLS label stack object with the labels
+func mplsObject(labels ...MPLSLabel) []byte {
+	object := make([]byte, 4, 4+4*len(labels))
+	binary.BigEndian.PutUint16(object[0:2], uint16(4+4*len(labels)))
+	object[2] = icmpExtensionMPLSClass
+	object[3] = icmpExtensionMPLSType
+	for _, label := range labels {
+		value := uint32(label.Label)<<12 | uint32(label.TC)<<9 | uint32(label.TTL)
+		if label.S {
+			value |= 1 << 8
+		}
+		object = binary.BigEndian.AppendUint32(object, value)
+	}
+	return object
+}
+
+// extendedPayload returns quoted datagram of the length followed by RFC 4884 extension with the objects
+func extendedPayload(length int, objects ...[]byte) []byte {
+	payload := make([]byte, length, length+4)
+	payload = append(payload, icmpExtensionVersion<<4, 0, 0, 0)
+	for _, object := range objects {
+		payload = append(payload, object...)
+	}
+	return payload
+}
+
+func TestParseMPLSExtension(t *testing.T) {
+	top := MPLSLabel{Label: 16001, TC: 5, TTL: 254}
+	bottom := MPLSLabel{Label: 24, S: true, TTL: 1}
+	otherObject := []byte{0, 8, 2, 1, 0, 0, 0, 1}
+	tests := []struct {
+		name    string
+		payload []byte
+		length  int
+		want    []MPLSLabel
+	}{
+		{name: "label stack", payload: extendedPayload(128, mplsObject(top, bottom)), length: 128,
+			want: []MPLSLabel{top, bottom}},
+		{name: "router not following RFC 4884", payload: extendedPayload(128, mplsObject(bottom)), length: 0,
+			want: []MPLSLabel{bottom}},
+		{name: "longer quoted datagram", payload: extendedPayload(136, mplsObject(bottom)), length: 136,
+			want: []MPLSLabel{bottom}},
+		{name: "other object first", payload: extendedPayload(128, otherObject, mplsObject(top)), length: 128,
+			want: []MPLSLabel{top}},
+		{name: "no extension", payload: make([]byte, 128), length: 128, want: nil},
+		{name: "truncated extension header", payload: extendedPayload(128)[:130], length: 128, want: nil},
+		{name: "wrong extension version", payload: append(make([]byte, 128), 1<<4, 0, 0, 0), length: 128,
+			want: nil},
+		{name: "length beyond payload", payload: extendedPayload(128, mplsObject(top)), length: 256, want: nil},
+		{name: "truncated object header", payload: extendedPayload(128, mplsObject(top)[:2]), length: 128,
+			want: nil},
+		{name: "object longer than payload", payload: extendedPayload(128, mplsObject(top, bottom)[:8]),
+			length: 128, want: nil},
+		{name: "zero object length", payload: extendedPayload(128, []byte{0, 0, 1, 1, 0, 0, 0, 0}),
+			length: 128, want: nil},
+		{name: "partial label entry", payload: extendedPayload(128, []byte{0, 6, 1, 1, 0x03, 0xe8, 0, 0}),
+			length: 128, want: nil},
+		{name: "truncated second object", payload: extendedPayload(128, mplsObject(top), mplsObject(bottom)[:6]),
+			length: 128, want: []MPLSLabel{top}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseMPLSExtension(tt.payload, tt.length)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseMPLSExtension() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// quotedIPv4 returns quoted ipv4 datagram with the header length, protocol, destination and transport header
+func quotedIPv4(headerLen int, protocol int, destination string, transport []byte) []byte {
+	quoted := make([]byte, headerLen, headerLen+len(transport))
+	quoted[0] = 0x40 | byte(headerLen/4)
+	quoted[9] = byte(protocol)
+	copy(quoted[16:20], net.ParseIP(destination).To4())
+	return append(quoted, transport...)
+}
+
+// quotedIPv6 returns quoted ipv6 datagram with the next header, destination and transport header
+func quotedIPv6(protocol int, destination string, transport []byte) []byte {
+	quoted := make([]byte, ipv6HeaderSize, ipv6HeaderSize+len(transport))
+	quoted[0] = 0x60
+	quoted[6] = byte(protocol)
+	copy(quoted[24:40], net.ParseIP(destination).To16())
+	return append(quoted, transport...)
+}
+
+func TestParseQuoted(t *testing.T) {
+	// source port 33434, destination port 5001
+	udpHeader := []byte{0x82, 0x9a, 0x13, 0x89, 0, 8, 0, 0}
+	// echo request id 0x1234, seq 7
+	echoHeader := []byte{8, 0, 0, 0, 0x12, 0x34, 0, 7}
+	tests := []struct {
+		name            string
+		protocolVersion int
+		quoted          []byte
+		ok              bool
+		want            traceReply
+	}{
+		{name: "ipv4 udp", protocolVersion: 4, quoted: quotedIPv4(20, syscall.IPPROTO_UDP, "10.10.0.2", udpHeader),
+			ok: true, want: traceReply{protocol: syscall.IPPROTO_UDP, destination: net.ParseIP("10.10.0.2").To4(),
+				srcPort: 33434, dstPort: 5001}},
+		{name: "ipv4 options", protocolVersion: 4, quoted: quotedIPv4(24, syscall.IPPROTO_UDP, "10.10.0.2", udpHeader),
+			ok: true, want: traceReply{protocol: syscall.IPPROTO_UDP, destination: net.ParseIP("10.10.0.2").To4(),
+				srcPort: 33434, dstPort: 5001}},
+		{name: "ipv4 icmp", protocolVersion: 4, quoted: quotedIPv4(20, syscall.IPPROTO_ICMP, "10.10.0.2", echoHeader),
+			ok: true, want: traceReply{protocol: syscall.IPPROTO_ICMP, destination: net.ParseIP("10.10.0.2").To4(),
+				id: 0x1234, seq: 7}},
+		{name: "ipv4 truncated header", protocolVersion: 4,
+			quoted: quotedIPv4(20, syscall.IPPROTO_UDP, "10.10.0.2", nil)[:19]},
+		{name: "ipv4 truncated transport", protocolVersion: 4,
+			quoted: quotedIPv4(20, syscall.IPPROTO_UDP, "10.10.0.2", udpHeader[:7])},
+		{name: "ipv4 options truncated transport", protocolVersion: 4,
+			quoted: quotedIPv4(24, syscall.IPPROTO_UDP, "10.10.0.2", udpHeader[:4])},
+		{name: "ipv6 udp", protocolVersion: 6, quoted: quotedIPv6(syscall.IPPROTO_UDP, "fd10::2", udpHeader),
+			ok: true, want: traceReply{protocol: syscall.IPPROTO_UDP, destination: net.ParseIP("fd10::2"),
+				srcPort: 33434, dstPort: 5001}},
+		{name: "ipv6 icmp", protocolVersion: 6, quoted: quotedIPv6(syscall.IPPROTO_ICMPV6, "fd10::2", echoHeader),
+			ok: true, want: traceReply{protocol: syscall.IPPROTO_ICMPV6, destination: net.ParseIP("fd10::2"),
+				id: 0x1234, seq: 7}},
+		{name: "ipv6 truncated header", protocolVersion: 6,
+			quoted: quotedIPv6(syscall.IPPROTO_UDP, "fd10::2", nil)[:39]},
+		{name: "ipv6 truncated transport", protocolVersion: 6,
+			quoted: quotedIPv6(syscall.IPPROTO_UDP, "fd10::2", udpHeader[:7])},
+		{name: "empty", protocolVersion: 4, quoted: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			test := &TraceTest{common: CommonTest{ProtocolVersion: tt.protocolVersion}}
+			reply := &traceReply{}
+			ok := test.parseQuoted(reply, tt.quoted)
+			if ok != tt.ok {
+				t.Fatalf("parseQuoted() = %v, want %v", ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+			if !reflect.DeepEqual(*reply, tt.want) {
+				t.Errorf("parseQuoted() reply = %+v, want %+v", *reply, tt.want)
+			}
+		})
+	}
+}
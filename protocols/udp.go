@@ -2,11 +2,16 @@ package protocols
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"log"
 	"net"
 	"os"
+	"strings"
 	"syscall"
 	"time"
+
+	"github.com/kononovn/testcmd/netutils"
 )
 
 const (
@@ -22,6 +27,12 @@ type UDPTest struct {
 	Broadcast     bool
 	Timeout       time.Duration
 	InterfaceName *net.Interface
+	// ExpectPackets is the number of packets the multicast/broadcast receiver waits for from ExpectFrom
+	// sources within ExpectWithin or with timeout per packet if not set, other packets are counted as
+	// unexpected. Zero keeps receiving the packages number with timeout per packet
+	ExpectPackets int
+	ExpectFrom    *net.IPNet
+	ExpectWithin  time.Duration
 }
 
 // NewUDPTest creates new instance of ConnectivityTestParameters
@@ -35,14 +46,17 @@ func NewUDPTest(
 	multicast bool,
 	broadcast bool,
 	timeout int,
-	interfaceName string) *UDPTest {
-	intFace, err := net.InterfaceByName(interfaceName)
-	if err != nil && multicast {
-		fmt.Print(err)
-		os.Exit(1)
-	}
+	interfaceName string,
+	vrfName string,
+	sourceIP string,
+	sourcePort int,
+	routing Routing,
+	reflect Reflect,
+	flows Flows,
+	diagnostics bool) (*UDPTest, error) {
+	intFace, err := netutils.ResolveInterface(interfaceName)
 	if err != nil {
-		intFace = nil
+		return nil, err
 	}
 	return &UDPTest{
 		InterfaceName: intFace,
@@ -56,17 +70,26 @@ func NewUDPTest(
 			ProtocolVersion: protocolVersion,
 			PackagesNumber:  packagesNumber,
 			Negative:        negative,
-		}}
+			SourceIP:        sourceIP,
+			SourcePort:      sourcePort,
+			VRF:             vrfName,
+			Routing:         routing,
+			Reflect:         reflect,
+			Flows:           flows,
+			Diagnostics:     diagnostics,
+		}}, nil
 }
 
-func (test *UDPTest) resolveAddress() *net.UDPAddr {
-	addr, err := net.ResolveUDPAddr(fmt.Sprintf("%s%d", ProtocolUDP, test.common.ProtocolVersion),
-		fmt.Sprintf("[%s]:%d", test.common.ServerIP, test.ServerPort))
-	if err != nil {
-		fmt.Print(err)
-		os.Exit(1)
+func (test *UDPTest) interfaceName() string {
+	if test.InterfaceName == nil {
+		return ""
 	}
-	return addr
+	return test.InterfaceName.Name
+}
+
+func (test *UDPTest) resolveAddress() (*net.UDPAddr, error) {
+	return net.ResolveUDPAddr(fmt.Sprintf("%s%d", ProtocolUDP, test.common.ProtocolVersion),
+		fmt.Sprintf("[%s]:%d", test.common.ServerIP, test.ServerPort))
 }
 
 func (test *UDPTest) runUDPPing(
@@ -76,29 +99,30 @@ func (test *UDPTest) runUDPPing(
 	statPacketLost *int,
 	statPacketReceived *int,
 	statTotalTime *int64,
-	exitCode *int) {
+	exitCode *int) error {
 
 	time.Sleep(1 * time.Second)
 	buffer := make([]byte, test.common.MTU)
+	if test.common.Reflect.Enabled && len(buffer) < netutils.ReflectionMaxSize {
+		buffer = make([]byte, netutils.ReflectionMaxSize)
+	}
 	startTime := time.Now()
 	deadline := time.Now().Add(test.Timeout * time.Second)
 	conn.SetDeadline(deadline)
 	f, err := conn.File()
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		return err
 	}
-	timeVal := new(syscall.Timeval)
-	timeVal.Sec = int64(test.Timeout)
-	err = syscall.SetsockoptTimeval(int(f.Fd()), syscall.SOL_SOCKET, syscall.SO_SNDTIMEO, timeVal)
+	defer f.Close()
+	// Timeval fields are 32-bit on 32-bit architectures
+	timeVal := syscall.NsecToTimeval(int64(test.Timeout * time.Second))
+	err = syscall.SetsockoptTimeval(int(f.Fd()), syscall.SOL_SOCKET, syscall.SO_SNDTIMEO, &timeVal)
 	if err != nil {
-		fmt.Printf("Error define send timeout %s", err)
-		os.Exit(1)
+		return fmt.Errorf("Error define send timeout %w", os.NewSyscallError("setsockopt", err))
 	}
-	err = syscall.SetsockoptTimeval(int(f.Fd()), syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, timeVal)
+	err = syscall.SetsockoptTimeval(int(f.Fd()), syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &timeVal)
 	if err != nil {
-		fmt.Printf("Error define DF receive timeout %s", err)
-		os.Exit(1)
+		return fmt.Errorf("Error define DF receive timeout %w", os.NewSyscallError("setsockopt", err))
 	}
 	if test.common.ProtocolVersion == 4 {
 		err = syscall.SetsockoptInt(int(f.Fd()), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DO)
@@ -106,41 +130,74 @@ func (test *UDPTest) runUDPPing(
 		err = syscall.SetsockoptInt(int(f.Fd()), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_DO)
 	}
 	if err != nil {
-		fmt.Printf("Error define MTU discovery flag %s", err)
-		os.Exit(1)
+		return fmt.Errorf("Error define MTU discovery flag %w", os.NewSyscallError("setsockopt", err))
 	}
 	_, err = conn.Write(byteTestString)
 	elapsed := time.Since(startTime)
 	if err != nil {
 		fmt.Println(err)
+		test.common.readErrorQueue(conn)
 		*statTotalTime += elapsed.Microseconds()
 		*statPacketLost++
+		test.common.recordPacket(false, 0)
 		*exitCode = 1
-		return
+		return nil
 	}
 	bnumber, addr, err := conn.ReadFromUDP(buffer)
+	elapsed = time.Since(startTime)
 	if err != nil {
 		fmt.Printf("Package lost\n")
+		test.common.readErrorQueue(conn)
 		*statPacketLost++
+		test.common.recordPacket(false, 0)
 		*exitCode = 1
-		return
+		return nil
+	}
+	reflected := test.common.Reflect.Enabled || netutils.IsReflection(buffer[:bnumber])
+	if reflected {
+		test.common.recordReflection(buffer[:bnumber])
 	}
 	receivedFromServerString := string(bytes.Trim(buffer, "\x00"))
-	if receivedFromServerString == string(byteTestString) {
+	if reflected || receivedFromServerString == string(byteTestString) {
 		*statTotalTime += elapsed.Microseconds()
 		fmt.Printf("%d bytes from %s: udp_seq=%d time=%dms\n", bnumber, addr, packetNumber, elapsed.Microseconds())
 		*statPacketReceived++
+		test.common.recordPacket(true, elapsed)
+	} else {
+		fmt.Printf("Package payload mismatch\n")
+		test.common.recordMismatch()
+		*exitCode = 1
 	}
+	return nil
 }
 
 func (test *UDPTest) testUnicastUDP() error {
-	raddr := test.resolveAddress()
-	conn, err := net.DialUDP(fmt.Sprintf("%s%d", ProtocolUDP, test.common.ProtocolVersion), nil, raddr)
+	raddr, err := test.resolveAddress()
 	if err != nil {
-		fmt.Print(err)
-		os.Exit(1)
+		return err
 	}
-	defer conn.Close()
+	var laddr *net.UDPAddr
+	source, err := test.common.sourceAddr(test.interfaceName())
+	if err != nil {
+		return err
+	}
+	if source != nil {
+		laddr = &net.UDPAddr{IP: source.IP, Zone: source.Zone, Port: test.common.SourcePort}
+	} else if test.common.SourcePort != 0 {
+		laddr = &net.UDPAddr{Port: test.common.SourcePort}
+	}
+	dialer := net.Dialer{Control: netutils.ControlSocket(test.common.bindDevice(test.interfaceName()), test.common.Routing.Mark)}
+	if laddr != nil {
+		dialer.LocalAddr = laddr
+	}
+	if test.common.Flows.Enabled() {
+		return test.testFlows(dialer, raddr)
+	}
+	conn, err := test.dial(dialer, raddr)
+	if err != nil {
+		return err
+	}
+	defer func() { conn.Close() }()
 	var testString string
 	for i := 1; i <= test.common.MTU; i++ {
 		testString += "a"
@@ -157,7 +214,15 @@ func (test *UDPTest) testUnicastUDP() error {
 	)
 
 	for i := 1; i <= test.common.PackagesNumber; i++ {
-		test.runUDPPing(
+		if test.common.Reflect.Tally && i > 1 {
+			// new socket of every package has new source port and may be balanced to another backend
+			conn.Close()
+			conn, err = test.dial(dialer, raddr)
+			if err != nil {
+				return err
+			}
+		}
+		err = test.runUDPPing(
 			conn,
 			i,
 			byteTestString,
@@ -165,40 +230,141 @@ func (test *UDPTest) testUnicastUDP() error {
 			&statPacketReceived,
 			&statTotalTime,
 			&exitCode)
+		if err != nil {
+			return err
+		}
 	}
 	fmt.Printf("--- %s UDP statistics ---\n", test.common.ServerIP)
 	fmt.Printf("%d packets transmitted, %d received, %d packet loss, time %dms\n",
 		test.common.PackagesNumber, statPacketReceived,
 		totalPackageLoss(test.common.PackagesNumber, statPacketLost), statTotalTime)
 	if exitCode != 0 {
-		return fmt.Errorf("connectivity test failed")
+		return test.common.packetsError("connectivity test failed")
 	}
 	return nil
 }
 
+// testFlows sends the packages over socket of every flow
+func (test *UDPTest) testFlows(dialer net.Dialer, raddr *net.UDPAddr) error {
+	byteTestString := []byte(strings.Repeat("a", test.common.MTU))
+	fmt.Printf("UDP PING %s %d(%d) bytes of data.\n",
+		test.common.ServerIP, test.common.MTU, test.common.MTU+28)
+	return test.common.runFlows(test.interfaceName(), func(source *net.IPAddr, port int) (net.Addr, error) {
+		local := &net.UDPAddr{Port: port}
+		if source != nil {
+			local.IP, local.Zone = source.IP, source.Zone
+		}
+		dialer.LocalAddr = local
+		conn, err := test.dial(dialer, raddr)
+		if err != nil {
+			fmt.Printf("Socket %s failed: %v\n", local, err)
+			return nil, err
+		}
+		defer conn.Close()
+		var (
+			statTotalTime      int64
+			exitCode           int
+			statPacketLost     int
+			statPacketReceived int
+		)
+		for i := 1; i <= test.common.PackagesNumber; i++ {
+			err = test.runUDPPing(conn, i, byteTestString, &statPacketLost, &statPacketReceived, &statTotalTime, &exitCode)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return conn.LocalAddr(), nil
+	})
+}
+
+// dial connects the socket to the server and enables the error queue for the diagnostics
+func (test *UDPTest) dial(dialer net.Dialer, raddr *net.UDPAddr) (*net.UDPConn, error) {
+	dialConn, err := dialer.Dial(fmt.Sprintf("%s%d", ProtocolUDP, test.common.ProtocolVersion), raddr.String())
+	if err != nil {
+		return nil, err
+	}
+	conn := dialConn.(*net.UDPConn)
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	var operr error
+	err = rawConn.Control(func(fd uintptr) {
+		operr = test.common.enableErrorQueue(int(fd))
+	})
+	if err == nil {
+		err = operr
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
 func (test *UDPTest) receiveUDPTraffic(conn *net.UDPConn) error {
+	if test.ExpectPackets > 0 {
+		return test.receiveExpectedUDPTraffic(conn)
+	}
 	buffer := make([]byte, test.common.MTU)
 	for i := 0; i <= test.common.PackagesNumber; i++ {
 		deadline := time.Now().Add(test.Timeout * time.Second)
 		conn.SetDeadline(deadline)
 		n, addr, err := conn.ReadFromUDP(buffer)
 		if err != nil {
+			test.common.recordPacket(false, 0)
 			return err
 		}
+		test.common.recordPacket(true, 0)
+		test.common.recordSource(addr.IP)
 		fmt.Printf("packet-received: bytes=%d from=%s\n",
 			n, addr.String())
 	}
 	return nil
 }
 
+// receiveExpectedUDPTraffic receives until the expected number of packets arrives from the expected
+// sources or the deadline expires, without ExpectWithin every expected packet must arrive within the
+// timeout after the previous one
+func (test *UDPTest) receiveExpectedUDPTraffic(conn *net.UDPConn) error {
+	buffer := make([]byte, test.common.MTU)
+	if test.ExpectWithin > 0 {
+		conn.SetDeadline(time.Now().Add(test.ExpectWithin))
+	} else {
+		conn.SetDeadline(time.Now().Add(test.Timeout * time.Second))
+	}
+	received := 0
+	for received < test.ExpectPackets {
+		n, addr, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			return fmt.Errorf("received %d of %d expected packets: %w", received, test.ExpectPackets, err)
+		}
+		test.common.recordSource(addr.IP)
+		if test.ExpectFrom != nil && !test.ExpectFrom.Contains(addr.IP) {
+			fmt.Printf("packet-unexpected: bytes=%d from=%s\n", n, addr.String())
+			continue
+		}
+		received++
+		// unexpected packets do not extend the wait for the expected ones
+		if test.ExpectWithin == 0 {
+			conn.SetDeadline(time.Now().Add(test.Timeout * time.Second))
+		}
+		test.common.recordPacket(true, 0)
+		fmt.Printf("packet-received: bytes=%d from=%s\n", n, addr.String())
+	}
+	return nil
+}
+
 func (test *UDPTest) testMulticastUDP() error {
-	var err error
-	addr := test.resolveAddress()
+	addr, err := test.resolveAddress()
+	if err != nil {
+		return err
+	}
 	pc, err := net.ListenMulticastUDP(fmt.Sprintf(
 		"%s%d", ProtocolUDP, test.common.ProtocolVersion), test.InterfaceName, addr)
 	if err != nil {
-		fmt.Print(err)
-		os.Exit(1)
+		return err
 	}
 	defer pc.Close()
 	pc.SetReadBuffer(test.common.MTU)
@@ -210,13 +376,26 @@ func (test *UDPTest) testMulticastUDP() error {
 }
 
 func (test *UDPTest) testBroadcastUDP() error {
-	var err error
-	addr := test.resolveAddress()
-	pc, err := net.ListenUDP(ProtocolUDP, addr)
+	addr, err := test.resolveAddress()
+	if err != nil {
+		return err
+	}
+	if test.common.ProtocolVersion == 6 {
+		// IPv6 has no broadcast, receive the link-scoped group (e.g. ff02::1) instead
+		if test.InterfaceName == nil {
+			return fmt.Errorf("interface is required for IPv6 link-scoped group %s", test.common.ServerIP)
+		}
+		return test.testMulticastUDP()
+	}
+	lc := net.ListenConfig{}
+	if test.InterfaceName != nil {
+		lc.Control = netutils.ControlBindToDevice(test.InterfaceName.Name)
+	}
+	listener, err := lc.ListenPacket(context.Background(), ProtocolUDP, addr.String())
 	if err != nil {
-		fmt.Print(err)
-		os.Exit(1)
+		return err
 	}
+	pc := listener.(*net.UDPConn)
 	defer pc.Close()
 	pc.SetReadBuffer(test.common.MTU)
 	err = test.receiveUDPTraffic(pc)
@@ -226,32 +405,74 @@ func (test *UDPTest) testBroadcastUDP() error {
 	return nil
 }
 
-// RunTest runs the test
-func (test *UDPTest) RunTest() {
-	var err error
+// probe sends single byte datagram and waits for the echo of the server
+func (test *UDPTest) probe() error {
+	dialer := net.Dialer{Control: netutils.ControlSocket(test.common.bindDevice(test.interfaceName()), test.common.Routing.Mark)}
+	source, err := test.common.sourceAddr(test.interfaceName())
+	if err != nil {
+		return err
+	}
+	if source != nil {
+		dialer.LocalAddr = &net.UDPAddr{IP: source.IP, Zone: source.Zone}
+	}
+	raddr, err := test.resolveAddress()
+	if err != nil {
+		return err
+	}
+	conn, err := dialer.Dial(fmt.Sprintf("%s%d", ProtocolUDP, test.common.ProtocolVersion), raddr.String())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(waitPeerInterval))
+	_, err = conn.Write([]byte("a"))
+	if err != nil {
+		return err
+	}
+	_, err = conn.Read(make([]byte, 1))
+	return err
+}
+
+// WaitPeer waits until the server echoes datagrams. Multicast and broadcast receivers have no peer to probe
+func (test *UDPTest) WaitPeer(timeout time.Duration) {
+	if test.Multicast || test.Broadcast {
+		log.Printf("Parameter -wait-peer ignored in UDP multicast and broadcast mode")
+		return
+	}
+	test.common.waitPeer(test.common.bindDevice(test.interfaceName()), timeout, test.probe)
+}
+
+// Result returns statistics and details of the test run
+func (test *UDPTest) Result() *Result {
+	return &test.common.Result
+}
+
+// Run runs the test and returns error when the result does not match the expectation
+func (test *UDPTest) Run() error {
+	testFunc := test.testUnicastUDP
 	switch {
 	case test.Multicast:
-		err = test.testMulticastUDP()
+		testFunc = test.testMulticastUDP
 	case test.Broadcast:
-		err = test.testBroadcastUDP()
-	default:
-		err = test.testUnicastUDP()
+		testFunc = test.testBroadcastUDP
+	}
+	err := test.common.runChecked(test.common.bindDevice(test.interfaceName()), testFunc)
+	if test.common.Result.RouteErr != nil {
+		return test.common.Result.RouteErr
+	}
+	if test.common.Result.SetupErr != nil {
+		return test.common.Result.SetupErr
 	}
 	if err == nil {
 		if test.common.Negative {
-			fmt.Print("UDP Negative test failed")
-			os.Exit(1)
-		} else {
-			fmt.Print("UDP test passed as expected")
-		}
-		os.Exit(0)
-	} else {
-		if test.common.Negative {
-			fmt.Print("UDP Negative test failed as expected")
-			os.Exit(0)
+			return fmt.Errorf("UDP Negative test failed")
 		}
-		fmt.Print(err)
-		fmt.Print("UDP test failed")
-		os.Exit(1)
+		log.Print("UDP test passed as expected")
+		return nil
+	}
+	if test.common.Negative {
+		log.Print("UDP Negative test failed as expected")
+		return nil
 	}
+	return fmt.Errorf("UDP test failed: %w", err)
 }
@@ -0,0 +1,49 @@
+package protocols
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReceiveExpectedUDPTrafficIgnoresUnexpectedPackets(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sender, err := net.DialUDP("udp4", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+
+	// packets from the loopback are unexpected, they keep arriving more often than the timeout
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(100 * time.Millisecond):
+				sender.Write([]byte("unexpected"))
+			}
+		}
+	}()
+
+	_, expectFrom, _ := net.ParseCIDR("192.0.2.0/24")
+	test := &UDPTest{
+		common:        CommonTest{MTU: 100},
+		Timeout:       1,
+		ExpectPackets: 1,
+		ExpectFrom:    expectFrom,
+	}
+	start := time.Now()
+	if err := test.receiveExpectedUDPTraffic(conn); err == nil {
+		t.Fatal("receiving only unexpected packets passed")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("unexpected packets extended the wait to %s, timeout is 1s", elapsed)
+	}
+}
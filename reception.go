@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kononovn/testcmd/netutils"
+	"github.com/kononovn/testcmd/servers"
+)
+
+// receptionPollInterval is the interval the server counters are checked against the expectation
+const receptionPollInterval = 100 * time.Millisecond
+
+// receptionExpectation is the assertion of the receiving side: servers and udp multicast/broadcast
+// receivers exit once the packets arrived from the expected sources or the time is up
+type receptionExpectation struct {
+	Packets int
+	From    *net.IPNet
+	Within  time.Duration
+}
+
+// parseExpectation returns nil without expectation, source or deadline alone expect single packet
+func parseExpectation(packets int, from string, within time.Duration) (*receptionExpectation, error) {
+	if packets == 0 && from == "" && within == 0 {
+		return nil, nil
+	}
+	if packets < 0 {
+		return nil, fmt.Errorf("Unsupported parameter expect-packets=%d", packets)
+	}
+	if within < 0 {
+		return nil, fmt.Errorf("Unsupported parameter expect-within=%s", within)
+	}
+	expectation := &receptionExpectation{Packets: packets, Within: within}
+	if expectation.Packets == 0 {
+		expectation.Packets = 1
+	}
+	if from != "" {
+		_, ipNet, err := net.ParseCIDR(from)
+		if err != nil {
+			ip := netutils.ParseIP(from)
+			if ip == nil {
+				return nil, fmt.Errorf("Unsupported parameter expect-from=%s is not address or cidr", from)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			ipNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		}
+		expectation.From = ipNet
+	}
+	return expectation, nil
+}
+
+func (expectation *receptionExpectation) String() string {
+	description := fmt.Sprintf("%d packets", expectation.Packets)
+	if expectation.From != nil {
+		description += fmt.Sprintf(" from %s", expectation.From)
+	}
+	if expectation.Within > 0 {
+		description += fmt.Sprintf(" within %s", expectation.Within)
+	}
+	return description
+}
+
+func (expectation *receptionExpectation) matches(source string) bool {
+	if expectation.From == nil {
+		return true
+	}
+	ip := netutils.ParseIP(source)
+	return ip != nil && expectation.From.Contains(ip)
+}
+
+// waitServer checks the server counters until the expectation is met, the deadline expires or the
+// server stops. The server is closed afterwards
+func (expectation *receptionExpectation) waitServer(server *servers.Server) error {
+	start := time.Now()
+	ticker := time.NewTicker(receptionPollInterval)
+	defer ticker.Stop()
+	var err error
+	for {
+		matching, _ := expectation.count(serverSources(server.Stats()))
+		if matching >= expectation.Packets {
+			break
+		}
+		if expectation.Within > 0 && time.Since(start) >= expectation.Within {
+			err = fmt.Errorf("received %d of %d expected packets", matching, expectation.Packets)
+			break
+		}
+		if !server.Running() {
+			err = server.Wait()
+			if err == nil {
+				err = fmt.Errorf("server stopped")
+			}
+			break
+		}
+		<-ticker.C
+	}
+	elapsed := time.Since(start)
+	server.Close()
+	return expectation.summarize(serverSources(server.Stats()), elapsed, err)
+}
+
+func serverSources(stats servers.Stats) map[string]int {
+	sources := make(map[string]int, len(stats.Clients))
+	for client, clientStats := range stats.Clients {
+		sources[client] = int(clientStats.PacketsReceived)
+	}
+	return sources
+}
+
+// count returns the number of packets from the expected sources and the packets of other sources
+func (expectation *receptionExpectation) count(sources map[string]int) (int, map[string]int) {
+	matching := 0
+	unexpected := map[string]int{}
+	for source, packets := range sources {
+		if expectation.matches(source) {
+			matching += packets
+		} else {
+			unexpected[source] = packets
+		}
+	}
+	return matching, unexpected
+}
+
+// summarize prints the reception summary and returns error unless the expectation is met
+func (expectation *receptionExpectation) summarize(sources map[string]int, elapsed time.Duration, err error) error {
+	matching, unexpected := expectation.count(sources)
+	if err == nil && matching < expectation.Packets {
+		err = fmt.Errorf("received %d of %d expected packets", matching, expectation.Packets)
+	}
+	unexpectedSources := make([]string, 0, len(unexpected))
+	for source, packets := range unexpected {
+		unexpectedSources = append(unexpectedSources, fmt.Sprintf("%s=%d", source, packets))
+	}
+	sort.Strings(unexpectedSources)
+
+	fmt.Println("--- reception summary ---")
+	fmt.Printf("expected: %s\n", expectation)
+	fmt.Printf("received: %d\n", matching)
+	fmt.Printf("unexpected: %s\n", strings.Join(unexpectedSources, ","))
+	fmt.Printf("elapsed: %s\n", elapsed.Round(time.Millisecond))
+	if err != nil {
+		fmt.Printf("result: failed: %v\n", err)
+		return err
+	}
+	fmt.Println("result: passed")
+	log.Printf("Reception expectation met: %s", expectation)
+	return nil
+}
@@ -14,4 +14,4 @@ export GOFLAGS="${GOFLAGS:-"-mod=vendor"}"
 export PATH=$PATH:$GOPATH/bin
 
 mkdir -p bin
-go build -o ./bin/testcmd main.go
+go build -o ./bin/testcmd .
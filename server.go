@@ -0,0 +1,295 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/kononovn/testcmd/netutils"
+	"github.com/kononovn/testcmd/protocols"
+	"github.com/kononovn/testcmd/servers"
+)
+
+// serverSpec keeps parameters of the server, keys follow the command line flags
+type serverSpec struct {
+	Protocol   string `yaml:"protocol" json:"protocol"`
+	Server     string `yaml:"server" json:"server,omitempty"`
+	Port       int    `yaml:"port" json:"port"`
+	MTU        string `yaml:"mtu" json:"mtu,omitempty"`
+	MTUStrict  bool   `yaml:"mtu-strict" json:"mtu-strict,omitempty"`
+	Packages   int    `yaml:"packages" json:"packages,omitempty"`
+	Interface  string `yaml:"interface" json:"interface,omitempty"`
+	VRF        string `yaml:"vrf" json:"vrf,omitempty"`
+	Source     string `yaml:"source" json:"source,omitempty"`
+	SourcePort int    `yaml:"source-port" json:"source-port,omitempty"`
+	Multicast  bool   `yaml:"multicast" json:"multicast,omitempty"`
+	Broadcast  bool   `yaml:"broadcast" json:"broadcast,omitempty"`
+	Directed   bool   `yaml:"directed" json:"directed,omitempty"`
+	Reflect    bool   `yaml:"reflect" json:"reflect,omitempty"`
+	Identity   string `yaml:"identity" json:"identity,omitempty"`
+}
+
+// maxIdentityLength keeps the identity within the reflection message
+const maxIdentityLength = 253
+
+// start validates the parameters and starts the server. Source address of multicast/broadcast
+// servers is taken from the network attachment unless set explicitly
+func (spec *serverSpec) start(network *netutils.NetworkStatus) (*servers.Server, error) {
+	err := validateProtocol(spec.Protocol)
+	if err != nil {
+		return nil, err
+	}
+	if spec.MTU == "" {
+		spec.MTU = defaultMtu
+	}
+	mtu, err := parseMtu(spec.MTU)
+	if err != nil {
+		return nil, err
+	}
+	if spec.Packages == 0 {
+		spec.Packages = defaultPackages
+	}
+	err = validateSourcePort(spec.SourcePort)
+	if err != nil {
+		return nil, err
+	}
+	intFace, err := netutils.ResolveInterface(spec.Interface)
+	if err != nil {
+		return nil, err
+	}
+	if intFace != nil {
+		spec.Interface = intFace.Name
+	}
+	err = validateVRF(spec.VRF, spec.Interface)
+	if err != nil {
+		return nil, err
+	}
+	err = validatePort(spec.Port)
+	if err != nil {
+		return nil, err
+	}
+
+	if (spec.Reflect || spec.Identity != "") && (spec.Multicast || spec.Broadcast) {
+		return nil, fmt.Errorf("Unsupported parameter reflect/identity in %s server mode, the server only sends", spec.mode())
+	}
+	identity, err := expandIdentity(spec.Identity)
+	if err != nil {
+		return nil, err
+	}
+
+	if spec.Multicast {
+		err = validateIP(spec.Server, spec.Multicast)
+		if err != nil {
+			return nil, err
+		}
+		protocolVersion := ipProtocolVersion(spec.Server)
+		sourceIP := networkSourceIP(network, spec.Source, protocolVersion)
+		err = validateSourceIP(sourceIP, spec.Interface, protocolVersion)
+		if err != nil {
+			return nil, err
+		}
+		mtu, err = defineMtu(mtu, protocols.ProtocolUDP, protocolVersion, spec.Server, sourceIP, 0,
+			netutils.BindDevice(spec.Interface, spec.VRF), spec.MTUStrict)
+		if err != nil {
+			return nil, err
+		}
+		return servers.StartMulticastUDPServer(spec.Port, spec.Server, protocolVersion, mtu, spec.Interface, spec.VRF, sourceIP,
+			spec.SourcePort)
+	}
+	if spec.Broadcast {
+		broadcastAddress, err := defineBroadcastAddress(spec.Server, spec.Directed, spec.Interface)
+		if err != nil {
+			return nil, err
+		}
+		protocolVersion := ipProtocolVersion(broadcastAddress)
+		sourceIP := networkSourceIP(network, spec.Source, protocolVersion)
+		err = validateSourceIP(sourceIP, spec.Interface, protocolVersion)
+		if err != nil {
+			return nil, err
+		}
+		mtu, err = defineMtu(mtu, protocols.ProtocolUDP, protocolVersion, broadcastAddress, sourceIP, 0,
+			netutils.BindDevice(spec.Interface, spec.VRF), spec.MTUStrict)
+		if err != nil {
+			return nil, err
+		}
+		return servers.StartBroadcastUDPServer(spec.Port, broadcastAddress, protocolVersion, mtu, spec.Interface, spec.VRF,
+			sourceIP, spec.SourcePort)
+	}
+
+	mtu, err = defineServerMtu(mtu, spec.Protocol, ipProtocolVersion(spec.Server), netutils.BindDevice(spec.Interface, spec.VRF))
+	if err != nil {
+		return nil, err
+	}
+	switch spec.Protocol {
+	case protocols.ProtocolUDP:
+		if spec.Server != "" {
+			log.Printf("Parameter -server=%s ignored in server UDP unicast mode. Use all interfaces 0.0.0.0", spec.Server)
+		}
+		return servers.StartUDPServer(spec.Port, mtu, spec.Interface, spec.VRF, spec.Reflect, identity)
+	case protocols.ProtocolSCTP:
+		return servers.StartSCTPServer(spec.Server, spec.Port, mtu, spec.Interface, spec.VRF, ipProtocolVersion(spec.Server),
+			spec.Packages, spec.Reflect, identity)
+	case protocols.ProtocolTCP:
+		return servers.StartTCPServer(spec.Server, spec.Port, spec.Interface, spec.VRF, mtu, spec.Reflect, identity)
+	}
+	return nil, fmt.Errorf("Unsupported parameter protocol=%s in server mode", spec.Protocol)
+}
+
+// expandIdentity expands environment variables of the identity, e.g. $POD_NAME@$NODE_NAME. HOSTNAME
+// falls back to the kernel hostname when the variable is not set
+func expandIdentity(identity string) (string, error) {
+	var err error
+	expanded := os.Expand(identity, func(name string) string {
+		value := os.Getenv(name)
+		if value == "" && name == "HOSTNAME" {
+			value, err = os.Hostname()
+		}
+		return value
+	})
+	if err != nil {
+		return "", fmt.Errorf("Unsupported parameter identity=%s %v", identity, err)
+	}
+	if identity != "" && expanded == "" {
+		return "", fmt.Errorf("Unsupported parameter identity=%s expands to empty value", identity)
+	}
+	if len(expanded) > maxIdentityLength {
+		return "", fmt.Errorf("Unsupported parameter identity=%s is longer than %d", identity, maxIdentityLength)
+	}
+	return expanded, nil
+}
+
+// mode returns the server mode used in metrics
+func (spec *serverSpec) mode() string {
+	switch {
+	case spec.Multicast:
+		return "multicast"
+	case spec.Broadcast:
+		return "broadcast"
+	}
+	return "unicast"
+}
+
+// serverEndpoints serve health, readiness and metrics of the server on the HTTP side-port. The server
+// is ready once started and until it stops. Packet metrics are labeled by client IP only on request,
+// every client address is a new series otherwise
+type serverEndpoints struct {
+	spec      *serverSpec
+	perClient bool
+	mutex     sync.Mutex
+	server    *servers.Server
+}
+
+// startServerEndpoints listens on the side-port before the server starts, so liveness probes pass
+// during start
+func startServerEndpoints(address string, spec *serverSpec, perClient bool) (*serverEndpoints, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("Unsupported parameter metrics-address=%s %s", address, err)
+	}
+	endpoints := &serverEndpoints{spec: spec, perClient: perClient}
+	mux := http.NewServeMux()
+	mux.HandleFunc(healthPath, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc(readyPath, endpoints.handleReady)
+	mux.HandleFunc(metricsPath, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		endpoints.writeMetrics(w)
+	})
+	go func() {
+		err := http.Serve(listener, mux)
+		log.Printf("Metrics endpoint stopped: %v", err)
+	}()
+	log.Printf("Serving %s, %s and %s on %s", healthPath, readyPath, metricsPath, listener.Addr())
+	return endpoints, nil
+}
+
+func (endpoints *serverEndpoints) setServer(server *servers.Server) {
+	endpoints.mutex.Lock()
+	defer endpoints.mutex.Unlock()
+	endpoints.server = server
+}
+
+func (endpoints *serverEndpoints) currentServer() *servers.Server {
+	endpoints.mutex.Lock()
+	defer endpoints.mutex.Unlock()
+	return endpoints.server
+}
+
+func (endpoints *serverEndpoints) handleReady(w http.ResponseWriter, r *http.Request) {
+	server := endpoints.currentServer()
+	if server == nil || !server.Running() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "not ready")
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// writeMetrics writes the server counters in Prometheus text exposition format
+func (endpoints *serverEndpoints) writeMetrics(w io.Writer) {
+	server := endpoints.currentServer()
+	stats := servers.Stats{}
+	if server != nil {
+		stats = server.Stats()
+	}
+	labels := metricLabels("protocol", endpoints.spec.Protocol, "mode", endpoints.spec.mode(),
+		"port", strconv.Itoa(endpoints.spec.Port))
+	clients := make([]string, 0, len(stats.Clients))
+	for client := range stats.Clients {
+		clients = append(clients, client)
+	}
+	sort.Strings(clients)
+	errorTypes := make([]string, 0, len(stats.Errors))
+	for errorType := range stats.Errors {
+		errorTypes = append(errorTypes, errorType)
+	}
+	sort.Strings(errorTypes)
+
+	writeMetricHeader(w, "testcmd_server_up", "gauge", "Whether the server is running.")
+	writeMetric(w, "testcmd_server_up", labels, boolMetric(server != nil && server.Running()))
+	writeMetricHeader(w, "testcmd_server_connections_accepted_total", "counter", "Connections accepted by tcp/sctp server.")
+	writeMetric(w, "testcmd_server_connections_accepted_total", labels, float64(stats.ConnectionsAccepted))
+	clientMetrics := []struct {
+		name  string
+		help  string
+		value func(servers.ClientStats) uint64
+	}{
+		{"testcmd_server_packets_received_total", "Packets received from the clients.",
+			func(client servers.ClientStats) uint64 { return client.PacketsReceived }},
+		{"testcmd_server_bytes_received_total", "Bytes received from the clients.",
+			func(client servers.ClientStats) uint64 { return client.BytesReceived }},
+		{"testcmd_server_packets_echoed_total", "Packets echoed to the clients.",
+			func(client servers.ClientStats) uint64 { return client.PacketsEchoed }},
+		{"testcmd_server_bytes_echoed_total", "Bytes echoed to the clients.",
+			func(client servers.ClientStats) uint64 { return client.BytesEchoed }},
+	}
+	for _, metric := range clientMetrics {
+		writeMetricHeader(w, metric.name, "counter", metric.help)
+		if !endpoints.perClient {
+			var total uint64
+			for _, client := range clients {
+				total += metric.value(stats.Clients[client])
+			}
+			writeMetric(w, metric.name, labels, float64(total))
+			continue
+		}
+		for _, client := range clients {
+			writeMetric(w, metric.name, labels+","+metricLabels("client", client), float64(metric.value(stats.Clients[client])))
+		}
+	}
+	writeMetricHeader(w, "testcmd_server_errors_total", "counter", "Errors by type.")
+	for _, errorType := range errorTypes {
+		writeMetric(w, "testcmd_server_errors_total", labels+","+metricLabels("type", errorType), float64(stats.Errors[errorType]))
+	}
+	writeMetricHeader(w, "testcmd_server_datagrams_sent_total", "counter", "Datagrams sent by multicast/broadcast server.")
+	writeMetric(w, "testcmd_server_datagrams_sent_total", labels, float64(stats.DatagramsSent))
+	writeMetricHeader(w, "testcmd_server_bytes_sent_total", "counter", "Bytes sent by multicast/broadcast server.")
+	writeMetric(w, "testcmd_server_bytes_sent_total", labels, float64(stats.BytesSent))
+}
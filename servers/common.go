@@ -0,0 +1,33 @@
+package servers
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/kononovn/testcmd/netutils"
+)
+
+// checkL3mdevAccept reports whether the listener receives traffic arriving via vrf devices.
+// With net.ipv4.<protocol>_l3mdev_accept=0 a listener in the default vrf does not accept traffic
+// arriving on vrf enslaved interfaces, with 1 it accepts traffic from every vrf.
+func checkL3mdevAccept(protocol string, vrfName string) {
+	value, err := netutils.ReadSysctl(fmt.Sprintf("net.ipv4.%s_l3mdev_accept", protocol))
+	if err != nil {
+		// kernel without vrf support
+		return
+	}
+	if vrfName != "" {
+		if value == "1" {
+			log.Printf("net.ipv4.%s_l3mdev_accept=1, listeners in default vrf also accept traffic from vrf %s", protocol, vrfName)
+		}
+		return
+	}
+	vrfs, err := netutils.VRFs()
+	if err != nil || len(vrfs) == 0 {
+		return
+	}
+	if value == "0" {
+		log.Printf("net.ipv4.%s_l3mdev_accept=0, listener in default vrf does not accept traffic arriving via vrf devices, use -vrf",
+			protocol)
+	}
+}
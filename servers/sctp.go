@@ -7,14 +7,22 @@ import (
 	"syscall"
 
 	"github.com/ishidawataru/sctp"
+	"github.com/kononovn/testcmd/netutils"
 )
 
-// RunSCTP runs a sctp server
-func RunSCTP(serverAddr string, port int, mtu int, interfaceName string, protocolVersion int, packagesNumber int) {
+// StartSCTPServer starts a sctp server, reflecting server or server with identity replies with the
+// observed client address and the identity before closing the association
+func StartSCTPServer(
+	serverAddr string, port int, mtu int, interfaceName string, vrfName string, protocolVersion int, packagesNumber int,
+	reflect bool, identity string) (*Server, error) {
 	log.Print("Start SCTP server")
+	device := netutils.BindDevice(interfaceName, vrfName)
 	address, err := net.ResolveIPAddr("ip", serverAddr)
 	if err != nil {
-		exitWithError(err)
+		return nil, sctpError(err)
+	}
+	if netutils.NeedsZone(address.IP) && address.Zone == "" {
+		address.Zone = interfaceName
 	}
 
 	listenAddr := &sctp.SCTPAddr{
@@ -24,22 +32,22 @@ func RunSCTP(serverAddr string, port int, mtu int, interfaceName string, protoco
 
 	socketConfig := &sctp.SocketConfig{
 		Control: func(network, address string, c syscall.RawConn) error {
+			var operr error
 			err := c.Control(
 				func(fd uintptr) {
 					// value is 1 to set SCTP_DISABLE_FRAGMENTS to true
-					err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_SCTP, sctp.SCTP_DISABLE_FRAGMENTS, 1)
-					if err != nil {
-						log.Fatalf("syscall.SetsockoptInt(SCTP_DISABLE_FRAGMENTS) error: %v", err)
-					}
-					if interfaceName != "" {
-						err = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, interfaceName)
-						if err != nil {
-							log.Fatalf("syscall.SetsockoptInt(SO_BINDTODEVICE) error: %v", err)
-						}
+					operr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_SCTP, sctp.SCTP_DISABLE_FRAGMENTS, 1)
+					if operr != nil {
+						operr = fmt.Errorf("syscall.SetsockoptInt(SCTP_DISABLE_FRAGMENTS) error: %w", operr)
+						return
 					}
+					operr = netutils.BindToDevice(int(fd), device)
 				},
 			)
-			return err
+			if err != nil {
+				return err
+			}
+			return operr
 		},
 		InitMsg: sctp.InitMsg{
 			NumOstreams:  uint16(packagesNumber),
@@ -52,32 +60,79 @@ func RunSCTP(serverAddr string, port int, mtu int, interfaceName string, protoco
 
 	listener, err := socketConfig.Listen(network, listenAddr)
 	if err != nil {
-		exitWithError(err)
+		return nil, sctpError(err)
 	}
-	defer listener.Close()
-	for {
+	server := newServer(listener)
+	server.serve(func() error {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				server.countError(ErrorAccept)
+				return sctpError(err)
+			}
+			if !server.track(conn) {
+				conn.Close()
+				continue
+			}
+			server.countConnection()
 
-		conn, err := listener.Accept()
-		if err != nil {
-			exitWithError(err)
-		}
+			buf := make([]byte, mtu)
+			n, err := conn.Read(buf)
+			server.untrack(conn)
+			if err != nil {
+				server.countError(ErrorRead)
+				conn.Close()
+				return sctpError(err)
+			}
+			server.countReceived(conn.RemoteAddr(), n)
+			if reflect || identity != "" {
+				n, err = conn.Write(sctpReflection(conn.(*sctp.SCTPConn), identity).Marshal())
+				if err != nil {
+					server.countError(ErrorWrite)
+					log.Printf("Failed to reflect the observed address to %s: %v", conn.RemoteAddr(), err)
+				} else {
+					server.countEchoed(conn.RemoteAddr(), n)
+				}
+			}
 
-		buf := make([]byte, mtu)
-		n, err := conn.Read(buf)
-		if err != nil {
-			exitWithError(err)
+			err = conn.Close()
+			if err != nil {
+				return sctpError(err)
+			}
+			log.Printf("packet-received: bytes=%d from=%s\n",
+				n, conn.RemoteAddr())
 		}
+	})
+	return server, nil
+}
 
-		err = conn.Close()
-		if err != nil {
-			exitWithError(err)
+// sctpReflection returns the reflection of the association, the source is the primary peer address and
+// the destination the local address of the same family
+func sctpReflection(conn *sctp.SCTPConn, identity string) *netutils.Reflection {
+	source, err := conn.SCTPGetPrimaryPeerAddr()
+	if err != nil || len(source.IPAddrs) == 0 {
+		source, _ = conn.RemoteAddr().(*sctp.SCTPAddr)
+	}
+	var sourceAddr, destinationAddr net.Addr
+	if source != nil && len(source.IPAddrs) > 0 {
+		sourceAddr = &net.TCPAddr{IP: source.IPAddrs[0].IP, Zone: source.IPAddrs[0].Zone, Port: source.Port}
+		local, err := conn.SCTPLocalAddr(0)
+		if err == nil {
+			isIPv4 := source.IPAddrs[0].IP.To4() != nil
+			for _, address := range local.IPAddrs {
+				if (address.IP.To4() != nil) == isIPv4 {
+					destinationAddr = &net.TCPAddr{IP: address.IP, Zone: address.Zone, Port: local.Port}
+					break
+				}
+			}
 		}
-		log.Printf("packet-received: bytes=%d from=%s\n",
-			n, conn.RemoteAddr())
-
 	}
+	reflection := netutils.NewReflection(sourceAddr, destinationAddr, "")
+	reflection.Identity = identity
+	log.Printf("Reflect %s", reflection)
+	return reflection
 }
 
-func exitWithError(err error) {
-	log.Fatalf("sctp server error: %v", err)
+func sctpError(err error) error {
+	return fmt.Errorf("sctp server error: %w", err)
 }
@@ -0,0 +1,192 @@
+package servers
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+// Error types counted by the servers
+const (
+	ErrorAccept = "accept"
+	ErrorRead   = "read"
+	ErrorWrite  = "write"
+	ErrorSend   = "send"
+)
+
+// Server is a running server. Close stops it together with the open connections, Wait blocks until
+// the server stops and returns the error which stopped it
+type Server struct {
+	listener io.Closer
+	mutex    sync.Mutex
+	conns    map[io.Closer]struct{}
+	closed   bool
+	done     chan struct{}
+	err      error
+	stats    Stats
+}
+
+// Stats are the counters of the server since start
+type Stats struct {
+	ConnectionsAccepted uint64
+	// Clients are keyed by the client IP address
+	Clients map[string]ClientStats
+	// Errors are keyed by the error type
+	Errors map[string]uint64
+	// DatagramsSent and BytesSent are sent by multicast/broadcast servers
+	DatagramsSent uint64
+	BytesSent     uint64
+}
+
+// ClientStats are the counters of single client
+type ClientStats struct {
+	PacketsReceived uint64
+	BytesReceived   uint64
+	PacketsEchoed   uint64
+	BytesEchoed     uint64
+}
+
+func newServer(listener io.Closer) *Server {
+	return &Server{
+		listener: listener,
+		conns:    map[io.Closer]struct{}{},
+		done:     make(chan struct{}),
+		stats:    Stats{Clients: map[string]ClientStats{}, Errors: map[string]uint64{}},
+	}
+}
+
+// serve runs the server loop in background, the error after Close is not reported
+func (server *Server) serve(run func() error) {
+	go func() {
+		err := run()
+		server.mutex.Lock()
+		if server.closed {
+			err = nil
+		}
+		server.err = err
+		server.mutex.Unlock()
+		close(server.done)
+	}()
+}
+
+// track registers the connection closed together with the server, false is returned if the server is closed
+func (server *Server) track(conn io.Closer) bool {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if server.closed {
+		return false
+	}
+	server.conns[conn] = struct{}{}
+	return true
+}
+
+func (server *Server) untrack(conn io.Closer) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	delete(server.conns, conn)
+}
+
+// Close stops the server and waits until the server loop exits
+func (server *Server) Close() error {
+	server.mutex.Lock()
+	if server.closed {
+		server.mutex.Unlock()
+		return nil
+	}
+	server.closed = true
+	for conn := range server.conns {
+		conn.Close()
+	}
+	server.mutex.Unlock()
+	err := server.listener.Close()
+	<-server.done
+	return err
+}
+
+// Wait blocks until the server stops
+func (server *Server) Wait() error {
+	<-server.done
+	return server.err
+}
+
+// Running reports whether the server loop is running
+func (server *Server) Running() bool {
+	select {
+	case <-server.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// Stats returns copy of the counters
+func (server *Server) Stats() Stats {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	stats := server.stats
+	stats.Clients = make(map[string]ClientStats, len(server.stats.Clients))
+	for client, clientStats := range server.stats.Clients {
+		stats.Clients[client] = clientStats
+	}
+	stats.Errors = make(map[string]uint64, len(server.stats.Errors))
+	for errorType, count := range server.stats.Errors {
+		stats.Errors[errorType] = count
+	}
+	return stats
+}
+
+func (server *Server) countConnection() {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.stats.ConnectionsAccepted++
+}
+
+// countReceived counts the packet received from the client, the client port is not kept to limit
+// the number of clients
+func (server *Server) countReceived(addr net.Addr, bytes int) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	client := clientIP(addr)
+	clientStats := server.stats.Clients[client]
+	clientStats.PacketsReceived++
+	clientStats.BytesReceived += uint64(bytes)
+	server.stats.Clients[client] = clientStats
+}
+
+func (server *Server) countEchoed(addr net.Addr, bytes int) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	client := clientIP(addr)
+	clientStats := server.stats.Clients[client]
+	clientStats.PacketsEchoed++
+	clientStats.BytesEchoed += uint64(bytes)
+	server.stats.Clients[client] = clientStats
+}
+
+func (server *Server) countSent(bytes int) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.stats.DatagramsSent++
+	server.stats.BytesSent += uint64(bytes)
+}
+
+// countError counts the error unless it is caused by Close
+func (server *Server) countError(errorType string) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if server.closed {
+		return
+	}
+	server.stats.Errors[errorType]++
+}
+
+func clientIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
@@ -2,74 +2,97 @@ package servers
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
-	"syscall"
 	"time"
+
+	"github.com/kononovn/testcmd/netutils"
 )
 
-// RunTCPServer runs tcp server
-func RunTCPServer(address string, port int, intFace string, bufferSize int) {
-	listen(fmt.Sprintf("%s:%d", address, port), intFace, bufferSize)
+// StartTCPServer starts tcp echo server, reflecting server or server with identity replies with the
+// observed client address and the identity instead of the payload
+func StartTCPServer(
+	address string, port int, intFace string, vrfName string, bufferSize int, reflect bool, identity string) (*Server, error) {
+	checkL3mdevAccept("tcp", vrfName)
+	if netutils.ParseIP(address) != nil {
+		// link-local listen address is scoped to the interface
+		scoped, err := netutils.ScopedIPAddr(address, intFace)
+		if err != nil {
+			return nil, err
+		}
+		address = scoped.String()
+	}
+	return listen(net.JoinHostPort(address, fmt.Sprint(port)), netutils.BindDevice(intFace, vrfName), bufferSize,
+		reflect || identity != "", identity)
 }
 
-func listen(address, vrfName string, bufferSize int) {
-	lc := net.ListenConfig{Control: controlOnConnSetup(vrfName)}
+func listen(address, device string, bufferSize int, reflect bool, identity string) (*Server, error) {
+	lc := net.ListenConfig{Control: netutils.ControlBindToDevice(device)}
 
 	ln, err := lc.Listen(context.Background(), "tcp", address)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	defer ln.Close()
-
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			log.Fatal(err)
+	server := newServer(ln)
+	server.serve(func() error {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				server.countError(ErrorAccept)
+				return err
+			}
+			if !server.track(conn) {
+				conn.Close()
+				continue
+			}
+			server.countConnection()
+			go func() {
+				handleConnection(server, conn, bufferSize, reflect, identity)
+				server.untrack(conn)
+			}()
 		}
-		go handleConnection(conn, bufferSize)
-	}
+	})
+	return server, nil
 }
 
-func handleConnection(conn net.Conn, bufferSize int) {
+func handleConnection(server *Server, conn net.Conn, bufferSize int, reflect bool, identity string) {
+	defer conn.Close()
 	log.Print("Start TCP Server")
+	var reflection []byte
+	if reflect {
+		observed := netutils.NewReflection(conn.RemoteAddr(), conn.LocalAddr(), "")
+		observed.Identity = identity
+		log.Printf("Reflect %s", observed)
+		reflection = observed.Marshal()
+	}
 
 	for {
 		time.Sleep(1 * time.Second)
 		buffer := make([]byte, bufferSize)
 		n, err := conn.Read(buffer)
 		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				server.countError(ErrorRead)
+			}
 			log.Printf("Connection from client: %s closed", conn.RemoteAddr())
 			return
 		}
 		log.Printf("packet-received: bytes=%d from=%s\n",
 			n, conn.RemoteAddr())
-		_, err = conn.Write([]byte(buffer[:n]))
+		server.countReceived(conn.RemoteAddr(), n)
+		reply := buffer[:n]
+		if reflect {
+			reply = reflection
+		}
+		n, err = conn.Write(reply)
 		if err != nil {
+			server.countError(ErrorWrite)
 			log.Printf("Failed to retrieve traffic from the client due to %v", err)
 			return
 		}
-	}
-
-	conn.Close()
-}
-
-func controlOnConnSetup(vrfName string) func(network string, address string, c syscall.RawConn) error {
-	return func(network string, address string, c syscall.RawConn) error {
-		if vrfName == "" {
-			return nil
-		}
-		var operr error
-		fn := func(fd uintptr) {
-			operr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, vrfName)
-		}
-		if err := c.Control(fn); err != nil {
-			return err
-		}
-		if operr != nil {
-			return operr
-		}
-		return nil
+		server.countEchoed(conn.RemoteAddr(), n)
 	}
 }
@@ -1,13 +1,15 @@
 package servers
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
-	"os"
-	"strings"
 	"syscall"
 	"time"
+
+	"github.com/kononovn/testcmd/netutils"
 )
 
 const (
@@ -15,95 +17,217 @@ const (
 	ProtocolUDP = "udp"
 )
 
-func defineSourceIP(interfaceName string, protocolVersion int) (*string, error) {
-	var intFaceAddr string
-	intFace, err := net.InterfaceByName(interfaceName)
+// defineSourceNet returns the interface prefix of the protocol version. For IPv6 global address is
+// preferred, link-local address is used on interfaces without one or when link-local is preferred
+func defineSourceNet(interfaceName string, protocolVersion int, linkLocal bool) (*net.IPNet, error) {
+	var intFaceNet, linkLocalNet *net.IPNet
+	intFace, err := netutils.ResolveInterface(interfaceName)
 	if err != nil {
 		log.Printf("Can not get interface by name %s", interfaceName)
 		return nil, err
 	}
+	if intFace == nil {
+		return nil, fmt.Errorf("error: interface is required to define source ip address")
+	}
 	intFaceAddreses, err := intFace.Addrs()
 	if err != nil {
 		log.Printf("Can not get ip addresses on interface %s", interfaceName)
 		return nil, err
 	}
-	if len(intFaceAddreses) < 1 {
-		log.Printf("error: can not find ip address on interface %s", interfaceName)
-		return nil, err
-	}
 	for _, addr := range intFaceAddreses {
-		if strings.Contains(addr.String(), ":") && protocolVersion == 6 && !strings.Contains(addr.String(), "fe80") {
-			intFaceAddr = strings.Split(addr.String(), "/")[0]
-		} else if protocolVersion == 4 && !strings.Contains(addr.String(), ":") {
-			intFaceAddr = strings.Split(addr.String(), "/")[0]
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		isIPv4 := ipNet.IP.To4() != nil
+		switch {
+		case protocolVersion == 4 && isIPv4:
+			intFaceNet = ipNet
+		case protocolVersion == 6 && !isIPv4 && ipNet.IP.IsLinkLocalUnicast():
+			linkLocalNet = ipNet
+		case protocolVersion == 6 && !isIPv4:
+			intFaceNet = ipNet
 		}
 	}
-	if intFaceAddr == "" {
+	if linkLocalNet != nil && (linkLocal || intFaceNet == nil) {
+		intFaceNet = linkLocalNet
+	}
+	if intFaceNet == nil {
 		log.Printf("error: can not find ip address on interface %s", interfaceName)
 		return nil, fmt.Errorf("error: can not find ip address on interface %s", interfaceName)
 	}
+	return intFaceNet, nil
+}
+
+func defineSourceIP(interfaceName string, protocolVersion int, linkLocal bool) (*string, error) {
+	intFaceNet, err := defineSourceNet(interfaceName, protocolVersion, linkLocal)
+	if err != nil {
+		return nil, err
+	}
+	intFaceAddr := intFaceNet.IP.String()
 	return &intFaceAddr, nil
 }
 
-func defineConnection(serverPort int) net.PacketConn {
-	pc, err := net.ListenPacket("udp", fmt.Sprintf("0.0.0.0:%d", serverPort))
+// DirectedBroadcastAddress returns subnet-directed broadcast address of the IPv4 prefix
+// configured on the interface
+func DirectedBroadcastAddress(interfaceName string) (string, error) {
+	if interfaceName == "" {
+		return "", fmt.Errorf("interface is required to define directed broadcast address")
+	}
+	intFaceNet, err := defineSourceNet(interfaceName, 4, false)
 	if err != nil {
-		log.Print(err)
-		os.Exit(1)
+		return "", err
 	}
-	return pc
+	return directedBroadcast(intFaceNet).String(), nil
 }
 
-// RunBroadcastUDPServer starts multicast udp server
-func RunBroadcastUDPServer(serverPort int, serverIP string, udpDatagramSize int, interfaceName string) {
-	runGenericUDPServer("broadcast", serverPort, serverIP, 4, udpDatagramSize, interfaceName)
+// directedBroadcast returns the IPv4 prefix address with all host bits set
+func directedBroadcast(ipNet *net.IPNet) net.IP {
+	ip := ipNet.IP.To4()
+	broadcastIP := make(net.IP, len(ip))
+	for i := range ip {
+		broadcastIP[i] = ip[i] | ^ipNet.Mask[len(ipNet.Mask)-len(ip)+i]
+	}
+	return broadcastIP
 }
 
-// RunMulticastUDPServer starts multicast udp server
-func RunMulticastUDPServer(serverPort int, serverIP string, protocolVersion int, udpDatagramSize int, interfaceName string) {
-	runGenericUDPServer("multicast", serverPort, serverIP, protocolVersion, udpDatagramSize, interfaceName)
+func defineConnection(serverPort int, device string, packetInfo bool) (net.PacketConn, error) {
+	control := netutils.ControlBindToDevice(device)
+	lc := net.ListenConfig{Control: func(network string, address string, c syscall.RawConn) error {
+		err := control(network, address, c)
+		if err != nil || !packetInfo {
+			return err
+		}
+		var operr error
+		err = c.Control(func(fd uintptr) {
+			operr = netutils.EnablePacketInfo(int(fd))
+		})
+		if err != nil {
+			return err
+		}
+		return operr
+	}}
+	return lc.ListenPacket(context.Background(), "udp", fmt.Sprintf("0.0.0.0:%d", serverPort))
+}
+
+// StartBroadcastUDPServer starts broadcast udp server. For protocol version 4 serverIP is either
+// limited broadcast 255.255.255.255 or subnet-directed broadcast address. IPv6 has no broadcast,
+// so for protocol version 6 serverIP is a link-scoped multicast group (e.g. ff02::1) sent on interfaceName
+func StartBroadcastUDPServer(
+	serverPort int, serverIP string, protocolVersion int, udpDatagramSize int, interfaceName string, vrfName string,
+	sourceIP string, sourcePort int) (*Server, error) {
+	return startGenericUDPServer("broadcast", serverPort, serverIP, protocolVersion, udpDatagramSize, interfaceName, vrfName,
+		sourceIP, sourcePort)
+}
+
+// StartMulticastUDPServer starts multicast udp server
+func StartMulticastUDPServer(
+	serverPort int, serverIP string, protocolVersion int, udpDatagramSize int, interfaceName string, vrfName string,
+	sourceIP string, sourcePort int) (*Server, error) {
+	return startGenericUDPServer("multicast", serverPort, serverIP, protocolVersion, udpDatagramSize, interfaceName, vrfName,
+		sourceIP, sourcePort)
 }
 
-func runGenericUDPServer(mode string, serverPort int, serverIP string, protocolVersion int, udpDatagramSize int, interfaceName string) {
+func startGenericUDPServer(
+	mode string,
+	serverPort int,
+	serverIP string,
+	protocolVersion int,
+	udpDatagramSize int,
+	interfaceName string,
+	vrfName string,
+	sourceIP string,
+	sourcePort int) (*Server, error) {
 	var testString string
 	raddr, err := net.ResolveUDPAddr(fmt.Sprintf("%s%d", ProtocolUDP, protocolVersion), fmt.Sprintf("[%s]:%d", serverIP, serverPort))
 	if err != nil {
-		log.Print(err)
-		os.Exit(1)
+		return nil, err
+	}
+	// Link-scoped IPv6 groups are only meaningful together with the outgoing interface
+	linkScope := protocolVersion == 6 && raddr.IP.IsLinkLocalMulticast()
+	if linkScope && raddr.Zone == "" {
+		if interfaceName == "" {
+			return nil, fmt.Errorf("error: interface is required for link-scoped group %s", serverIP)
+		}
+		raddr.Zone = interfaceName
 	}
-	intFaceAddr, err := defineSourceIP(interfaceName, protocolVersion)
+	if interfaceName == "" {
+		interfaceName = raddr.Zone
+	}
+	intFaceAddr := &sourceIP
+	// sender without interface leaves the source address to the routing, e.g. of the vrf or towards
+	// directed broadcast of a remote subnet
+	if sourceIP == "" && interfaceName != "" {
+		intFaceAddr, err = defineSourceIP(interfaceName, protocolVersion, linkScope)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if sourcePort == 0 {
+		sourcePort = serverPort
+	}
+	laddr, err := net.ResolveUDPAddr(fmt.Sprintf("%s%d", ProtocolUDP, protocolVersion), fmt.Sprintf("[%s]:%d", *intFaceAddr, sourcePort))
 	if err != nil {
-		log.Print(err)
-		os.Exit(1)
+		return nil, err
+	}
+	if laddr.IP.IsLinkLocalUnicast() && laddr.Zone == "" {
+		laddr.Zone = interfaceName
 	}
-	laddr, err := net.ResolveUDPAddr(fmt.Sprintf("%s%d", ProtocolUDP, protocolVersion), fmt.Sprintf("[%s]:%d", *intFaceAddr, serverPort))
+	dialer := net.Dialer{LocalAddr: laddr, Control: netutils.ControlBindToDevice(netutils.BindDevice(interfaceName, vrfName))}
+	dialConn, err := dialer.Dial(fmt.Sprintf("%s%d", ProtocolUDP, protocolVersion), raddr.String())
 	if err != nil {
-		log.Print(err)
-		os.Exit(1)
+		return nil, err
 	}
-	conn, err := net.DialUDP(fmt.Sprintf("%s%d", ProtocolUDP, protocolVersion), laddr, raddr)
+	conn := dialConn.(*net.UDPConn)
+	err = setSenderOptions(conn, protocolVersion)
 	if err != nil {
-		log.Print(err)
-		os.Exit(1)
+		conn.Close()
+		return nil, err
+	}
+	for i := 1; i <= udpDatagramSize; i++ {
+		testString += "a"
 	}
-	defer conn.Close()
+	byteTestString := []byte(testString)
+	log.Printf("Start UDP %s Server", mode)
+	server := newServer(conn)
+	server.serve(func() error {
+		for {
+			log.Printf("Transmit udp datagramm: size %d to %s address %s", udpDatagramSize, mode, serverIP)
+			time.Sleep(2 * time.Second)
+			byteTransmitted, err := conn.Write(byteTestString)
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			if err != nil {
+				server.countError(ErrorSend)
+				log.Printf("udp datagramm size %d transmission to %s status error: %s", byteTransmitted, serverIP, err)
+			} else {
+				server.countSent(byteTransmitted)
+			}
+			log.Printf("udp datagramm size %d transmission to %s status OK", byteTransmitted, serverIP)
+		}
+	})
+	return server, nil
+}
+
+// setSenderOptions sets send/receive timeouts and DF flag on the sender socket, broadcast permission is
+// set by Go on every datagram socket
+func setSenderOptions(conn *net.UDPConn, protocolVersion int) error {
 	//Set DF flage on socket
 	f, err := conn.File()
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		return err
 	}
+	defer f.Close()
 	timeVal := new(syscall.Timeval)
 	timeVal.Sec = 5
 	err = syscall.SetsockoptTimeval(int(f.Fd()), syscall.SOL_SOCKET, syscall.SO_SNDTIMEO, timeVal)
 	if err != nil {
-		fmt.Printf("Error define send timeout %s", err)
-		os.Exit(1)
+		return fmt.Errorf("Error define send timeout %s", err)
 	}
 	err = syscall.SetsockoptTimeval(int(f.Fd()), syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, timeVal)
 	if err != nil {
-		fmt.Printf("Error define DF receive timeout %s", err)
-		os.Exit(1)
+		return fmt.Errorf("Error define DF receive timeout %s", err)
 	}
 	if protocolVersion == 4 {
 		err = syscall.SetsockoptInt(int(f.Fd()), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DO)
@@ -111,59 +235,75 @@ func runGenericUDPServer(mode string, serverPort int, serverIP string, protocolV
 		err = syscall.SetsockoptInt(int(f.Fd()), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_DO)
 	}
 	if err != nil {
-		fmt.Printf("Error define MTU discovery flag %s", err)
-		os.Exit(1)
-	}
-	for i := 1; i <= udpDatagramSize; i++ {
-		testString += "a"
-	}
-	byteTestString := []byte(testString)
-	log.Printf("Start UDP %s Server", mode)
-	for {
-		log.Printf("Transmit udp datagramm: size %d to %s address %s", udpDatagramSize, mode, serverIP)
-		time.Sleep(2 * time.Second)
-		byteTransmitted, err := conn.Write(byteTestString)
-		if err != nil {
-			log.Printf("udp datagramm size %d transmission to %s status error: %s", byteTransmitted, serverIP, err)
-		}
-		log.Printf("udp datagramm size %d transmission to %s status OK", byteTransmitted, serverIP)
+		return fmt.Errorf("Error define MTU discovery flag %s", err)
 	}
+	return nil
 }
 
-// RunUDPServer starts udp server
-func RunUDPServer(serverPort int, bufferSize int) {
-	pc := defineConnection(serverPort)
-	defer pc.Close()
-	doneChan := make(chan error, 1)
+// StartUDPServer starts udp echo server, reflecting server or server with identity replies with the
+// observed client address, the local address and interface the datagram arrived on and the identity
+// instead of the payload
+func StartUDPServer(
+	serverPort int, bufferSize int, interfaceName string, vrfName string, reflect bool, identity string) (*Server, error) {
+	checkL3mdevAccept("udp", vrfName)
+	reflect = reflect || identity != ""
+	pc, err := defineConnection(serverPort, netutils.BindDevice(interfaceName, vrfName), reflect)
+	if err != nil {
+		return nil, err
+	}
+	conn := pc.(*net.UDPConn)
 	buffer := make([]byte, bufferSize)
+	oob := make([]byte, 128)
 	log.Print("Start UDP Server")
-	go func() {
+	server := newServer(pc)
+	server.serve(func() error {
 		for {
-			n, addr, err := pc.ReadFrom(buffer)
+			n, oobn, _, addr, err := conn.ReadMsgUDP(buffer, oob)
 			if err != nil {
-				doneChan <- err
-				return
+				server.countError(ErrorRead)
+				return err
 			}
 			log.Printf("packet-received: bytes=%d from=%s\n",
 				n, addr.String())
+			server.countReceived(addr, n)
+			reply := buffer[:n]
+			if reflect {
+				reply = udpReflection(addr, oob[:oobn], serverPort, identity)
+			}
 			deadline := time.Now().Add(20 * time.Second)
 			err = pc.SetWriteDeadline(deadline)
 			if err != nil {
-				doneChan <- err
-				return
+				server.countError(ErrorWrite)
+				return err
 			}
-			n, err = pc.WriteTo(buffer[:n], addr)
+			n, err = pc.WriteTo(reply, addr)
 			if err != nil {
-				doneChan <- err
-				return
+				server.countError(ErrorWrite)
+				return err
 			}
+			server.countEchoed(addr, n)
 			log.Printf("packet-written: bytes=%d to=%s\n", n, addr.String())
 		}
-	}()
-	var err error
-	select {
-	case err = <-doneChan:
-		log.Printf("error occurred: %s", err)
+	})
+	return server, nil
+}
+
+// udpReflection returns the reflection of the datagram, local address and interface come from the packet info
+func udpReflection(source *net.UDPAddr, oob []byte, serverPort int, identity string) []byte {
+	var destination net.Addr
+	interfaceName := ""
+	ip, index := netutils.ParsePacketInfo(oob)
+	if ip != nil {
+		destination = &net.UDPAddr{IP: ip, Port: serverPort}
+	}
+	if index != 0 {
+		intFace, err := net.InterfaceByIndex(index)
+		if err == nil {
+			interfaceName = intFace.Name
+		}
 	}
-	return
+	reflection := netutils.NewReflection(source, destination, interfaceName)
+	reflection.Identity = identity
+	log.Printf("Reflect %s", reflection)
+	return reflection.Marshal()
 }
@@ -0,0 +1,39 @@
+package servers
+
+import (
+	"net"
+	"testing"
+)
+
+func TestDirectedBroadcast(t *testing.T) {
+	tests := []struct {
+		prefix string
+		want   string
+	}{
+		{prefix: "10.10.0.1/24", want: "10.10.0.255"},
+		{prefix: "192.168.1.65/26", want: "192.168.1.127"},
+		{prefix: "172.16.5.4/12", want: "172.31.255.255"},
+		{prefix: "10.0.0.1/31", want: "10.0.0.1"},
+		{prefix: "10.0.0.1/32", want: "10.0.0.1"},
+		{prefix: "10.0.0.1/0", want: "255.255.255.255"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.prefix, func(t *testing.T) {
+			ip, ipNet, err := net.ParseCIDR(tt.prefix)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the interface address keeps its host bits
+			ipNet.IP = ip
+			if got := directedBroadcast(ipNet).String(); got != tt.want {
+				t.Errorf("directedBroadcast(%s) = %s, want %s", tt.prefix, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDirectedBroadcastAddressRequiresInterface(t *testing.T) {
+	if _, err := DirectedBroadcastAddress(""); err == nil {
+		t.Error("DirectedBroadcastAddress without interface returned no error")
+	}
+}